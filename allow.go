@@ -0,0 +1,106 @@
+package portal
+
+import (
+	"net"
+	"strings"
+)
+
+// addressPattern is a parsed pattern of AllowAddresses
+type addressPattern struct {
+	// Host in lower case without a trailing dot, or the suffix with its dot for a wildcard
+	host     string
+	wildcard bool
+	// IP for an IP address host, which matches other forms of the same address
+	ip net.IP
+	// Empty for any port
+	port string
+}
+
+// AllowAddresses returns a function for AllowDestination that allows only the addresses
+// matching one of the patterns. A pattern is host:port, with these forms:
+//
+//	db.internal:5432      the host and port
+//	*.internal:443        any subdomain of internal, but not internal itself, on the port
+//	10.0.0.1:*            the host on any port, as does a pattern without a port
+//	[fd00::1]:22          an IPv6 address, in brackets with a port like in addresses
+//
+// Host names match case-insensitively, and IP addresses match in any notation. Host names are
+// not resolved, so a name does not match its IP address. Invalid patterns match nothing.
+// The addresses it allows are explicitly allowed for BlockPrivateMetadata
+func AllowAddresses(patterns ...string) func(address string) bool {
+	var ps []addressPattern
+	for _, s := range patterns {
+		if p, ok := parseAddressPattern(s); ok {
+			ps = append(ps, p)
+		}
+	}
+	return func(address string) bool {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return false
+		}
+		host = normalizeHost(host)
+		ip := net.ParseIP(host)
+		for _, p := range ps {
+			if p.match(host, ip, port) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func parseAddressPattern(s string) (addressPattern, bool) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port, or a bare IPv6 address
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		port = "*"
+	}
+	if port == "*" {
+		port = ""
+	}
+	host = normalizeHost(host)
+	p := addressPattern{host: host, port: port}
+	if strings.HasPrefix(host, "*.") {
+		p.host = host[1:]
+		p.wildcard = true
+	} else {
+		p.ip = net.ParseIP(host)
+	}
+	if p.host == "" || p.host == "." || strings.Contains(p.host, "*") {
+		return p, false
+	}
+	return p, true
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// normalizeAddress returns the address with the host normalized like for AllowAddresses, and an
+// IP address in its canonical form, so that the same destination is always the same string
+func normalizeAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return normalizeHost(address)
+	}
+	host = normalizeHost(host)
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (p *addressPattern) match(host string, ip net.IP, port string) bool {
+	if p.port != "" && p.port != port {
+		return false
+	}
+	if p.wildcard {
+		return ip == nil && strings.HasSuffix(host, p.host)
+	}
+	if p.ip != nil {
+		return ip != nil && p.ip.Equal(ip)
+	}
+	return host == p.host
+}
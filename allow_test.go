@@ -0,0 +1,31 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestSetAllowDestination changes the policy while serving. The next connect is refused, and the
+// session already established is not affected
+func TestSetAllowDestination(t *testing.T) {
+	address := listen(t, echo)
+	remote := &Tunnel{AllowDestination: func(string) bool { return true }}
+	coch := serveTunnel(t, &Tunnel{}, remote)
+	c := dial(t, coch, address)
+
+	remote.SetAllowDestination(func(string) bool { return false })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := DialThrough(ctx, coch, address); !errors.Is(err, ErrServiceUnavailable) {
+		t.Fatalf("got %v, want ErrServiceUnavailable", err)
+	}
+
+	io.WriteString(c, "hi")
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hi" {
+		t.Fatalf("got %q %v", b, err)
+	}
+}
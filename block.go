@@ -0,0 +1,87 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// DefaultBlockedNetworks are the networks blocked by BlockPrivateMetadata unless BlockedNetworks is set
+var DefaultBlockedNetworks = parseNetworks(
+	// Unspecified, which connects to this host
+	"0.0.0.0/8",
+	"::/128",
+	// Loopback
+	"127.0.0.0/8",
+	"::1/128",
+	// Link-local, including the metadata address 169.254.169.254 of most clouds
+	"169.254.0.0/16",
+	"fe80::/10",
+	// AWS IPv6 metadata
+	"fd00:ec2::254/128",
+	// Alibaba Cloud metadata
+	"100.100.100.200/32",
+)
+
+var errBlockedAddress = errors.New("blocked address")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// blockControl is the net.Dialer control function refusing blocked addresses.
+// It is called with the resolved address of each connection attempt
+func (tn *Tunnel) blockControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || tn.blockedIP(ip) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+func (tn *Tunnel) blockedIP(ip net.IP) bool {
+	nets := tn.BlockedNetworks
+	if nets == nil {
+		nets = DefaultBlockedNetworks
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve looks up the addresses of the host of address, for DryRun. With block, it fails if any
+// of them is blocked, as dialing with blockControl would when trying that address
+func (tn *Tunnel) resolve(ctx context.Context, address string, block bool) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		if block && tn.blockedIP(a.IP) {
+			return nil, errBlockedAddress
+		}
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
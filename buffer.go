@@ -0,0 +1,82 @@
+package portal
+
+import "sync/atomic"
+
+// bufferAccount counts the data of a session held in memory by its queue, for MaxBufferedBytes.
+// The counts are atomic, as every queue updates them on each enqueue and dequeue
+type bufferAccount struct {
+	tn *Tunnel
+	si *sessionInfo
+}
+
+func (b *bufferAccount) add(n int) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&b.si.buffered, int64(n))
+	atomic.AddInt64(&b.tn.counters.bufferedBytes, int64(n))
+}
+
+// pressure is whether the queues of the tunnel hold three quarters of MaxBufferedBytes or more
+func (b *bufferAccount) pressure() bool {
+	return b.tn.bufferPressure()
+}
+
+func (tn *Tunnel) bufferPressure() bool {
+	if tn.MaxBufferedBytes <= 0 {
+		return false
+	}
+	return tn.bufferedBytes() >= tn.MaxBufferedBytes/4*3
+}
+
+func (tn *Tunnel) bufferedBytes() int64 {
+	return atomic.LoadInt64(&tn.counters.bufferedBytes)
+}
+
+// shedBuffered closes the session with the most data held in memory if the queues hold
+// MaxBufferedBytes or more, not counting the sessions already shed and still draining.
+// Called by the mapper before delivering data
+func (tn *Tunnel) shedBuffered(maps ...map[int32]*session) {
+	if tn.MaxBufferedBytes <= 0 {
+		return
+	}
+	total := tn.bufferedBytes()
+	if total < tn.MaxBufferedBytes {
+		return
+	}
+	var largest *session
+	var size int64
+	for _, m := range maps {
+		for _, s := range m {
+			n := atomic.LoadInt64(&s.info.buffered)
+			if s.shed {
+				total -= n
+			} else if n > size {
+				largest, size = s, n
+			}
+		}
+	}
+	if total < tn.MaxBufferedBytes || largest == nil {
+		return
+	}
+	tn.warnf("mapper buffer limit reached, shedding session. buffered=%d conn=%s session_buffered=%d", total, largest.info.address, size)
+	tn.counters.add(&tn.counters.sessionsShed, 1)
+	largest.shed = true
+	largest.closeCode = ClosePolicy
+	largest.closeReason = "buffer limit"
+	// Fail the writes so that the queue drains right away
+	largest.info.abort()
+	largest.close()
+}
+
+const defaultOutputBuffer = 64
+
+// outputBuffer returns OutputBuffer, or its default. Zero for no buffer
+func (tn *Tunnel) outputBuffer() int {
+	if tn.OutputBuffer < 0 {
+		return 0
+	} else if tn.OutputBuffer == 0 {
+		return defaultOutputBuffer
+	}
+	return tn.OutputBuffer
+}
@@ -0,0 +1,93 @@
+package portal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMaxBufferedBytes queues data for a destination that does not read past MaxBufferedBytes,
+// which sheds that session while another one goes on
+func TestMaxBufferedBytes(t *testing.T) {
+	const max = 256 * 1024
+	const window = 1 << 20
+	remote := &Tunnel{WindowSize: window, MaxBufferedBytes: max}
+	coch := serveTunnel(t, &Tunnel{WindowSize: window}, remote)
+	stuck := listen(t, func(c net.Conn) {
+		defer c.Close()
+		// Not reading until the session is shed
+		waitFor(t, "shedding", func() bool { return remote.Stats().SessionsShed > 0 })
+	})
+	c := dial(t, coch, stuck)
+	other := dial(t, coch, listen(t, echo))
+	// Past what the socket buffers of the destination take
+	go c.Write(make([]byte, 64*window))
+
+	waitFor(t, "shedding", func() bool { return remote.Stats().SessionsShed > 0 })
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		t.Fatalf("got %v, want the shed session closed", err)
+	}
+	waitFor(t, "the queue drained", func() bool { return remote.Stats().BufferedBytes == 0 })
+	if s := remote.Stats(); s.SessionsShed != 1 || s.MaxBufferedBytes != max {
+		t.Fatalf("got %d shed of the limit %d", s.SessionsShed, s.MaxBufferedBytes)
+	}
+	transfer(t, other, 100)
+}
+
+// stallingFramer stalls every so many writes, like a transport with latency spikes
+type stallingFramer struct {
+	Framer
+	every  int64
+	stall  time.Duration
+	writes int64
+}
+
+func (f *stallingFramer) Write(b []byte) error {
+	if atomic.AddInt64(&f.writes, 1)%f.every == 0 {
+		time.Sleep(f.stall)
+	}
+	return f.Framer.Write(b)
+}
+
+// BenchmarkOutputBuffer churns short sessions while a download keeps a transport stalling 20ms
+// every 20 writes busy, and reports the p99 time the mapper of the downloading side takes to
+// handle a message, without and with OutputBuffer
+func BenchmarkOutputBuffer(b *testing.B) {
+	bulk := listen(b, func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	})
+	address := listen(b, echo)
+	for _, size := range []int{-1, 0} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			remote := &Tunnel{OutputBuffer: size}
+			ca, cb := net.Pipe()
+			fb := &stallingFramer{Framer: NewConnFramer(cb), every: 20, stall: 20 * time.Millisecond}
+			coch := serveFramers(b, &Tunnel{}, remote, NewConnFramer(ca), fb)
+			go io.Copy(io.Discard, dial(b, coch, bulk))
+			buf := make([]byte, 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c := dial(b, coch, address)
+				if _, err := c.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(c, buf); err != nil {
+					b.Fatal(err)
+				}
+				c.Close()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(remote.Stats().MapperP99Latency.Microseconds()), "mapper-p99-us")
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package portal
+
+import "math"
+
+const defaultCapacityHighWater = 0.8
+
+// sessionCapacity is the most sessions open at the same time, MaxSessions or the ids of the
+// sessions initiated on this side
+func (tn *Tunnel) sessionCapacity() int {
+	if tn.MaxSessions > 0 {
+		return tn.MaxSessions
+	}
+	return math.MaxInt32
+}
+
+// sessionHighWater is the number of open sessions for OnCapacityWarning
+func (tn *Tunnel) sessionHighWater() int {
+	r := tn.CapacityHighWater
+	if r <= 0 || r > 1 {
+		r = defaultCapacityHighWater
+	}
+	hw := int(float64(tn.sessionCapacity()) * r)
+	if hw < 1 {
+		hw = 1
+	}
+	return hw
+}
+
+// checkCapacity is called by the mapper when the number of open sessions changes.
+// warned is whether the high-water mark was reached without recovering since.
+// Recovery is below 90% of the mark, so that sessions opening and closing around the mark
+// do not call back on every change
+func (tn *Tunnel) checkCapacity(active int, warned *bool) {
+	hw := tn.sessionHighWater()
+	if !*warned && active >= hw {
+		*warned = true
+		tn.warnf("mapper session capacity warning. active=%d max=%d", active, tn.sessionCapacity())
+		if tn.OnCapacityWarning != nil {
+			tn.OnCapacityWarning(active, tn.sessionCapacity())
+		}
+	} else if *warned && active < hw-hw/10 {
+		*warned = false
+		tn.logf("mapper session capacity recovered. active=%d max=%d", active, tn.sessionCapacity())
+		if tn.OnCapacityRecovered != nil {
+			tn.OnCapacityRecovered(active, tn.sessionCapacity())
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package portal
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+// TestCapacityWarning opens sessions past the high-water mark and closes them below it, which
+// calls back once each time, not on every session around the mark
+func TestCapacityWarning(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) func(active, max int) {
+		return func(active, max int) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, fmt.Sprintf("%s %d/%d", name, active, max))
+		}
+	}
+	got := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), calls...)
+	}
+	tn := &Tunnel{MaxSessions: 20, OnCapacityWarning: record("warning"), OnCapacityRecovered: record("recovered")}
+	coch := serveTunnel(t, tn, &Tunnel{})
+	address := listen(t, echo)
+	var conns []net.Conn
+	open := func(n int) {
+		for ; n > 0; n-- {
+			conns = append(conns, dial(t, coch, address))
+		}
+		waitFor(t, "sessions open", func() bool { return tn.ActiveSessions() == len(conns) })
+	}
+	closeConns := func(n int) {
+		for ; n > 0; n-- {
+			conns[len(conns)-1].Close()
+			conns = conns[:len(conns)-1]
+		}
+		waitFor(t, "sessions closed", func() bool { return tn.ActiveSessions() == len(conns) })
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		if c := got(); fmt.Sprint(c) != fmt.Sprint(want) {
+			t.Fatalf("got %q, want %q", c, want)
+		}
+	}
+
+	open(15)
+	expect()
+	open(1)
+	expect("warning 16/20")
+	// Around the mark, and up to the limit
+	open(4)
+	closeConns(5)
+	expect("warning 16/20")
+	closeConns(1)
+	expect("warning 16/20", "recovered 14/20")
+	open(2)
+	expect("warning 16/20", "recovered 14/20", "warning 16/20")
+	if s := tn.Stats(); s.SessionHighWater != 16 || s.SessionCapacity != 20 {
+		t.Fatalf("got high-water mark %d of %d", s.SessionHighWater, s.SessionCapacity)
+	}
+}
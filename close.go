@@ -0,0 +1,46 @@
+package portal
+
+// CloseCode tells the other side why a session was disconnected
+type CloseCode int32
+
+const (
+	// CloseUnspecified is for a normal close, or from a version of the other side without close codes
+	CloseUnspecified CloseCode = 0
+	// CloseReadError is for an error reading the proxied connection
+	CloseReadError CloseCode = 1
+	// CloseReadTimeout is for ReadTimeout expiring on the proxied connection
+	CloseReadTimeout CloseCode = 2
+	// ClosePolicy is for a session closed by the tunnel, e.g. by CloseOnQuota
+	ClosePolicy CloseCode = 3
+	// CloseIdleTimeout is for IdleTimeout expiring on the session
+	CloseIdleTimeout CloseCode = 4
+	// CloseWriteTimeout is for WriteTimeout expiring on the proxied connection
+	CloseWriteTimeout CloseCode = 5
+)
+
+func (c CloseCode) String() string {
+	switch c {
+	case CloseUnspecified:
+		return "unspecified"
+	case CloseReadError:
+		return "read error"
+	case CloseReadTimeout:
+		return "read timeout"
+	case ClosePolicy:
+		return "policy"
+	case CloseIdleTimeout:
+		return "idle timeout"
+	case CloseWriteTimeout:
+		return "write timeout"
+	}
+	return "unknown"
+}
+
+// SessionClose is the reason the other side gave for disconnecting a session
+type SessionClose struct {
+	// Address the session was connected to
+	Address string
+	Code    CloseCode
+	// Reason is a description for logging. Empty if not given
+	Reason string
+}
@@ -0,0 +1,171 @@
+package portal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// Compression is the algorithm DATA is compressed with over the tunnel, see Tunnel.Compression
+type Compression uint32
+
+const (
+	// CompressionNone sends DATA as read
+	CompressionNone Compression = iota
+
+	// CompressionGzip compresses DATA with gzip
+	CompressionGzip
+
+	// CompressionZstd compresses DATA with zstd, which is faster than gzip for about the same ratio
+	CompressionZstd
+)
+
+// ErrCompression is the error the tunnel connection is closed with when the compressed DATA from
+// the other side cannot be decompressed
+var ErrCompression = errors.New("invalid compressed data")
+
+// compressionThreshold is the default of CompressionThreshold
+const compressionThreshold = 256
+
+// maxDecompressedSize is the most data of a compressed DATA message. The sender compresses no
+// more than that, so more is from a broken or hostile sender
+const maxDecompressedSize = 16 << 20
+
+// compressionOverhead is the size of the compression field in a message, which the compressed
+// data must save on top to be worth it
+const compressionOverhead = 3
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+// zstdWriter returns the zstd encoder shared by all tunnels, which is safe for concurrent use
+// with EncodeAll
+func zstdWriter() *zstd.Encoder {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+	})
+	return zstdEncoder
+}
+
+// zstdDecoders are the idle stream decoders of decompress. A decoder runs a goroutine until it
+// is closed, so the ones that do not fit are closed instead of left to the garbage collector
+var zstdDecoders = make(chan *zstd.Decoder, 8)
+
+// zstdReader returns an idle stream decoder of r, or a new one
+func zstdReader(r io.Reader) (*zstd.Decoder, error) {
+	select {
+	case d := <-zstdDecoders:
+		if err := d.Reset(r); err != nil {
+			d.Close()
+			return nil, err
+		}
+		return d, nil
+	default:
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	}
+}
+
+// putZstdReader keeps a decoder that read its stream to the end for the next decompress
+func putZstdReader(d *zstd.Decoder) {
+	select {
+	case zstdDecoders <- d:
+	default:
+		d.Close()
+	}
+}
+
+func (c Compression) valid() bool {
+	return c <= CompressionZstd
+}
+
+// compressionThreshold returns CompressionThreshold, or the default
+func (tn *Tunnel) compressionThreshold() int {
+	if tn.CompressionThreshold > 0 {
+		return tn.CompressionThreshold
+	}
+	return compressionThreshold
+}
+
+// compress compresses the data of a DATA message to be written with Compression, if the other side
+// can decompress it by the features f of the tunnel connection. The data is left as it is when it is below CompressionThreshold, or when
+// compressing does not make it smaller, e.g. data already compressed
+func (tn *Tunnel) compress(co *message.Message, f Features) {
+	if tn.Compression == CompressionNone || co.Type != message.Message_DATA ||
+		len(co.Buf) < tn.compressionThreshold() || len(co.Buf) > maxDecompressedSize ||
+		!f.Compression {
+		return
+	}
+	var b []byte
+	switch tn.Compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		w.Reset(&buf)
+		w.Write(co.Buf)
+		w.Close()
+		gzipWriters.Put(w)
+		b = buf.Bytes()
+	case CompressionZstd:
+		b = zstdWriter().EncodeAll(co.Buf, nil)
+	default:
+		return
+	}
+	if len(b)+compressionOverhead >= len(co.Buf) {
+		return
+	}
+	co.Buf = b
+	co.Compression = uint32(tn.Compression)
+}
+
+// decompress restores the data of a message from the other side compressed with any of the algorithms
+func decompress(co *message.Message) error {
+	if co.Compression == 0 {
+		return nil
+	}
+	var b []byte
+	var err error
+	switch Compression(co.Compression) {
+	case CompressionGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(co.Buf)); err == nil {
+			b, err = readDecompressed(r)
+		}
+	case CompressionZstd:
+		// Streamed like gzip, so that the data is only decoded up to the limit
+		var d *zstd.Decoder
+		if d, err = zstdReader(bytes.NewReader(co.Buf)); err == nil {
+			if b, err = readDecompressed(d); err == nil {
+				putZstdReader(d)
+			} else {
+				d.Close()
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown compression %d", co.Compression)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCompression, err)
+	}
+	co.Buf = b
+	co.Compression = 0
+	return nil
+}
+
+// readDecompressed reads the decompressed data to the end, failing over maxDecompressedSize
+func readDecompressed(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err == nil && len(b) > maxDecompressedSize {
+		err = errors.New("data too large")
+	}
+	return b, err
+}
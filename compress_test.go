@@ -0,0 +1,82 @@
+package portal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("compress me ", 1000))
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		tn := &Tunnel{Compression: c}
+		// Many times, so that the zstd decoders are reused
+		for i := 0; i < 20; i++ {
+			co := &message.Message{Type: message.Message_DATA, Buf: data}
+			tn.compress(co, Features{Compression: true})
+			if Compression(co.Compression) != c || len(co.Buf) >= len(data) {
+				t.Fatalf("%d: not compressed", c)
+			}
+			if err := decompress(co); err != nil {
+				t.Fatalf("%d: %v", c, err)
+			}
+			if !bytes.Equal(co.Buf, data) {
+				t.Fatalf("%d: data mismatch", c)
+			}
+		}
+	}
+}
+
+// TestDecompressLimit checks that data decompressing to more than maxDecompressedSize, which the
+// sender never compresses, fails instead of being decoded whole
+func TestDecompressLimit(t *testing.T) {
+	big := make([]byte, maxDecompressedSize+1)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(big)
+	w.Close()
+	tests := []struct {
+		name string
+		co   *message.Message
+	}{
+		{name: "gzip", co: &message.Message{Compression: uint32(CompressionGzip), Buf: gz.Bytes()}},
+		{name: "zstd", co: &message.Message{Compression: uint32(CompressionZstd), Buf: zstdWriter().EncodeAll(big, nil)}},
+		{name: "zstd invalid", co: &message.Message{Compression: uint32(CompressionZstd), Buf: []byte("not zstd")}},
+		{name: "unknown", co: &message.Message{Compression: 99, Buf: []byte("x")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := decompress(tt.co); !errors.Is(err, ErrCompression) {
+				t.Fatalf("got %v, want ErrCompression", err)
+			}
+		})
+	}
+
+	// The decoders still work after a failure
+	co := &message.Message{Compression: uint32(CompressionZstd), Buf: zstdWriter().EncodeAll([]byte("ok"), nil)}
+	if err := decompress(co); err != nil || string(co.Buf) != "ok" {
+		t.Fatalf("got %q %v", co.Buf, err)
+	}
+}
+
+// TestCompressEcho sends compressible data through the tunnel with each algorithm
+func TestCompressEcho(t *testing.T) {
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		coch := serveTunnel(t, &Tunnel{Compression: c}, &Tunnel{Compression: c})
+		conn := dial(t, coch, listen(t, echo))
+		msg := strings.Repeat("compress me ", 10000)
+		go io.WriteString(conn, msg)
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != msg {
+			t.Fatalf("%d: echo mismatch", c)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package portal
+
+import (
+	"context"
+	"sync"
+)
+
+// tunnelConn is the state of one tunnel connection being served. A Tunnel may serve several
+// connections at the same time, so the state of each is kept apart from the Tunnel, and the
+// goroutines of the connection reach it through the context of the connection
+type tunnelConn struct {
+	summary   summary
+	handshake handshake
+	quota     quota
+}
+
+// connOf returns the state of the tunnel connection of ctx
+func connOf(ctx context.Context) *tunnelConn {
+	return ctx.Value(connStateKey).(*tunnelConn)
+}
+
+// connections tracks the tunnel connections served by a Tunnel, for its methods about the
+// current one, e.g. Features. With several at the same time, that is the one started last
+type connections struct {
+	mu sync.Mutex
+	// The connection started last, kept after it ends until the next one starts
+	latest *tunnelConn
+	// Closed when a connection starts
+	started chan struct{}
+}
+
+func (cs *connections) start(tc *tunnelConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.latest = tc
+	if cs.started != nil {
+		close(cs.started)
+		cs.started = nil
+	}
+}
+
+// current returns the connection started last, or nil and a channel closed when one starts
+func (cs *connections) current() (*tunnelConn, <-chan struct{}) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.latest != nil {
+		return cs.latest, nil
+	}
+	if cs.started == nil {
+		cs.started = make(chan struct{})
+	}
+	return nil, cs.started
+}
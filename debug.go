@@ -0,0 +1,185 @@
+package portal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// sessionInfo is shared by the mapper, proxyReader and proxyWriter of a session.
+// The bytes of the proxied connection are updated atomically by the proxyReader and proxyWriter
+// and read by the mapper for DebugDump
+type sessionInfo struct {
+	read    int64
+	written int64
+	// Data held in memory by the queue of the session, for MaxBufferedBytes
+	buffered int64
+	// Messages in the queue of the session with flow control
+	queued int64
+	// Time of the last data read or written in unix nanoseconds, for IdleTimeout.
+	// 0 until the proxyReader starts
+	active int64
+	// Address the session connects to. Also describes the connection in logs if it has no addresses
+	address string
+	// Receive window of this side for the session, set when it is created. 0 for no flow control
+	window int
+	// Most DATA messages queued for the session with the window, by MaxQueuedMessagesPerSession.
+	// 0 for no limit
+	maxQueued int
+	// Channel of the data of the session to the other side by SessionPriority. nil for the tunnel channel
+	lane chan<- *message.Message
+	// Session of datagrams, see ConnectOperation.Datagram. Set before its goroutines start
+	datagram bool
+	// Set atomically by the proxyWriter when a write timed out, for the proxyReader to tell why it ends
+	writeTimedOut int32
+
+	// The proxied connection once connected, for the mapper to abort it
+	mu      sync.Mutex
+	conn    net.Conn
+	aborted bool
+}
+
+// setConn records the proxied connection once connected. It is closed right away if the
+// session was aborted before
+func (si *sessionInfo) setConn(c net.Conn) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.conn = c
+	if si.aborted {
+		c.Close()
+	}
+}
+
+// connected is whether the proxied connection is set
+func (si *sessionInfo) connected() bool {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	return si.conn != nil
+}
+
+// abort closes the proxied connection, unblocking a write of the proxyWriter to it
+func (si *sessionInfo) abort() {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.aborted = true
+	if si.conn != nil {
+		si.conn.Close()
+	}
+}
+
+// dumpers are the dump request channels of the mappers of the tunnel connections being served
+type dumpers struct {
+	mu  sync.Mutex
+	chs map[chan chan<- string]time.Time
+}
+
+func (d *dumpers) add() chan chan<- string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.chs == nil {
+		d.chs = make(map[chan chan<- string]time.Time)
+	}
+	ch := make(chan chan<- string)
+	d.chs[ch] = time.Now()
+	return ch
+}
+
+// oldest returns when the longest served tunnel connection started, or the zero time without one
+func (d *dumpers) oldest() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var t time.Time
+	for _, started := range d.chs {
+		if t.IsZero() || started.Before(t) {
+			t = started
+		}
+	}
+	return t
+}
+
+func (d *dumpers) remove(ch chan chan<- string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.chs, ch)
+}
+
+// DebugDump writes a human-readable snapshot of the tunnel for debugging: the options,
+// the statistics, and the sessions of each tunnel connection being served.
+// The sessions are gathered from the mappers, waiting up to a second for a busy one.
+// The format is best effort and may change between versions. It is not meant to be parsed
+func (tn *Tunnel) DebugDump(w io.Writer) {
+	fmt.Fprintf(w, "tunnel profile=%q read_timeout=%v read_buffer_size=%d window_size=%d keepalive_interval=%v max_total_bytes=%d quota_exceeded=%v\n",
+		tn.Profile, tn.ReadTimeout, tn.readBufferSize(), tn.windowSize(), tn.KeepaliveInterval, tn.MaxTotalBytes, tn.QuotaExceeded())
+	st := tn.Stats()
+	fmt.Fprintf(w, "stats uptime=%v active_sessions=%d connects=%d connect_errors=%d bytes_read=%d bytes_written=%d goroutines=%d keepalive_rtt=%v mapper_p99=%v\n",
+		st.Uptime.Round(time.Millisecond), st.ActiveSessions, st.Connects, st.ConnectErrors, st.BytesRead, st.BytesWritten, st.Goroutines, st.KeepaliveRTT, st.MapperP99Latency)
+	fmt.Fprintf(w, "stats read_first_byte=%+v write_first_byte=%+v\n", st.ReadFirstByte, st.WriteFirstByte)
+
+	tn.dumpers.mu.Lock()
+	chs := make(map[chan chan<- string]time.Time, len(tn.dumpers.chs))
+	for ch, t := range tn.dumpers.chs {
+		chs[ch] = t
+	}
+	tn.dumpers.mu.Unlock()
+	for ch, started := range chs {
+		fmt.Fprintf(w, "connection age=%v\n", time.Since(started).Round(time.Millisecond))
+		r := make(chan string, 1)
+		select {
+		case ch <- r:
+			io.WriteString(w, <-r)
+		case <-time.After(time.Second):
+			fmt.Fprintln(w, "  mapper busy")
+		}
+	}
+}
+
+// dumpSessions formats the sessions of a mapper for DebugDump
+func dumpSessions(lm map[int32]*session, rm map[int32]*session, lcm map[int32]net.Conn) string {
+	var b strings.Builder
+	for _, m := range []struct {
+		origin string
+		m      map[int32]*session
+	}{{"local", lm}, {"remote", rm}} {
+		ids := make([]int, 0, len(m.m))
+		for id := range m.m {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			s := m.m[int32(id)]
+			state := "connected"
+			if _, ok := lcm[int32(id)]; ok && m.origin == "local" {
+				state = "connecting"
+			} else if s.closed {
+				state = "closed"
+			} else if s.sent && s.received {
+				state = "closing"
+			} else if s.sent {
+				state = "sent_last"
+			} else if s.received {
+				state = "received_last"
+			}
+			fmt.Fprintf(&b, "  session origin=%s id=%d address=%s age=%v state=%s read=%d written=%d",
+				m.origin, id, s.info.address, time.Since(s.created).Round(time.Millisecond), state,
+				atomic.LoadInt64(&s.info.read), atomic.LoadInt64(&s.info.written))
+			if s.window != nil {
+				fmt.Fprintf(&b, " unacked=%d/%d", s.window.unacked(), s.window.size)
+			}
+			if s.info.window > 0 {
+				fmt.Fprintf(&b, " queued=%d", atomic.LoadInt64(&s.info.queued))
+				if s.info.maxQueued > 0 {
+					fmt.Fprintf(&b, "/%d", s.info.maxQueued)
+				}
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
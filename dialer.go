@@ -0,0 +1,173 @@
+package portal
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Dialer connects the tunnel client to the tunnel server and returns the framer of the connection.
+// The zero value dials plain TCP with ConnFramer
+type Dialer struct {
+	// TLSConfig enables TLS with the config. nil for plain connection
+	TLSConfig *tls.Config
+
+	// Timeout is the maximum time for connecting, including the proxy and TLS handshakes. Zero for no timeout
+	Timeout time.Duration
+
+	// KeepAlive is the TCP keep-alive period as in net.Dialer. Zero for the default, and negative to disable
+	KeepAlive time.Duration
+
+	// Proxy returns the upstream HTTP proxy for the tunnel connection, e.g. http.ProxyFromEnvironment.
+	// The request has the tunnel URL only. No proxy if nil or it returns nil URL
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Websocket connects with websocket and uses WebsocketFramer
+	Websocket bool
+
+	// Path is the websocket path of the tunnel endpoint. Defaults to "/tunnel"
+	Path string
+
+	// Header is sent with the websocket handshake, e.g. Authorization
+	Header http.Header
+}
+
+// Dial connects to the tunnel server at address <host>:<port>
+func (d *Dialer) Dial(ctx context.Context, address string) (Framer, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	nd := &net.Dialer{KeepAlive: d.KeepAlive}
+	if d.Websocket {
+		return d.dialWebsocket(ctx, nd, address)
+	}
+
+	c, err := d.dialConn(ctx, nd, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.TLSConfig != nil {
+		cfg := d.TLSConfig.Clone()
+		if cfg.ServerName == "" {
+			host, _, _ := net.SplitHostPort(address)
+			cfg.ServerName = host
+		}
+		tc := tls.Client(c, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	return NewConnFramer(c), nil
+}
+
+func (d *Dialer) dialWebsocket(ctx context.Context, nd *net.Dialer, address string) (Framer, error) {
+	u := url.URL{
+		Scheme: "ws",
+		Host:   address,
+		Path:   d.Path,
+	}
+	if d.TLSConfig != nil {
+		u.Scheme = "wss"
+	}
+	if u.Path == "" {
+		u.Path = "/tunnel"
+	}
+	options := &websocket.DialOptions{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext:     nd.DialContext,
+				TLSClientConfig: d.TLSConfig,
+				Proxy:           d.Proxy,
+			},
+		},
+		HTTPHeader: d.Header,
+	}
+	c, _, err := websocket.Dial(ctx, u.String(), options)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebsocketFramer(c), nil
+}
+
+// dialConn connects with TCP directly or through the proxy
+func (d *Dialer) dialConn(ctx context.Context, nd *net.Dialer, address string) (net.Conn, error) {
+	var pu *url.URL
+	if d.Proxy != nil {
+		u := &url.URL{Scheme: "http", Host: address}
+		if d.TLSConfig != nil {
+			u.Scheme = "https"
+		}
+		var err error
+		if pu, err = d.Proxy(&http.Request{Method: http.MethodConnect, URL: u, Header: http.Header{}}); err != nil {
+			return nil, err
+		}
+	}
+	if pu == nil {
+		return nd.DialContext(ctx, "tcp", address)
+	}
+	if pu.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", pu.Scheme)
+	}
+	proxyAddress := pu.Host
+	if pu.Port() == "" {
+		proxyAddress = net.JoinHostPort(pu.Hostname(), "80")
+	}
+	c, err := nd.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if c, err = proxyConnect(ctx, c, pu, address); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// proxyConnect sends HTTP CONNECT to the proxy and returns the connection to the address
+func proxyConnect(ctx context.Context, c net.Conn, pu *url.URL, address string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if pu.User != nil {
+		p, _ := pu.User.Password()
+		userpw := pu.User.Username() + ":" + p
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(userpw)))
+	}
+	if err := req.Write(c); err != nil {
+		return c, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return c, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("proxy connect failed: %s", res.Status)
+	}
+	if br.Buffered() > 0 {
+		// Server sent data right after the response
+		return &bufferedConn{Conn: c, r: io.MultiReader(br, c)}, nil
+	}
+	return c, nil
+}
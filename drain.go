@@ -0,0 +1,74 @@
+package portal
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDrained is why the tunnel connection ended after Drain, in Summary.Err. Serve returns nil for it
+var ErrDrained = errors.New("tunnel drained")
+
+// Drain stops the tunnel from taking new sessions while the open ones finish, e.g. before a
+// redeploy. Sessions initiated on either side are refused with service unavailable, and
+// TunnelGroup gives no more connections to the tunnel. Once the last session ends, the tunnel
+// connection is closed cleanly and Serve returns nil. With DrainTimeout, the sessions still open
+// after it are disconnected with ClosePolicy. The tunnel stays drained, including for later calls
+// of Serve
+func (tn *Tunnel) Drain() {
+	tn.drainMu.Lock()
+	defer tn.drainMu.Unlock()
+	if tn.draining {
+		return
+	}
+	tn.draining = true
+	if tn.drainCh == nil {
+		tn.drainCh = make(chan struct{})
+	}
+	close(tn.drainCh)
+}
+
+// Draining is whether Drain was called
+func (tn *Tunnel) Draining() bool {
+	tn.drainMu.Lock()
+	defer tn.drainMu.Unlock()
+	return tn.draining
+}
+
+// drains returns a channel closed when Drain is called
+func (tn *Tunnel) drains() <-chan struct{} {
+	tn.drainMu.Lock()
+	defer tn.drainMu.Unlock()
+	if tn.drainCh == nil {
+		tn.drainCh = make(chan struct{})
+	}
+	return tn.drainCh
+}
+
+// drainTimer returns the channel of the DrainTimeout expiring, or nil without one
+func (tn *Tunnel) drainTimer() (<-chan time.Time, func() bool) {
+	if tn.DrainTimeout <= 0 {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(tn.DrainTimeout)
+	return t.C, t.Stop
+}
+
+// drained waits for the tunnelWriter to close flushed after writing the last messages, for up
+// to ShutdownTimeout, and closes the connection cleanly.
+// It returns early when stop is closed as the tunnel ended anyway
+func (tn *Tunnel) drained(tc *tunnelConn, c Framer, flushed <-chan struct{}, stop <-chan struct{}) {
+	tn.logf("tunnel drained")
+	if d := tn.shutdownTimeout(); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-flushed:
+		case <-timer.C:
+			tn.warnf("tunnel drain timed out before flushing")
+		case <-stop:
+			return
+		}
+	}
+	tc.summary.closed(ErrDrained)
+	c.Close(nil)
+}
@@ -0,0 +1,17 @@
+package portal
+
+import "net"
+
+// DryRunDecision is what a session from the other side would have done, with DryRun
+type DryRunDecision struct {
+	// Address requested by the other side
+	Address string
+	// Destination is the address that would be connected to, after RewriteDestination
+	Destination string
+	// Resolved are the IP addresses of Destination. Empty if refused before resolving it
+	Resolved []net.IP
+	// Allowed is whether the session would be connected
+	Allowed bool
+	// Reason the session would be refused. Empty if allowed
+	Reason string
+}
@@ -0,0 +1,60 @@
+package portal
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDryRun checks the decisions of DryRun for an allowed destination, which reports where it
+// would connect to, and a denied one, without connecting to either
+func TestDryRun(t *testing.T) {
+	var accepted int64
+	address := listen(t, func(c net.Conn) {
+		atomic.AddInt64(&accepted, 1)
+		c.Close()
+	})
+	decisions := make(chan DryRunDecision, 1)
+	remote := &Tunnel{
+		DryRun: true,
+		RewriteDestination: func(a string) (string, error) {
+			if a == "app.example.com:443" {
+				return address, nil
+			}
+			return a, nil
+		},
+		AllowDestination: func(a string) bool { return a == address },
+		OnDryRun:         func(d DryRunDecision) { decisions <- d },
+	}
+	coch := serveTunnel(t, &Tunnel{}, remote)
+
+	for _, tc := range []struct {
+		address string
+		want    DryRunDecision
+	}{
+		{"app.example.com:443", DryRunDecision{Address: "app.example.com:443", Destination: address, Allowed: true}},
+		{"denied.example.com:443", DryRunDecision{Address: "denied.example.com:443", Destination: "denied.example.com:443", Reason: "destination not allowed"}},
+	} {
+		if err := dialErr(coch, tc.address); !errors.Is(err, ErrServiceUnavailable) {
+			t.Fatalf("%s: got %v, want service unavailable", tc.address, err)
+		}
+		var d DryRunDecision
+		select {
+		case d = <-decisions:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no decision", tc.address)
+		}
+		if d.Address != tc.want.Address || d.Destination != tc.want.Destination || d.Allowed != tc.want.Allowed || d.Reason != tc.want.Reason {
+			t.Fatalf("got %+v, want %+v", d, tc.want)
+		}
+		// Only the allowed destination is resolved
+		if tc.want.Allowed != (len(d.Resolved) == 1 && d.Resolved[0].Equal(net.IPv4(127, 0, 0, 1))) {
+			t.Fatalf("%s: resolved %v", tc.address, d.Resolved)
+		}
+	}
+	if n := atomic.LoadInt64(&accepted); n != 0 {
+		t.Fatalf("connected %d times in dry run", n)
+	}
+}
@@ -0,0 +1,114 @@
+package portal
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the events written by LogEventsJSON
+const (
+	eventSessionOpen   = "session_open"
+	eventSessionClose  = "session_close"
+	eventConnectFail   = "connect_fail"
+	eventTunnelClose   = "tunnel_close"
+	eventEventsDropped = "events_dropped"
+)
+
+// eventBuffer is the number of events held for each writer of LogEventsJSON
+const eventBuffer = 1024
+
+// event is a line of LogEventsJSON
+type event struct {
+	Time         time.Time `json:"time"`
+	Type         string    `json:"type"`
+	ID           *int32    `json:"id,omitempty"`
+	Origin       string    `json:"origin,omitempty"`
+	Address      string    `json:"address,omitempty"`
+	BytesRead    int64     `json:"bytes_read,omitempty"`
+	BytesWritten int64     `json:"bytes_written,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	Dropped      int64     `json:"dropped,omitempty"`
+}
+
+// events passes the events to the writers of LogEventsJSON without blocking
+type events struct {
+	mu    sync.Mutex
+	sinks []*eventSink
+}
+
+// eventSink is the buffer of a writer of LogEventsJSON, with the events dropped since its last line
+type eventSink struct {
+	ch      chan event
+	dropped int64
+}
+
+// LogEventsJSON writes the events of the tunnel to w as newline-delimited JSON, one object per
+// line, for as long as the tunnel is used. Each line has these fields, those not applying left out:
+//
+//	time           RFC 3339 time of the event
+//	type           session_open, session_close, connect_fail, tunnel_close or events_dropped
+//	id             id of the session on the tunnel connection
+//	origin         local for sessions initiated on this side, remote for the other side
+//	address        address the session connects to
+//	bytes_read     bytes read from the proxied connection, or all of them for tunnel_close
+//	bytes_written  bytes written to the proxied connection, or all of them for tunnel_close
+//	reason         why the session or tunnel connection ended, or the connect failed
+//	dropped        number of events left out since the last line, for events_dropped
+//
+// The events are buffered, and written in order by a goroutine, so a slow w does not hold up the
+// tunnel. When the buffer is full, events are dropped and counted in Stats as EventsDropped, and
+// an events_dropped line with their number is written before the next event. Call it once for
+// each w, as the events go to all of them
+func (tn *Tunnel) LogEventsJSON(w io.Writer) {
+	s := &eventSink{ch: make(chan event, eventBuffer)}
+	tn.events.mu.Lock()
+	tn.events.sinks = append(tn.events.sinks, s)
+	tn.events.mu.Unlock()
+	go func() {
+		enc := json.NewEncoder(w)
+		for e := range s.ch {
+			if d := atomic.SwapInt64(&s.dropped, 0); d > 0 {
+				enc.Encode(event{Time: e.Time, Type: eventEventsDropped, Dropped: d})
+			}
+			enc.Encode(e)
+		}
+	}()
+}
+
+// emit passes the event to the writers of LogEventsJSON, dropping it for those that are behind
+func (tn *Tunnel) emit(e event) {
+	tn.events.mu.Lock()
+	defer tn.events.mu.Unlock()
+	if len(tn.events.sinks) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for _, s := range tn.events.sinks {
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+			tn.counters.add(&tn.counters.eventsDropped, 1)
+		}
+	}
+}
+
+// emitSession emits an event of a session with its bytes
+func (tn *Tunnel) emitSession(typ string, id int32, local bool, si *sessionInfo, reason string) {
+	origin := "remote"
+	if local {
+		origin = "local"
+	}
+	tn.emit(event{
+		Type:         typ,
+		ID:           &id,
+		Origin:       origin,
+		Address:      si.address,
+		BytesRead:    atomic.LoadInt64(&si.read),
+		BytesWritten: atomic.LoadInt64(&si.written),
+		Reason:       reason,
+	})
+}
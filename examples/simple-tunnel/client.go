@@ -3,19 +3,17 @@ package main
 import (
 	"context"
 	"log"
-	"net"
 
 	"github.com/oatcode/portal"
 )
 
 func tunnelClient() {
 	log.Printf("Tunnel client...")
-	c, err := net.Dial("tcp", tunnelAddress)
-	if err != nil {
-		log.Fatalf("Tunnel client dial error: %v", err)
+	d := &portal.Dialer{}
+	dial := func() (portal.Framer, error) {
+		return d.Dial(context.Background(), tunnelAddress)
+	}
+	if err := portal.DialAndServeWithReconnect(context.Background(), dial, &portal.Tunnel{}, nil, portal.Backoff{}); err != nil {
+		log.Fatalf("Tunnel client error: %v", err)
 	}
-	defer c.Close()
-	log.Print("Tunnel client connected")
-
-	portal.TunnelServe(context.Background(), NewNetConnFramer(c), nil)
 }
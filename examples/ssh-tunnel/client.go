@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/oatcode/portal"
+	"github.com/oatcode/portal/pkg/sshtunnel"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func clientAuth() []ssh.AuthMethod {
+	if keyFile == "" {
+		return []ssh.AuthMethod{ssh.Password(password)}
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signer)}
+}
+
+// sshClient connects to the SSH server, establishes the tunnel over the SSH connection,
+// and serves the proxy on this side
+func sshClient() {
+	log.Printf("SSH client...")
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := ssh.Dial("tcp", sshAddress, &ssh.ClientConfig{
+		User:            user,
+		Auth:            clientAuth(),
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		log.Fatalf("SSH dial error: %v", err)
+	}
+	defer c.Close()
+
+	var f portal.Framer
+	if command != "" {
+		f, err = sshtunnel.DialCommand(c, command)
+	} else {
+		f, err = sshtunnel.DialChannel(c)
+	}
+	if err != nil {
+		log.Fatalf("SSH tunnel error: %v", err)
+	}
+	log.Print("SSH tunnel connected")
+
+	coch := make(chan portal.ConnectOperation)
+	go http.ListenAndServe(proxyAddress, portal.NewHTTPHandler(portal.HTTPHandlerOptions{
+		ConnectOperations: coch,
+	}))
+	portal.TunnelServe(context.Background(), f, coch)
+}
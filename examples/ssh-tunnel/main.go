@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/oatcode/portal"
+)
+
+var client bool
+var server bool
+var sshAddress string
+var proxyAddress string
+var user string
+var keyFile string
+var password string
+var knownHostsFile string
+var command string
+var hostKeyFile string
+var authorizedKeysFile string
+
+func main() {
+	flag.BoolVar(&client, "client", false, "Run SSH client with the proxy")
+	flag.BoolVar(&server, "server", false, "Run SSH server accepting tunnel channels")
+	flag.StringVar(&sshAddress, "sshAddress", "", "SSH server [<ip>]:<port>")
+	flag.StringVar(&proxyAddress, "proxyAddress", "", "Proxy [<ip>]:<port>")
+	flag.StringVar(&user, "user", "", "SSH user of the client")
+	flag.StringVar(&keyFile, "key", "", "Private key file of the client")
+	flag.StringVar(&password, "password", "", "Password of the client if no key")
+	flag.StringVar(&knownHostsFile, "knownHosts", "", "known_hosts file to verify the server host key")
+	flag.StringVar(&command, "command", "", "Command serving the tunnel on stdio on the SSH server. Opens a tunnel channel if empty")
+	flag.StringVar(&hostKeyFile, "hostKey", "", "Private host key file of the server")
+	flag.StringVar(&authorizedKeysFile, "authorizedKeys", "", "authorized_keys file of the server")
+	flag.Parse()
+
+	portal.Logf = log.Printf
+
+	if server {
+		sshServer()
+	} else if client {
+		sshClient()
+	}
+}
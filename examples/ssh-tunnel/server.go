@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+
+	"github.com/oatcode/portal"
+	"github.com/oatcode/portal/pkg/sshtunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+func serverConfig() *ssh.ServerConfig {
+	authorized := map[string]bool{}
+	b, err := os.ReadFile(authorizedKeysFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for len(b) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		authorized[string(key.Marshal())] = true
+		b = rest
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorized[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, errUnauthorized
+		},
+	}
+	b, err = os.ReadFile(hostKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(bytes.TrimSpace(b))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.AddHostKey(signer)
+	return config
+}
+
+var errUnauthorized = errors.New("unauthorized key")
+
+// sshServer accepts SSH connections and serves a tunnel on each tunnel channel.
+// Destinations are connected on this side
+func sshServer() {
+	log.Printf("SSH server...")
+	config := serverConfig()
+	l, err := net.Listen("tcp", sshAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			sc, chans, reqs, err := ssh.NewServerConn(c, config)
+			if err != nil {
+				log.Printf("SSH handshake error: %v", err)
+				return
+			}
+			log.Printf("SSH server connected: user=%s remote=%s", sc.User(), sc.RemoteAddr())
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				f, err := sshtunnel.AcceptChannel(nc)
+				if err != nil {
+					log.Printf("SSH channel error: %v", err)
+					continue
+				}
+				go portal.TunnelServe(context.Background(), f, nil)
+			}
+		}()
+	}
+}
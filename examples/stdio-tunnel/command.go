@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"github.com/oatcode/portal"
+)
+
+// commandTunnel runs the command and serves the tunnel over its stdin and stdout.
+// The proxy is opened on this side
+func commandTunnel(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Command required")
+	}
+	log.Printf("Tunnel command: %v", args)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	coch := make(chan portal.ConnectOperation)
+	go http.ListenAndServe(proxyAddress, portal.NewHTTPHandler(portal.HTTPHandlerOptions{
+		ConnectOperations: coch,
+	}))
+	portal.TunnelServe(context.Background(), portal.NewStreamFramer(r, w), coch)
+	if err := cmd.Wait(); err != nil {
+		log.Printf("Tunnel command ended: %v", err)
+	}
+}
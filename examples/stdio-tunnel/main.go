@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/oatcode/portal"
+)
+
+var stdio bool
+var proxyAddress string
+
+func main() {
+	flag.BoolVar(&stdio, "stdio", false, "Run tunnel over stdin and stdout")
+	flag.StringVar(&proxyAddress, "proxyAddress", "", "Proxy [<ip>]:<port>")
+	flag.Parse()
+
+	portal.Logf = log.Printf
+
+	if stdio {
+		stdioTunnel()
+	} else {
+		commandTunnel(flag.Args())
+	}
+}
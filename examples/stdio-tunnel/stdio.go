@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/oatcode/portal"
+)
+
+// stdioTunnel serves the tunnel over stdin and stdout. Logs go to stderr
+func stdioTunnel() {
+	log.Printf("Tunnel over stdio...")
+	portal.TunnelServe(context.Background(), portal.NewStreamFramer(os.Stdin, os.Stdout), nil)
+}
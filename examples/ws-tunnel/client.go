@@ -8,19 +8,11 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 
 	"github.com/oatcode/portal"
-	"nhooyr.io/websocket"
 )
 
 func dialAndServe(tlsConfig *tls.Config) {
-	u := url.URL{
-		Scheme: "https",
-		Host:   address,
-		Path:   "tunnel",
-	}
-
 	h := http.Header{}
 	if tunnelBasicAuth != "" {
 		h.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tunnelBasicAuth)))
@@ -28,23 +20,21 @@ func dialAndServe(tlsConfig *tls.Config) {
 	if tunnelBearerAuth != "" {
 		h.Add("Authorization", "Bearer "+tunnelBearerAuth)
 	}
-	options := &websocket.DialOptions{
-		HTTPClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-				Proxy:           http.ProxyFromEnvironment,
-			},
-		},
-		HTTPHeader: h,
+	d := &portal.Dialer{
+		TLSConfig: tlsConfig,
+		Proxy:     http.ProxyFromEnvironment,
+		Websocket: true,
+		Header:    h,
 	}
-	c, _, err := websocket.Dial(context.Background(), u.String(), options)
+	f, err := d.Dial(context.Background(), address)
 	if err != nil {
 		log.Fatal("Dial: ", err)
 	}
-	defer c.Close(websocket.StatusNormalClosure, "")
 	log.Print("Tunnel client connected")
 
-	portal.TunnelServe(context.Background(), NewWebsocketFramer(c, address), nil)
+	if err := portal.TunnelServe(context.Background(), f, nil); err != nil {
+		log.Fatal("Tunnel: ", err)
+	}
 }
 
 func createClientTlsConfig(trustFile string) *tls.Config {
@@ -54,9 +44,18 @@ func createClientTlsConfig(trustFile string) *tls.Config {
 	}
 	rootCAs := x509.NewCertPool()
 	rootCAs.AppendCertsFromPEM(pemCerts)
-	return &tls.Config{
+	cfg := &tls.Config{
 		RootCAs: rootCAs,
 	}
+	if certFile != "" {
+		// Client certificate for servers requiring one
+		cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cer}
+	}
+	return cfg
 }
 
 func tunnelClient() {
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"log"
 
 	"github.com/oatcode/portal"
-	"nhooyr.io/websocket"
 )
 
 var client bool
@@ -19,6 +17,7 @@ var tunnelBearerAuth string
 var certFile string
 var keyFile string
 var trustFile string
+var clientTrustFile string
 
 func main() {
 	flag.BoolVar(&client, "client", false, "Run client")
@@ -30,7 +29,8 @@ func main() {
 	flag.StringVar(&tunnelBearerAuth, "tunnelBearerAuth", "", "Tunnel bearer auth token")
 	flag.StringVar(&certFile, "cert", "", "TLS certificate filename")
 	flag.StringVar(&keyFile, "key", "", "TLS certificate key filename")
-	flag.StringVar(&trustFile, "trust", "", "TLS client certificate filename to trust")
+	flag.StringVar(&trustFile, "trust", "", "TLS server certificate filename to trust")
+	flag.StringVar(&clientTrustFile, "clientTrust", "", "TLS client certificate filename to trust for requiring client certificates")
 	flag.Parse()
 
 	portal.Logf = log.Printf
@@ -41,27 +41,3 @@ func main() {
 		tunnelClient()
 	}
 }
-
-type WebsocketFramer struct {
-	conn *websocket.Conn
-}
-
-func NewWebsocketFramer(conn *websocket.Conn, connString string) *WebsocketFramer {
-	return &WebsocketFramer{conn: conn}
-}
-func (c *WebsocketFramer) Read() (b []byte, err error) {
-	_, b, err = c.conn.Read(context.Background())
-	return b, err
-}
-
-func (c *WebsocketFramer) Write(b []byte) error {
-	return c.conn.Write(context.Background(), websocket.MessageBinary, b)
-}
-
-func (c *WebsocketFramer) Close(err error) error {
-	if err == nil {
-		return c.conn.Close(websocket.StatusNormalClosure, "")
-	} else {
-		return c.conn.Close(websocket.StatusInternalError, err.Error())
-	}
-}
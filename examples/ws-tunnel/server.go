@@ -3,12 +3,10 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/base64"
-	"fmt"
+	"crypto/x509"
+	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
-	"strings"
 
 	"github.com/oatcode/portal"
 	"nhooyr.io/websocket"
@@ -16,130 +14,72 @@ import (
 
 var coch = make(chan portal.ConnectOperation)
 
-type proxyConnectHandler struct {
-	other *http.ServeMux
-}
-
-func (h proxyConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodConnect {
-		if !proxyAuth(r) {
-			http.Error(w, "proxy authentication failed", http.StatusUnauthorized)
-			return
-		}
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
-			return
-		}
-		conn, _, err := hj.Hijack()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Proxy connect: %s", connString(conn))
-		coch <- portal.ConnectOperation{Conn: conn, Address: r.URL.Host}
-	} else {
-		h.other.ServeHTTP(w, r)
-	}
-}
-
 func tunnelHandler(w http.ResponseWriter, r *http.Request) {
-	if !tunnelAuth(r) {
-		http.Error(w, "tunnel authentication failed", http.StatusUnauthorized)
-		return
-	}
 	conn, err := websocket.Accept(w, r, nil)
 	if err != nil {
 		panic(err)
 	}
-	go portal.TunnelServe(context.Background(), NewWebsocketFramer(conn, r.RemoteAddr), coch)
-}
-
-// Copied from golang's http lib
-func parseBasicAuth(auth string) (username, password string, ok bool) {
-	const prefix = "Basic "
-	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
-		return
-	}
-	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
-	if err != nil {
-		return
-	}
-	cs := string(c)
-	s := strings.IndexByte(cs, ':')
-	if s < 0 {
-		return
-	}
-	return cs[:s], cs[s+1:], true
-}
-
-func verifyBasic(auth, userpw string) bool {
-	const prefix = "Basic "
-	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
-		return false
-	}
-	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
-	if err != nil {
-		return false
-	}
-	return string(c) == userpw
-}
-
-func verifyBearer(auth, token string) bool {
-	const prefix = "Bearer "
-	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
-		return false
-	}
-	return auth[len(prefix):] == token
+	// Tunnel per connection for the identity of the client certificate
+	tn := &portal.Tunnel{PeerIdentity: portal.TLSPeerIdentity(r.TLS)}
+	log.Printf("Tunnel server connected: %s peer=%s", r.RemoteAddr, tn.PeerIdentity)
+	go func() {
+		if err := tn.Serve(context.Background(), portal.NewWebsocketFramer(conn), coch); err != nil {
+			log.Printf("Tunnel server disconnected: %s err=%v", r.RemoteAddr, err)
+		}
+	}()
 }
 
-func proxyAuth(r *http.Request) bool {
-	auth := r.Header.Get("Proxy-Authorization")
+func proxyAuth() func(r *http.Request) bool {
 	if proxyBasicAuth != "" {
-		return verifyBasic(auth, proxyBasicAuth)
+		return portal.BasicAuth("Proxy-Authorization", proxyBasicAuth)
 	}
 	if proxyBearerAuth != "" {
-		return verifyBearer(auth, proxyBearerAuth)
+		return portal.BearerAuth("Proxy-Authorization", proxyBearerAuth)
 	}
-	return true
+	return nil
 }
 
-func tunnelAuth(r *http.Request) bool {
-	auth := r.Header.Get("Authorization")
+func tunnelAuth() func(r *http.Request) bool {
 	if tunnelBasicAuth != "" {
-		return verifyBasic(auth, tunnelBasicAuth)
+		return portal.BasicAuth("Authorization", tunnelBasicAuth)
 	}
 	if tunnelBearerAuth != "" {
-		return verifyBearer(auth, tunnelBearerAuth)
+		return portal.BearerAuth("Authorization", tunnelBearerAuth)
 	}
-	return true
+	return nil
 }
 
-func createServerTlsConfig(certFile string, keyFile string) *tls.Config {
+func createServerTlsConfig(certFile string, keyFile string, clientTrustFile string) *tls.Config {
 	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &tls.Config{
+	cfg := &tls.Config{
 		Certificates: []tls.Certificate{cer},
 	}
-}
-
-func connString(c net.Conn) string {
-	return fmt.Sprintf("%v->%v", c.LocalAddr(), c.RemoteAddr())
+	if clientTrustFile != "" {
+		pemCerts, err := ioutil.ReadFile(clientTrustFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AppendCertsFromPEM(pemCerts)
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
 }
 
 func tunnelServer() {
 	log.Printf("Tunnel server...")
 
-	otherHandler := http.NewServeMux()
-	otherHandler.HandleFunc("/tunnel", tunnelHandler)
-
-	listener, err := tls.Listen("tcp", address, createServerTlsConfig(certFile, keyFile))
+	listener, err := tls.Listen("tcp", address, createServerTlsConfig(certFile, keyFile, clientTrustFile))
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.Serve(listener, proxyConnectHandler{
-		other: otherHandler,
-	})
+	http.Serve(listener, portal.NewHTTPHandler(portal.HTTPHandlerOptions{
+		ConnectOperations: coch,
+		ProxyAuth:         proxyAuth(),
+		TunnelHandler:     http.HandlerFunc(tunnelHandler),
+		TunnelAuth:        tunnelAuth(),
+	}))
 }
@@ -0,0 +1,45 @@
+package portal
+
+import (
+	"expvar"
+	"time"
+)
+
+// PublishExpvar publishes the tunnel statistics as expvar variables named <prefix>.<name>,
+// so they are served on /debug/vars with the default HTTP mux. Use a different prefix for each tunnel.
+// Like expvar.Publish, it panics if a variable of the same name is already published.
+//
+// The variables are all integers:
+//
+//	<prefix>.active_sessions     gauge    sessions currently open
+//	<prefix>.pending_connects    gauge    sessions from the other side being connected
+//	<prefix>.connects            counter  sessions connected
+//	<prefix>.connect_errors      counter  sessions failed to connect
+//	<prefix>.sessions_throttled  counter  sessions refused by MaxNewSessionsPerSecond
+//	<prefix>.buffered_bytes      gauge    bytes held in memory by the session queues
+//	<prefix>.sessions_shed       counter  sessions closed by MaxBufferedBytes
+//	<prefix>.bytes_read          counter  bytes read from the proxied connections
+//	<prefix>.bytes_written       counter  bytes written to the proxied connections
+//	<prefix>.goroutines          gauge    goroutines of the tunnel running
+//	<prefix>.uptime_seconds      gauge    seconds the tunnel has been connected
+func (tn *Tunnel) PublishExpvar(prefix string) {
+	vars := map[string]func(s Stats) int64{
+		"active_sessions":    func(s Stats) int64 { return s.ActiveSessions },
+		"pending_connects":   func(s Stats) int64 { return s.PendingConnects },
+		"connects":           func(s Stats) int64 { return s.Connects },
+		"connect_errors":     func(s Stats) int64 { return s.ConnectErrors },
+		"sessions_throttled": func(s Stats) int64 { return s.SessionsThrottled },
+		"buffered_bytes":     func(s Stats) int64 { return s.BufferedBytes },
+		"sessions_shed":      func(s Stats) int64 { return s.SessionsShed },
+		"bytes_read":         func(s Stats) int64 { return s.BytesRead },
+		"bytes_written":      func(s Stats) int64 { return s.BytesWritten },
+		"goroutines":         func(s Stats) int64 { return s.Goroutines },
+		"uptime_seconds":     func(s Stats) int64 { return int64(s.Uptime / time.Second) },
+	}
+	for name, v := range vars {
+		v := v
+		expvar.Publish(prefix+"."+name, expvar.Func(func() interface{} {
+			return v(tn.Stats())
+		}))
+	}
+}
@@ -0,0 +1,175 @@
+package portal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialThrough connects to the address on the other side of the tunnel through the connect
+// operation channel given to Serve. The connection is one end of a net.Pipe, with the other end
+// being the session, so it does not support half close of writing.
+//
+// Reading can be paused by not calling Read. With WindowSize, the other side stops sending after
+// the window is full, and resumes when Read is called again. Without flow control, a paused
+// connection stalls the whole tunnel. To stop reading for good while still writing, call
+// CloseRead of the connection, e.g. through interface{ CloseRead() error }. The data that
+// arrives afterwards is discarded, so the other side is not held up. Read returns io.EOF after it
+func DialThrough(ctx context.Context, coch chan<- ConnectOperation, address string) (net.Conn, error) {
+	c, s := net.Pipe()
+	result := make(chan error, 1)
+	select {
+	case coch <- ConnectOperation{Conn: s, Address: address, Result: result}:
+	case <-ctx.Done():
+		c.Close()
+		s.Close()
+		return nil, ctx.Err()
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return &sessionConn{Conn: c}, nil
+	case <-ctx.Done():
+		// The session ends as its connection is closed
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// sessionConn is a connection from DialThrough
+type sessionConn struct {
+	net.Conn
+	mu         sync.Mutex
+	readClosed bool
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.readClosed
+	c.mu.Unlock()
+	if closed {
+		return 0, io.EOF
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseRead stops reading from the session. The data still arriving is read and discarded
+// until the connection is closed, so the session keeps acknowledging it
+func (c *sessionConn) CloseRead() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readClosed {
+		return nil
+	}
+	c.readClosed = true
+	go io.Copy(io.Discard, c.Conn)
+	return nil
+}
+
+// Dial connects to the address on the other side of the tunnel, like a connection from the
+// connect operation channel given to Serve. It waits for the tunnel to be served if it is not.
+// See DialThrough for the connection returned
+func (tn *Tunnel) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return DialThrough(ctx, tn.dials(), address)
+}
+
+// dials returns the channel of the connect operations from Dial
+func (tn *Tunnel) dials() chan ConnectOperation {
+	tn.dialOnce.Do(func() {
+		tn.dialCh = make(chan ConnectOperation)
+	})
+	return tn.dialCh
+}
+
+// HTTPTransport returns a transport that reaches the destinations through the tunnel with Dial,
+// so an http.Client using it makes its requests from the other side:
+//
+//	client := &http.Client{Transport: tn.HTTPTransport()}
+func (tn *Tunnel) HTTPTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return tn.Dial(ctx, address)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Defaults of HTTPHandlerOptions for the connections of ForwardHTTP
+const (
+	defaultForwardIdleTimeout    = 90 * time.Second
+	defaultForwardMaxIdlePerHost = 16
+)
+
+// newForwardProxy creates the handler forwarding plain HTTP proxy requests through the tunnel.
+// The response is streamed to the client as it arrives, flushing after each write.
+// director, if not nil, changes the requests before they are forwarded
+func newForwardProxy(opts HTTPHandlerOptions, director func(r *http.Request)) http.Handler {
+	if director == nil {
+		// The request URL is already absolute for a proxy request
+		director = func(r *http.Request) {}
+	}
+	idleTimeout := opts.ForwardIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultForwardIdleTimeout
+	}
+	maxIdle := opts.ForwardMaxIdlePerHost
+	if maxIdle <= 0 {
+		maxIdle = defaultForwardMaxIdlePerHost
+	}
+	coch := opts.ConnectOperations
+	return &httputil.ReverseProxy{
+		Director: director,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return DialThrough(ctx, coch, address)
+			},
+			IdleConnTimeout:     idleTimeout,
+			MaxIdleConnsPerHost: maxIdle,
+		},
+		FlushInterval: -1,
+	}
+}
+
+const defaultProxyName = "portal"
+
+// addForwardedHeaders adds the Via and Forwarded headers of a request forwarded by the proxy name.
+// Any from proxies before are kept
+func addForwardedHeaders(r *http.Request, name string) {
+	r.Header.Add("Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, name))
+	f := "by=" + forwardedValue(name)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			// IPv6 address
+			ip = "[" + ip + "]"
+		}
+		f += ";for=" + forwardedValue(ip)
+	}
+	if r.Host != "" {
+		f += ";host=" + forwardedValue(r.Host)
+	}
+	r.Header.Add("Forwarded", f+";proto=http")
+}
+
+// forwardedValue returns a value of the Forwarded header, quoted unless it is a token
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
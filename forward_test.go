@@ -0,0 +1,136 @@
+package portal
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHTTPTransport fetches with HTTPTransport from a server known by a name only on the other
+// side of the tunnel
+func TestHTTPTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Host)
+	}))
+	defer backend.Close()
+	local := &Tunnel{}
+	remote := &Tunnel{RewriteDestination: func(address string) (string, error) {
+		if address == "backend.internal:80" {
+			return backend.Listener.Addr().String(), nil
+		}
+		return address, nil
+	}}
+	serveTunnel(t, local, remote)
+
+	tr := local.HTTPTransport()
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://backend.internal/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || string(b) != "hello backend.internal" {
+			t.Fatalf("got %d %q %v", resp.StatusCode, b, err)
+		}
+	}
+	// The second request reuses the connection
+	if n := remote.Stats().Connects; n != 1 {
+		t.Fatalf("got %d sessions, want 1", n)
+	}
+}
+
+// TestPauseRead pauses reading a connection from DialThrough with flow control, resumes, and
+// then stops reading with CloseRead while still writing
+func TestPauseRead(t *testing.T) {
+	const window = 16 * 1024
+	const size = 256 * 1024
+	client, remote := &Tunnel{WindowSize: window}, &Tunnel{}
+	coch := serveTunnel(t, client, remote)
+	got := make(chan string, 1)
+	address := listen(t, func(c net.Conn) {
+		defer c.Close()
+		c.Write(make([]byte, 2*size))
+		b := make([]byte, 3)
+		io.ReadFull(c, b)
+		got <- string(b)
+	})
+	c := dial(t, coch, address)
+
+	// Paused by not reading. The other side stops after the window
+	waitFor(t, "data", func() bool { return remote.Stats().BytesRead > 0 })
+	time.Sleep(100 * time.Millisecond)
+	if n := remote.Stats().BytesRead; n > window+bufferSize {
+		t.Fatalf("read %d bytes from the destination while paused, window %d", n, window)
+	}
+	// Resumed
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.(interface{ CloseRead() error }).CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read %d %v after CloseRead", n, err)
+	}
+	// The data after CloseRead is acknowledged, so the other side reads it all
+	waitFor(t, "data after CloseRead", func() bool { return remote.Stats().BytesRead == 2*size })
+	io.WriteString(c, "bye")
+	select {
+	case s := <-got:
+		if s != "bye" {
+			t.Fatalf("got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write after CloseRead not delivered")
+	}
+}
+
+// TestForwardedHeaders checks the proxy headers on the requests forwarded with ForwardHTTP
+func TestForwardedHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer backend.Close()
+	host := backend.Listener.Addr().String()
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+
+	for _, tc := range []struct {
+		name      string
+		opts      HTTPHandlerOptions
+		via       string
+		forwarded string
+	}{
+		{"off", HTTPHandlerOptions{}, "", ""},
+		{"default name", HTTPHandlerOptions{AddForwardedHeaders: true},
+			"1.1 portal", `by=portal;for=127.0.0.1;host="` + host + `";proto=http`},
+		{"proxy name", HTTPHandlerOptions{AddForwardedHeaders: true, ProxyName: "edge-1"},
+			"1.1 edge-1", `by=edge-1;for=127.0.0.1;host="` + host + `";proto=http`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := forwardClient(t, coch, tc.opts).Get(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			h := <-headers
+			if got := h.Get("Via"); got != tc.via {
+				t.Errorf("got Via %q, want %q", got, tc.via)
+			}
+			if got := h.Get("Forwarded"); got != tc.forwarded {
+				t.Errorf("got Forwarded %q, want %q", got, tc.forwarded)
+			}
+			if got := h.Get("X-Forwarded-For"); got != "127.0.0.1" {
+				t.Errorf("got X-Forwarded-For %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package portal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"nhooyr.io/websocket"
+)
+
+// MaxFrameSize is the largest message ConnFramer and StreamFramer read or write. It bounds the
+// memory a broken or hostile other side can make Read allocate with the length of a frame.
+// The tunnel splits DATA messages to fit, as the framers report it as MaxMessageSize
+const MaxFrameSize = 16 << 20
+
+// ErrFrameTooLarge is the error of reading or writing a frame longer than MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ConnFramer frames messages over a stream connection, e.g. TCP or TLS.
+//
+// The wire format, for other implementations to interoperate: each message is its length as a
+// signed 32-bit integer in little endian, followed by that many bytes of content, the marshalled
+// message.Message. There is no other header, padding or delimiter. A negative length, or one
+// over MaxFrameSize, is an error that ends the connection
+type ConnFramer struct {
+	conn net.Conn
+}
+
+func NewConnFramer(conn net.Conn) *ConnFramer {
+	return &ConnFramer{conn: conn}
+}
+
+func (c *ConnFramer) Read() (b []byte, err error) {
+	return readFrame(c.conn)
+}
+
+func (c *ConnFramer) Write(b []byte) error {
+	return writeFrame(c.conn, b)
+}
+
+// MaxMessageSize returns MaxFrameSize
+func (c *ConnFramer) MaxMessageSize() int {
+	return MaxFrameSize
+}
+
+func (c *ConnFramer) Close(err error) error {
+	return c.conn.Close()
+}
+
+// StreamFramer frames messages like ConnFramer over a reader and writer pair,
+// e.g. stdin and stdout of a process, or os.Pipe
+type StreamFramer struct {
+	r io.Reader
+	w io.Writer
+}
+
+func NewStreamFramer(r io.Reader, w io.Writer) *StreamFramer {
+	return &StreamFramer{r: r, w: w}
+}
+
+// Read returns io.EOF when the other side closes its writer, or when the reader is closed by Close
+func (c *StreamFramer) Read() (b []byte, err error) {
+	b, err = readFrame(c.r)
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		err = io.EOF
+	}
+	return b, err
+}
+
+func (c *StreamFramer) Write(b []byte) error {
+	return writeFrame(c.w, b)
+}
+
+// MaxMessageSize returns MaxFrameSize
+func (c *StreamFramer) MaxMessageSize() int {
+	return MaxFrameSize
+}
+
+// Close closes the writer so that the other side reads EOF, and then the reader.
+// Either is left open if it is not an io.Closer
+func (c *StreamFramer) Close(err error) error {
+	var werr, rerr error
+	if wc, ok := c.w.(io.Closer); ok {
+		werr = wc.Close()
+	}
+	if rc, ok := c.r.(io.Closer); ok && rc != interface{}(c.w) {
+		rerr = rc.Close()
+	}
+	if werr != nil {
+		return werr
+	}
+	return rerr
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	// Read len first then content
+	var dl int32
+	if err := binary.Read(r, binary.LittleEndian, &dl); err != nil {
+		return nil, err
+	}
+	if dl < 0 {
+		return nil, errors.New("invalid frame length")
+	}
+	if dl > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	buf := make([]byte, dl)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	// Write len first then content
+	dl := int32(len(b))
+	if err := binary.Write(w, binary.LittleEndian, dl); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// WebsocketFramer sends each message as a binary websocket message
+type WebsocketFramer struct {
+	conn *websocket.Conn
+}
+
+func NewWebsocketFramer(conn *websocket.Conn) *WebsocketFramer {
+	return &WebsocketFramer{conn: conn}
+}
+
+// Read returns io.EOF when the other side closes the websocket normally
+func (c *WebsocketFramer) Read() (b []byte, err error) {
+	_, b, err = c.conn.Read(context.Background())
+	if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+		err = io.EOF
+	}
+	return b, err
+}
+
+func (c *WebsocketFramer) Write(b []byte) error {
+	return c.conn.Write(context.Background(), websocket.MessageBinary, b)
+}
+
+// MaxMessageSize returns the default read limit of the websocket library on the other side
+func (c *WebsocketFramer) MaxMessageSize() int {
+	return 32768
+}
+
+func (c *WebsocketFramer) Close(err error) error {
+	if err == nil {
+		return c.conn.Close(websocket.StatusNormalClosure, "")
+	} else {
+		return c.conn.Close(websocket.StatusInternalError, err.Error())
+	}
+}
+
+// copiesOnWrite reports whether the Framer is done with the byte array when Write returns, as
+// with the framers of this package, so that it can be reused. Other framers may retain it
+func copiesOnWrite(c Framer) bool {
+	switch c := c.(type) {
+	case *ConnFramer, *StreamFramer, *WebsocketFramer:
+		return true
+	case *wireDebugFramer:
+		return copiesOnWrite(c.c)
+	}
+	return false
+}
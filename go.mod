@@ -2,9 +2,13 @@ module github.com/oatcode/portal
 
 go 1.17
 
-require google.golang.org/protobuf v1.28.0
+require (
+	golang.org/x/crypto v0.14.0
+	google.golang.org/protobuf v1.28.0
+)
 
 require (
-	github.com/klauspost/compress v1.10.3 // indirect
+	github.com/klauspost/compress v1.10.3
+	golang.org/x/sys v0.13.0 // indirect
 	nhooyr.io/websocket v1.8.7
 )
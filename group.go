@@ -0,0 +1,204 @@
+package portal
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TunnelGroup spreads the proxy connections over the tunnels served through it, e.g. of several
+// clients connected to one server. Tunnels join the group when served with its Serve and leave
+// when it returns. Each connection goes to the next live tunnel in turn.
+// The zero value is an empty group ready to use. It is safe for concurrent use
+type TunnelGroup struct {
+	mu      sync.Mutex
+	members []*groupMember
+	// Index of the member for the next connection
+	next int
+}
+
+// groupMember is a tunnel being served in the group
+type groupMember struct {
+	tn   *Tunnel
+	coch chan ConnectOperation
+	// Closed when the tunnel leaves the group, as its coch is no longer read
+	done chan struct{}
+}
+
+// Serve serves the tunnel like Tunnel.Serve, with the connections of the group.
+// The tunnel is in the group until Serve returns
+func (g *TunnelGroup) Serve(ctx context.Context, tn *Tunnel, c Framer) error {
+	m := &groupMember{tn: tn, coch: make(chan ConnectOperation), done: make(chan struct{})}
+	g.add(m)
+	defer g.remove(m)
+	return tn.Serve(ctx, c, m.coch)
+}
+
+// Len returns the number of tunnels in the group
+func (g *TunnelGroup) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members)
+}
+
+func (g *TunnelGroup) add(m *groupMember) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(g.members, m)
+}
+
+func (g *TunnelGroup) remove(m *groupMember) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, o := range g.members {
+		if o == m {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			if g.next > i {
+				// Keep the turn of the members after it
+				g.next--
+			}
+			break
+		}
+	}
+	close(m.done)
+}
+
+// pick returns the member whose turn it is, skipping those draining, or nil if there is none
+func (g *TunnelGroup) pick() *groupMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for range g.members {
+		if g.next >= len(g.members) {
+			g.next = 0
+		}
+		m := g.members[g.next]
+		g.next++
+		if !m.tn.Draining() {
+			return m
+		}
+	}
+	return nil
+}
+
+// available is whether a tunnel of the group takes connections
+func (g *TunnelGroup) available() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, m := range g.members {
+		if !m.tn.Draining() {
+			return true
+		}
+	}
+	return false
+}
+
+// connect gives the connect operation to a tunnel of the group. A tunnel leaving before taking it
+// passes it on to the next one. It returns false if there is none left, or all are draining
+func (g *TunnelGroup) connect(co ConnectOperation) bool {
+	for {
+		m := g.pick()
+		if m == nil {
+			return false
+		}
+		select {
+		case m.coch <- co:
+			return true
+		case <-m.done:
+		}
+	}
+}
+
+// Hijack hijacks the connection of a CONNECT request and gives it to a tunnel of the group,
+// like the CONNECT requests of NewHTTPHandler. Without a tunnel, or with all of them draining
+// after Drain, it responds with service unavailable. Authenticate the request before calling it, e.g. with ProxyAuth:
+//
+//	if !auth(r) {
+//		http.Error(w, "proxy authentication failed", http.StatusProxyAuthRequired)
+//		return
+//	}
+//	group.Hijack(w, r)
+func (g *TunnelGroup) Hijack(w http.ResponseWriter, r *http.Request) {
+	g.HijackContext(context.Background(), w, r)
+}
+
+// HijackContext is Hijack with the session tied to ctx: the connection is closed when ctx is done,
+// which disconnects the session like the client closing it. A dial still in progress on the other
+// side is disconnected once it completes. Note that the context of the request cannot be used, as
+// the HTTP server cancels it when the handler returns after the hijack
+func (g *TunnelGroup) HijackContext(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "CONNECT required", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Host == "" || r.URL.Path != "" {
+		http.Error(w, "CONNECT requires host:port target", http.StatusBadRequest)
+		return
+	}
+	if !g.available() {
+		http.Error(w, ErrServiceUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Need to clean deadlines in case it was set
+	conn.SetDeadline(time.Time{})
+	if brw.Reader.Buffered() > 0 {
+		// Client sent data without waiting for the response
+		conn = &bufferedConn{Conn: conn, r: io.MultiReader(brw.Reader, conn)}
+	}
+	if ctx.Done() != nil {
+		conn = newContextConn(ctx, conn)
+	}
+	sessionLogf(-1, "Proxy connect: %s", connString(conn, r.URL.Host))
+	ok = g.connect(ConnectOperation{
+		Conn:               conn,
+		Address:            r.URL.Host,
+		ProxyAuthorization: r.Header.Get("Proxy-Authorization"),
+	})
+	if !ok {
+		// The tunnels left the group after the check
+		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
+		conn.Close()
+	}
+}
+
+// contextConn closes the connection when ctx is done, for HijackContext.
+// It stops watching ctx on the first Close
+type contextConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newContextConn(ctx context.Context, conn net.Conn) *contextConn {
+	c := &contextConn{Conn: conn, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.closed:
+		}
+	}()
+	return c
+}
+
+func (c *contextConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *contextConn) CloseWrite() error {
+	return closeWrite(c.Conn, c.Close)
+}
@@ -0,0 +1,402 @@
+package portal
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPHandlerOptions is for creating the handler with NewHTTPHandler
+type HTTPHandlerOptions struct {
+	// ConnectOperations receives the hijacked connections of HTTP CONNECT requests.
+	// It is usually the channel given to Serve. CONNECT requests are refused if nil. A CONNECT
+	// waits for the channel to take it until the context of the request is done, e.g. by the
+	// BaseContext of the server, when its connection is closed
+	ConnectOperations chan<- ConnectOperation
+
+	// AllowConnect limits which CONNECT requests are hijacked, e.g. only those that came in through
+	// the proxy listener by http.LocalAddrContextKey. Others are refused with method not allowed.
+	// nil allows all
+	AllowConnect func(r *http.Request) bool
+
+	// ProxyAuth authenticates HTTP CONNECT requests, and forwarded requests with ForwardHTTP. nil allows all
+	ProxyAuth func(r *http.Request) bool
+
+	// MaxConnectsPerClient limits the concurrent CONNECT sessions of each client IP address, by the
+	// RemoteAddr of the request, so that one client cannot take all the sessions of the tunnel.
+	// A session counts until its connection is closed. CONNECT requests over it are refused with
+	// too many requests. Zero for no limit
+	MaxConnectsPerClient int
+
+	// OnClientLimited is called with the client IP address of each CONNECT request refused by
+	// MaxConnectsPerClient, e.g. to count the rejections of each client. It must not block
+	OnClientLimited func(ip string)
+
+	// ForwardHTTP forwards plain HTTP proxy requests, i.e. with absolute http URLs instead of CONNECT,
+	// through the tunnel with ConnectOperations. The response is streamed to the client as it arrives
+	ForwardHTTP bool
+
+	// AddForwardedHeaders adds Via and Forwarded headers to the requests forwarded with ForwardHTTP,
+	// naming the proxy by ProxyName and the client by the RemoteAddr of the request, for the
+	// logging and loop detection of the destinations. X-Forwarded-For with the client address is
+	// added to forwarded requests either way. CONNECT sessions are opaque, so nothing is added to them
+	AddForwardedHeaders bool
+
+	// ProxyName identifies the proxy in the headers added with AddForwardedHeaders. Defaults to "portal"
+	ProxyName string
+
+	// ForwardIdleTimeout closes a connection of ForwardHTTP kept for the next request to the same
+	// destination when idle for that long. Keep it within the IdleTimeout of the tunnel, which
+	// disconnects the session of an idle connection. Defaults to 90 seconds
+	ForwardIdleTimeout time.Duration
+
+	// ForwardMaxIdlePerHost is the number of idle connections of ForwardHTTP kept for each
+	// destination. Defaults to 16
+	ForwardMaxIdlePerHost int
+
+	// TunnelPath is the path of the tunnel endpoint. Defaults to "/tunnel"
+	TunnelPath string
+
+	// TunnelHandler handles requests to the tunnel endpoint, e.g. accepting websocket and calling Serve.
+	// The tunnel endpoint is disabled if nil
+	TunnelHandler http.Handler
+
+	// TunnelAuth authenticates requests to the tunnel endpoint. nil allows all
+	TunnelAuth func(r *http.Request) bool
+
+	// Handler handles all other requests. Responds with not found if nil
+	Handler http.Handler
+}
+
+type httpHandler struct {
+	opts    HTTPHandlerOptions
+	mux     *http.ServeMux
+	forward http.Handler
+	clients clientLimiter
+}
+
+// NewHTTPHandler creates a handler serving both the proxy and the tunnel endpoint.
+// Requests are handled in this order:
+//   - CONNECT requests are hijacked and sent to the connect operation channel. One without a
+//     host:port target, e.g. sent to the tunnel path by mistake, is a bad request. One refused by
+//     AllowConnect, or without a channel, is method not allowed. Then ProxyAuth is checked,
+//     and then MaxConnectsPerClient. Those of HTTP/2 cannot be hijacked, so their request and
+//     response bodies are streamed instead, without half close or ReadTimeout. Extended
+//     CONNECT, e.g. websocket over HTTP/2, is not implemented.
+//   - With ForwardHTTP, requests with absolute http URLs are forwarded through the tunnel after ProxyAuth.
+//   - Requests to the tunnel path must be GET, as in websocket upgrade, or they are method not allowed.
+//     Then TunnelAuth is checked before TunnelHandler.
+//   - Other requests go to Handler, or are not found. A websocket upgrade for the tunnel to the
+//     wrong path is not found unless Handler takes it.
+//
+// CONNECT requests have no path for a ServeMux to match. To add it to an existing server,
+// use the handler as the server handler and set the existing mux as Handler:
+//
+//	http.Serve(l, portal.NewHTTPHandler(portal.HTTPHandlerOptions{
+//		ConnectOperations: coch,
+//		TunnelHandler:     http.HandlerFunc(tunnelHandler),
+//		Handler:           mux,
+//	}))
+func NewHTTPHandler(opts HTTPHandlerOptions) http.Handler {
+	if opts.TunnelPath == "" {
+		opts.TunnelPath = "/tunnel"
+	}
+	h := &httpHandler{opts: opts, mux: http.NewServeMux()}
+	if opts.ForwardHTTP && opts.ConnectOperations != nil {
+		var director func(r *http.Request)
+		if opts.AddForwardedHeaders {
+			name := opts.ProxyName
+			if name == "" {
+				name = defaultProxyName
+			}
+			director = func(r *http.Request) {
+				addForwardedHeaders(r, name)
+			}
+		}
+		h.forward = newForwardProxy(opts, director)
+	}
+	if opts.TunnelHandler != nil {
+		h.mux.HandleFunc(opts.TunnelPath, h.serveTunnel)
+	}
+	if opts.Handler != nil {
+		h.mux.Handle("/", opts.Handler)
+	}
+	return h
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		h.serveConnect(w, r)
+	} else if h.forward != nil && r.URL.IsAbs() && r.URL.Scheme == "http" {
+		h.serveForward(w, r)
+	} else {
+		h.mux.ServeHTTP(w, r)
+	}
+}
+
+func (h *httpHandler) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if p := r.Header.Get(":protocol"); p != "" {
+		// Extended CONNECT of RFC 8441, e.g. websocket over HTTP/2
+		http.Error(w, "extended CONNECT not supported: "+p, http.StatusNotImplemented)
+		return
+	}
+	if r.URL.Host == "" || r.URL.Path != "" {
+		// Not the authority form of CONNECT, e.g. CONNECT /tunnel
+		http.Error(w, "CONNECT requires host:port target", http.StatusBadRequest)
+		return
+	}
+	if h.opts.ConnectOperations == nil || (h.opts.AllowConnect != nil && !h.opts.AllowConnect(r)) {
+		http.Error(w, "CONNECT not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.opts.ProxyAuth != nil && !h.opts.ProxyAuth(r) {
+		http.Error(w, "proxy authentication failed", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.ProtoMajor >= 2 {
+		h.serveStreamConnect(w, r)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+	ip, ok := h.acquireClient(w, r)
+	if !ok {
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		if h.opts.MaxConnectsPerClient > 0 {
+			h.clients.release(ip)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Need to clean deadlines in case it was set
+	conn.SetDeadline(time.Time{})
+	if brw.Reader.Buffered() > 0 {
+		// Client sent data without waiting for the response
+		conn = &bufferedConn{Conn: conn, r: io.MultiReader(brw.Reader, conn)}
+	}
+	if h.opts.MaxConnectsPerClient > 0 {
+		conn = &clientConn{Conn: conn, release: func() { h.clients.release(ip) }}
+	}
+	sessionLogf(-1, "Proxy connect: %s", connString(conn, r.URL.Host))
+	select {
+	case h.opts.ConnectOperations <- ConnectOperation{
+		Conn:               conn,
+		Address:            r.URL.Host,
+		ProxyAuthorization: r.Header.Get("Proxy-Authorization"),
+	}:
+	case <-r.Context().Done():
+		// Not taken by the tunnel before the server context is done
+		sessionLogf(-1, "Proxy connect canceled: %s", connString(conn, r.URL.Host))
+		conn.Close()
+	}
+}
+
+// serveStreamConnect serves a CONNECT request of HTTP/2 or later, which cannot be hijacked, with
+// its request and response bodies as the connection of the session. It returns when the session
+// ends, as the bodies are only usable until then
+func (h *httpHandler) serveStreamConnect(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "webserver doesn't support flushing", http.StatusInternalServerError)
+		return
+	}
+	ip, ok := h.acquireClient(w, r)
+	if !ok {
+		return
+	}
+	sc := newStreamConn(w, f, r)
+	var conn net.Conn = sc
+	if h.opts.MaxConnectsPerClient > 0 {
+		conn = &clientConn{Conn: conn, release: func() { h.clients.release(ip) }}
+	}
+	sessionLogf(-1, "Proxy connect: %s %s", r.Proto, connString(conn, r.URL.Host))
+	// The response is written by the result instead of to the connection
+	result := make(chan error, 1)
+	select {
+	case h.opts.ConnectOperations <- ConnectOperation{
+		Conn:               conn,
+		Address:            r.URL.Host,
+		Result:             result,
+		ProxyAuthorization: r.Header.Get("Proxy-Authorization"),
+	}:
+	case <-r.Context().Done():
+		sessionLogf(-1, "Proxy connect canceled: %s %s", r.Proto, connString(conn, r.URL.Host))
+		conn.Close()
+		return
+	}
+	select {
+	case err := <-result:
+		sc.reply(err)
+	case <-r.Context().Done():
+		conn.Close()
+	}
+	sc.wait(r)
+}
+
+// acquireClient counts a CONNECT session of the client with MaxConnectsPerClient. It returns the
+// client IP address, or false after responding with too many requests if the client has too many
+func (h *httpHandler) acquireClient(w http.ResponseWriter, r *http.Request) (string, bool) {
+	max := h.opts.MaxConnectsPerClient
+	if max <= 0 {
+		return "", true
+	}
+	ip := clientIP(r)
+	if !h.clients.acquire(ip, max) {
+		if h.opts.OnClientLimited != nil {
+			h.opts.OnClientLimited(ip)
+		}
+		http.Error(w, "too many connections from client", http.StatusTooManyRequests)
+		return "", false
+	}
+	return ip, true
+}
+
+func (h *httpHandler) serveForward(w http.ResponseWriter, r *http.Request) {
+	if h.opts.ProxyAuth != nil && !h.opts.ProxyAuth(r) {
+		http.Error(w, "proxy authentication failed", http.StatusProxyAuthRequired)
+		return
+	}
+	sessionLogf(-1, "Proxy forward: %s %s", r.Method, r.URL)
+	h.forward.ServeHTTP(w, r)
+}
+
+func (h *httpHandler) serveTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "tunnel endpoint requires GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.opts.TunnelAuth != nil && !h.opts.TunnelAuth(r) {
+		http.Error(w, "tunnel authentication failed", http.StatusUnauthorized)
+		return
+	}
+	h.opts.TunnelHandler.ServeHTTP(w, r)
+}
+
+// bufferedConn reads the data already buffered by the HTTP server before reading the connection
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn, c.Close)
+}
+
+// closeWrite passes on the half close of a wrapper of conn, or closes the wrapper with close if
+// conn does not support it, as the proxyWriter would without the wrapper
+func closeWrite(conn net.Conn, close func() error) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return close()
+}
+
+// clientLimiter counts the open CONNECT sessions of each client IP address for MaxConnectsPerClient
+type clientLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// acquire counts a session of the client if it has less than max
+func (l *clientLimiter) acquire(ip string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		l.active = make(map[string]int)
+	}
+	if l.active[ip] >= max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *clientLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+	} else {
+		l.active[ip]--
+	}
+}
+
+// clientIP returns the IP address of the client of the request, or RemoteAddr as is if it has no port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientConn releases the session of the client on the first Close
+type clientConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *clientConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *clientConn) CloseWrite() error {
+	return closeWrite(c.Conn, c.Close)
+}
+
+// BasicAuth returns an auth function for NewHTTPHandler that verifies the basic credentials
+// in the request header, e.g. "Proxy-Authorization" or "Authorization". userpw is <username>:<password>
+func BasicAuth(header, userpw string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		const prefix = "Basic "
+		auth := r.Header.Get(header)
+		if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+			return false
+		}
+		c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(c, []byte(userpw)) == 1
+	}
+}
+
+// BearerAuth returns an auth function for NewHTTPHandler that verifies the bearer token in the request header
+func BearerAuth(header, token string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		const prefix = "Bearer "
+		auth := r.Header.Get(header)
+		if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+	}
+}
+
+// TLSPeerIdentity returns the common name of the verified client certificate of a TLS connection,
+// e.g. from http.Request.TLS, for Tunnel.PeerIdentity. It returns empty if there is none
+func TLSPeerIdentity(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return cs.VerifiedChains[0][0].Subject.CommonName
+}
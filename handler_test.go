@@ -0,0 +1,149 @@
+package portal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// connect sends a CONNECT request for the address to the proxy and returns the connection and
+// the response
+func connect(t *testing.T, proxy *httptest.Server, address string) (net.Conn, *http.Response) {
+	t.Helper()
+	c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+// TestHTTPHandlerRoutes checks where NewHTTPHandler sends the requests other than CONNECT, which
+// the tests of CONNECT through the tunnel cover
+func TestHTTPHandlerRoutes(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) })
+	}
+	tunnelAuth := func(r *http.Request) bool { return r.Header.Get("Authorization") == "secret" }
+	tests := []struct {
+		name   string
+		opts   HTTPHandlerOptions
+		path   string
+		auth   string
+		status int
+		body   string
+	}{
+		{name: "tunnel", opts: HTTPHandlerOptions{TunnelHandler: named("tunnel")}, path: "/tunnel", status: http.StatusOK, body: "tunnel"},
+		{name: "tunnel path", opts: HTTPHandlerOptions{TunnelPath: "/t", TunnelHandler: named("tunnel")}, path: "/t", status: http.StatusOK, body: "tunnel"},
+		{name: "tunnel auth", opts: HTTPHandlerOptions{TunnelHandler: named("tunnel"), TunnelAuth: tunnelAuth}, path: "/tunnel", auth: "secret", status: http.StatusOK, body: "tunnel"},
+		{name: "tunnel auth failed", opts: HTTPHandlerOptions{TunnelHandler: named("tunnel"), TunnelAuth: tunnelAuth}, path: "/tunnel", auth: "wrong", status: http.StatusUnauthorized},
+		{name: "tunnel disabled", opts: HTTPHandlerOptions{Handler: named("other")}, path: "/tunnel", status: http.StatusOK, body: "other"},
+		{name: "other", opts: HTTPHandlerOptions{TunnelHandler: named("tunnel"), Handler: named("other")}, path: "/status", status: http.StatusOK, body: "other"},
+		{name: "not found", opts: HTTPHandlerOptions{TunnelHandler: named("tunnel")}, path: "/status", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			NewHTTPHandler(tt.opts).ServeHTTP(w, r)
+			if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Fatalf("got %d %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestHTTPHandlerMisroutes checks the answers of NewHTTPHandler to requests sent to the wrong
+// endpoint, which must not be hijacked or reach TunnelHandler
+func TestHTTPHandlerMisroutes(t *testing.T) {
+	tunnel := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { t.Error("tunnel handler called") })
+	coch := make(chan ConnectOperation)
+	opts := HTTPHandlerOptions{ConnectOperations: coch, TunnelHandler: tunnel}
+	refused := opts
+	refused.AllowConnect = func(r *http.Request) bool { return false }
+	tests := []struct {
+		name    string
+		opts    HTTPHandlerOptions
+		method  string
+		target  string
+		headers map[string]string
+		status  int
+	}{
+		{name: "connect to tunnel path", opts: opts, method: http.MethodConnect, target: "/tunnel", status: http.StatusBadRequest},
+		{name: "connect refused", opts: refused, method: http.MethodConnect, target: "example.com:443", status: http.StatusMethodNotAllowed},
+		{name: "connect without channel", opts: HTTPHandlerOptions{TunnelHandler: tunnel}, method: http.MethodConnect, target: "example.com:443", status: http.StatusMethodNotAllowed},
+		{name: "extended connect", opts: opts, method: http.MethodConnect, target: "example.com:443", headers: map[string]string{":protocol": "websocket"}, status: http.StatusNotImplemented},
+		{name: "post to tunnel path", opts: opts, method: http.MethodPost, target: "/tunnel", status: http.StatusMethodNotAllowed},
+		{name: "upgrade to proxy", opts: opts, method: http.MethodGet, target: "/proxy", headers: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			NewHTTPHandler(tt.opts).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got %d %q, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
+
+// TestMaxConnectsPerClient opens more CONNECT sessions from one client than MaxConnectsPerClient
+func TestMaxConnectsPerClient(t *testing.T) {
+	const max = 2
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+	var mu sync.Mutex
+	var limited []string
+	proxy := httptest.NewServer(NewHTTPHandler(HTTPHandlerOptions{
+		ConnectOperations:    coch,
+		MaxConnectsPerClient: max,
+		OnClientLimited: func(ip string) {
+			mu.Lock()
+			defer mu.Unlock()
+			limited = append(limited, ip)
+		},
+	}))
+	defer proxy.Close()
+	address := listen(t, echo)
+
+	var conns []net.Conn
+	for i := 0; i < max; i++ {
+		c, resp := connect(t, proxy, address)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d", resp.StatusCode)
+		}
+		conns = append(conns, c)
+	}
+	if _, resp := connect(t, proxy, address); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	mu.Lock()
+	if len(limited) != 1 || limited[0] != "127.0.0.1" {
+		t.Errorf("got limited clients %q", limited)
+	}
+	mu.Unlock()
+
+	// A session counts until its connection is closed
+	conns[0].Close()
+	waitFor(t, "the session closed", func() bool {
+		c, resp := connect(t, proxy, address)
+		c.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+}
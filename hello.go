@@ -0,0 +1,291 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// Features are the optional protocol features in use on a tunnel connection.
+// A feature is in use when both sides support and enable it
+type Features struct {
+	// FlowControl is WindowSize set on both sides
+	FlowControl bool
+
+	// Reordering is ReorderBuffer set on both sides
+	Reordering bool
+
+	// Keepalive is both sides answering keepalive pings. Pings are only sent with KeepaliveInterval
+	Keepalive bool
+
+	// LiveUpgrade is AllowLiveUpgrade set on both sides
+	LiveUpgrade bool
+
+	// Compression is both sides able to decompress DATA. Each side compresses the DATA it sends
+	// with its own Compression, if set
+	Compression bool
+
+	// Datagram is both sides able to carry sessions of datagrams, see ConnectOperation.Datagram
+	Datagram bool
+
+	// HalfClose is both sides able to end one direction of a session while the other goes on.
+	// Without it, the end of the data from one side disconnects the session, as before half close
+	HalfClose bool
+}
+
+// ErrLiveUpgradeUnsupported is returned by Upgrade when AllowLiveUpgrade is not set on both sides
+var ErrLiveUpgradeUnsupported = errors.New("live upgrade unsupported")
+
+// ErrIncompatibleVersion is the error the tunnel connection is closed with when the protocol
+// versions of the two sides do not work together, or with RequireVersion, when the other side
+// is from before versions
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+// Protocol version of this side in HELLO, and the oldest version of the other side it works with.
+// The version goes up when a change to the messages would be misread by an older version, and the
+// oldest version when this side stops supporting it. A HELLO without versions is version 0
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 0
+)
+
+// Bits of the features in HELLO
+const (
+	featureFlowControl uint32 = 1 << iota
+	featureReordering
+	featureKeepalive
+	featureLiveUpgrade
+	featureCompression
+	featureDatagram
+	featureHalfClose
+)
+
+// localFeatures returns the bits of the features supported and enabled on this side
+func (tn *Tunnel) localFeatures() uint32 {
+	f := featureKeepalive | featureCompression | featureDatagram | featureHalfClose
+	if tn.windowSize() > 0 {
+		f |= featureFlowControl
+	}
+	if tn.ReorderBuffer > 0 {
+		f |= featureReordering
+	}
+	if tn.AllowLiveUpgrade {
+		f |= featureLiveUpgrade
+	}
+	return f
+}
+
+// helloMessage returns the HELLO of this side with the local features
+func helloMessage(local uint32) *message.Message {
+	return &message.Message{
+		Type:       message.Message_HELLO,
+		Features:   local,
+		Version:    protocolVersion,
+		MinVersion: minProtocolVersion,
+	}
+}
+
+// checkVersion checks the version of the other side with its first message. Each side checks
+// both ways, so that both fail the same, whichever is the newer one
+func (tn *Tunnel) checkVersion(co *message.Message) error {
+	if co.Type != message.Message_HELLO {
+		if tn.RequireVersion {
+			return fmt.Errorf("%w: no HELLO from the other side", ErrIncompatibleVersion)
+		}
+		return nil
+	}
+	if co.Version < minProtocolVersion || co.MinVersion > protocolVersion {
+		return fmt.Errorf("%w: version %d, oldest supported %d, of the other side, and %d, oldest supported %d, of this side",
+			ErrIncompatibleVersion, co.Version, co.MinVersion, protocolVersion, minProtocolVersion)
+	}
+	return nil
+}
+
+// upgradeFeatures returns the bits of the local features for UPGRADE. Reordering stays as it was
+// at the start of the connection, as messages are numbered from the first one or not at all
+func (tn *Tunnel) upgradeFeatures(prev uint32) uint32 {
+	return tn.localFeatures()&^featureReordering | prev&featureReordering
+}
+
+// handshake is the HELLO exchange of a tunnel connection.
+// Each side sends HELLO as its first message, or with LegacyCompat, in answer to the HELLO of
+// the other side. A first message of another type is from an older version without HELLO, or
+// from a side with LegacyCompat, which then has none of the features
+type handshake struct {
+	mu       sync.Mutex
+	features Features
+	// Closed when the first message from the other side is received or the connection ends
+	ready chan struct{}
+	done  bool
+	// Closed when the features are agreed again with AllowLiveUpgrade
+	changed chan struct{}
+}
+
+// receive completes the handshake with the HELLO of the other side, or nil without it
+func (h *handshake) receive(co *message.Message, local uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done {
+		return
+	}
+	h.done = true
+	if co != nil {
+		h.features = makeFeatures(co.Features & local)
+	}
+	if ch := h.readyLocked(); !isClosed(ch) {
+		close(ch)
+	}
+}
+
+// get returns the features agreed so far
+func (h *handshake) get() Features {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.features
+}
+
+// upgrade agrees the features again with a later HELLO or UPGRADE from the other side
+func (h *handshake) upgrade(co *message.Message, local uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.features = makeFeatures(co.Features & local)
+	if h.changed != nil {
+		close(h.changed)
+		h.changed = nil
+	}
+}
+
+// upgraded returns a channel closed when the features are next agreed again
+func (h *handshake) upgraded() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.changed == nil {
+		h.changed = make(chan struct{})
+	}
+	return h.changed
+}
+
+func makeFeatures(f uint32) Features {
+	return Features{
+		FlowControl: f&featureFlowControl != 0,
+		Reordering:  f&featureReordering != 0,
+		Keepalive:   f&featureKeepalive != 0,
+		LiveUpgrade: f&featureLiveUpgrade != 0,
+		Compression: f&featureCompression != 0,
+		Datagram:    f&featureDatagram != 0,
+		HalfClose:   f&featureHalfClose != 0,
+	}
+}
+
+// end stops the waiting when the tunnel connection ends, complete or not
+func (h *handshake) end() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch := h.readyLocked(); !isClosed(ch) {
+		close(ch)
+	}
+}
+
+func (h *handshake) wait() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.readyLocked()
+}
+
+// readyLocked returns ready, made on first use. h.mu must be held
+func (h *handshake) readyLocked() chan struct{} {
+	if h.ready == nil {
+		h.ready = make(chan struct{})
+	}
+	return h.ready
+}
+
+// Features returns the features in use on the current tunnel connection, i.e. the one served
+// last, until the next one starts. Each connection of a Tunnel serving several at the same time
+// has its own. They are valid after WaitReady returns. With an older version on the other side
+// that does not send HELLO, none of the features are in use. The other side may still answer pings
+func (tn *Tunnel) Features() Features {
+	tc, _ := tn.conns.current()
+	if tc == nil {
+		return Features{}
+	}
+	return tc.handshake.get()
+}
+
+// WaitReady waits until the handshake of the current tunnel connection is complete, i.e. the
+// first message from the other side is received, or the connection ends. It may be called before
+// Serve, to wait for the first connection. As an older version on the other side sends nothing until it has a session or a ping,
+// use a ctx with a deadline and treat the timeout as an older version.
+// It returns ErrTunnelClosed if the connection ends before the handshake
+func (tn *Tunnel) WaitReady(ctx context.Context) error {
+	tc, started := tn.conns.current()
+	if tc == nil {
+		select {
+		case <-started:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		tc, _ = tn.conns.current()
+	}
+	select {
+	case <-tc.handshake.wait():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	tc.handshake.mu.Lock()
+	defer tc.handshake.mu.Unlock()
+	if !tc.handshake.done {
+		return ErrTunnelClosed
+	}
+	return nil
+}
+
+// Upgrade agrees the features of the current tunnel connection again with the other side,
+// after changing the options of this side, e.g. enabling flow control with SetWindowSize.
+// Both sides must have AllowLiveUpgrade, or it returns ErrLiveUpgradeUnsupported. It waits until
+// the other side answers, and then Features returns the features in use from then on.
+//
+// Sessions already connected keep going as they were, so nothing in flight is disrupted:
+//   - FlowControl applies to the sessions connected after. Each session keeps the windows it was
+//     connected with, so sessions with and without flow control can be open at the same time.
+//   - Keepalive is always in use with this version. KeepaliveInterval can be changed at any time
+//     with SetKeepaliveInterval, without Upgrade.
+//   - Compression is always in use with this version, as both sides decompress any DATA.
+//   - Reordering cannot change on a live connection, as messages are numbered from the first one
+//     or not at all. It stays as agreed at the start. Reconnect to change ReorderBuffer.
+//
+// Either side may call it, also at the same time. A side with AllowLiveUpgrade answers the
+// other side without its options changing
+func (tn *Tunnel) Upgrade(ctx context.Context) error {
+	tc, _ := tn.conns.current()
+	if !tn.AllowLiveUpgrade || tc == nil || !tc.handshake.get().LiveUpgrade {
+		return ErrLiveUpgradeUnsupported
+	}
+	changed := tc.handshake.upgraded()
+	tn.upgradeMu.Lock()
+	if tn.upgradeCh != nil {
+		// Wake up the mappers to send UPGRADE
+		close(tn.upgradeCh)
+		tn.upgradeCh = nil
+	}
+	tn.upgradeMu.Unlock()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// upgrades returns a channel closed when Upgrade is called
+func (tn *Tunnel) upgrades() <-chan struct{} {
+	tn.upgradeMu.Lock()
+	defer tn.upgradeMu.Unlock()
+	if tn.upgradeCh == nil {
+		tn.upgradeCh = make(chan struct{})
+	}
+	return tn.upgradeCh
+}
@@ -0,0 +1,282 @@
+package portal
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oatcode/portal/pkg/message"
+	"google.golang.org/protobuf/proto"
+)
+
+// legacyPeer is the other side of a tunnel connection from before HELLO. It only knows the
+// messages up to DATA, and fails the test on any other, as the older version would hang on it
+type legacyPeer struct {
+	t    *testing.T
+	conn net.Conn
+	f    *ConnFramer
+}
+
+// serveLegacy serves tn on one end of net.Pipe with coch and returns the legacy side of the other
+func serveLegacy(t *testing.T, tn *Tunnel, coch chan ConnectOperation) *legacyPeer {
+	t.Helper()
+	ca, cb := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tn.Serve(ctx, NewConnFramer(ca), coch)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		cb.Close()
+		<-done
+	})
+	return &legacyPeer{t: t, conn: cb, f: NewConnFramer(cb)}
+}
+
+func (p *legacyPeer) read() *message.Message {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := p.f.Read()
+	if err != nil {
+		p.t.Fatalf("legacy read: %v", err)
+	}
+	m := &message.Message{}
+	if err := proto.Unmarshal(b, m); err != nil {
+		p.t.Fatal(err)
+	}
+	if m.Type > message.Message_DATA {
+		p.t.Fatalf("legacy side got %v", m.Type)
+	}
+	return m
+}
+
+// expect reads the next message, which must be of type typ
+func (p *legacyPeer) expect(typ message.Message_Type) *message.Message {
+	p.t.Helper()
+	m := p.read()
+	if m.Type != typ {
+		p.t.Fatalf("legacy side got %v, want %v", m.Type, typ)
+	}
+	return m
+}
+
+func (p *legacyPeer) write(m *message.Message) {
+	p.t.Helper()
+	b, err := proto.Marshal(m)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := p.f.Write(b); err != nil {
+		p.t.Fatalf("legacy write: %v", err)
+	}
+}
+
+// legacyCompatTunnel returns a LegacyCompat tunnel with keepalive and a small window, whose pings
+// and acknowledgements must not reach a side from before HELLO
+func legacyCompatTunnel() *Tunnel {
+	return &Tunnel{LegacyCompat: true, KeepaliveInterval: 10 * time.Millisecond, WindowSize: 1024}
+}
+
+// TestLegacyCompatClient connects through a LegacyCompat side to a side from before HELLO
+func TestLegacyCompatClient(t *testing.T) {
+	coch := make(chan ConnectOperation)
+	p := serveLegacy(t, legacyCompatTunnel(), coch)
+
+	cch := make(chan net.Conn)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := DialThrough(ctx, coch, "legacy:1")
+		if err != nil {
+			t.Error(err)
+		}
+		cch <- c
+	}()
+	m := p.expect(message.Message_HTTP_CONNECT)
+	if m.SocketAddress != "legacy:1" {
+		t.Fatalf("got address %q", m.SocketAddress)
+	}
+	id := m.Id
+	p.write(&message.Message{Type: message.Message_HTTP_CONNECT_OK, Id: id})
+	c := <-cch
+	if c == nil {
+		t.FailNow()
+	}
+	defer c.Close()
+
+	go io.WriteString(c, "ping")
+	if m = p.expect(message.Message_DATA); string(m.Buf) != "ping" || m.Origin != message.Message_ORIGIN_LOCAL {
+		t.Fatalf("got %q from %v", m.Buf, m.Origin)
+	}
+	p.write(&message.Message{Type: message.Message_DATA, Origin: message.Message_ORIGIN_REMOTE, Id: id, Buf: []byte("pong")})
+	b := make([]byte, 4)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "pong" {
+		t.Fatalf("got %q %v", b, err)
+	}
+	// Time for pings, which must not come
+	time.Sleep(50 * time.Millisecond)
+
+	// The destination closes, and the older version waits for DISCONNECTED in answer
+	p.write(&message.Message{Type: message.Message_DISCONNECTED, Origin: message.Message_ORIGIN_REMOTE, Id: id})
+	if _, err := c.Read(b); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+	p.expect(message.Message_DISCONNECTED)
+}
+
+// TestLegacyCompatServer connects from a side from before HELLO through a LegacyCompat side
+func TestLegacyCompatServer(t *testing.T) {
+	p := serveLegacy(t, legacyCompatTunnel(), nil)
+	p.write(&message.Message{Type: message.Message_HTTP_CONNECT, Id: 7, SocketAddress: listen(t, echo)})
+	p.expect(message.Message_HTTP_CONNECT_OK)
+	// Over a quarter of the window, which would be acknowledged with flow control
+	msg := strings.Repeat("hello ", 100)
+	p.write(&message.Message{Type: message.Message_DATA, Id: 7, Buf: []byte(msg)})
+	var got []byte
+	for len(got) < len(msg) {
+		m := p.expect(message.Message_DATA)
+		if m.Origin != message.Message_ORIGIN_REMOTE || m.Id != 7 {
+			t.Fatalf("got DATA from %v of %d", m.Origin, m.Id)
+		}
+		got = append(got, m.Buf...)
+	}
+	if string(got) != msg {
+		t.Fatal("echo mismatch")
+	}
+	time.Sleep(50 * time.Millisecond)
+	p.write(&message.Message{Type: message.Message_DISCONNECTED, Id: 7})
+	p.expect(message.Message_DISCONNECTED)
+}
+
+// TestLegacyCompatHalfClose checks that the end of the data disconnects the session with a side
+// from before half close
+func TestLegacyCompatHalfClose(t *testing.T) {
+	coch := make(chan ConnectOperation)
+	p := serveLegacy(t, legacyCompatTunnel(), coch)
+	c, s := tcpPair(t)
+	result := make(chan error, 1)
+	coch <- ConnectOperation{Conn: s, Address: "legacy:1", Result: result}
+	id := p.expect(message.Message_HTTP_CONNECT).Id
+	p.write(&message.Message{Type: message.Message_HTTP_CONNECT_OK, Id: id})
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	p.expect(message.Message_DISCONNECTED)
+	p.write(&message.Message{Type: message.Message_DISCONNECTED, Origin: message.Message_ORIGIN_REMOTE, Id: id})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
+
+// TestLegacyCompatFeatures checks that a LegacyCompat side agrees the features with a side that
+// sends HELLO and pings it, and uses none with another LegacyCompat side, where neither sends HELLO
+func TestLegacyCompatFeatures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	compat, current := legacyCompatTunnel(), &Tunnel{}
+	serveTunnel(t, compat, current)
+	if err := compat.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := current.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f := compat.Features(); !f.Keepalive || f != current.Features() {
+		t.Fatalf("got %+v and %+v", f, current.Features())
+	}
+	// The other side announced keepalive, so the pings start
+	waitFor(t, "keepalive", func() bool { return compat.Stats().KeepaliveRTT > 0 })
+
+	a, b := &Tunnel{LegacyCompat: true}, &Tunnel{LegacyCompat: true}
+	coch := serveTunnel(t, a, b)
+	c := dial(t, coch, listen(t, echo))
+	io.WriteString(c, "hi")
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if a.Features() != (Features{}) || b.Features() != (Features{}) {
+		t.Fatalf("got %+v and %+v", a.Features(), b.Features())
+	}
+}
+
+// TestHelloAfterConnect agrees the features with the HELLO of the other side that comes after a
+// session is initiated on this side. Without LegacyCompat, both sides send HELLO first, so it is
+// not an answer to the session
+func TestHelloAfterConnect(t *testing.T) {
+	tn := &Tunnel{}
+	coch := make(chan ConnectOperation)
+	p := serveLegacy(t, tn, coch)
+	c, s := tcpPair(t)
+	defer c.Close()
+	coch <- ConnectOperation{Conn: s, Address: "peer:1"}
+	for _, typ := range []message.Message_Type{message.Message_HELLO, message.Message_HTTP_CONNECT} {
+		p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := p.f.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &message.Message{}
+		if err := proto.Unmarshal(b, m); err != nil || m.Type != typ {
+			t.Fatalf("got %v %v, want %v", m.Type, err, typ)
+		}
+	}
+	p.write(helloMessage(tn.localFeatures()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tn.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f := tn.Features(); !f.HalfClose {
+		t.Fatalf("got features %+v", f)
+	}
+}
+
+// TestConcurrentServeFeatures serves two tunnel connections with one Tunnel at the same time,
+// with and without flow control on the other side. Each keeps its own features, and Features
+// reports the one started last
+func TestConcurrentServeFeatures(t *testing.T) {
+	summaries := make(chan Summary, 2)
+	hub := &Tunnel{WindowSize: 64 * 1024, OnClose: func(sm Summary) { summaries <- sm }}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// connect serves hub with peer and returns the end of the peer, which ends both when closed
+	connect := func(peer *Tunnel) net.Conn {
+		ca, cb := net.Pipe()
+		go hub.Serve(context.Background(), NewConnFramer(ca), nil)
+		go peer.Serve(context.Background(), NewConnFramer(cb), nil)
+		if err := peer.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cb.Close() })
+		return cb
+	}
+
+	first := connect(&Tunnel{WindowSize: 64 * 1024})
+	waitFor(t, "first handshake", func() bool { return hub.Features().FlowControl })
+	connect(&Tunnel{WindowSize: -1})
+	waitFor(t, "second handshake", func() bool { return hub.Features().HalfClose && !hub.Features().FlowControl })
+
+	first.Close()
+	select {
+	case sm := <-summaries:
+		if !sm.Features.FlowControl {
+			t.Fatalf("first connection ended with features %+v", sm.Features)
+		}
+	case <-ctx.Done():
+		t.Fatal("first connection not ended")
+	}
+	if f := hub.Features(); f.FlowControl {
+		t.Fatalf("got features %+v of the first connection after it ended", f)
+	}
+}
@@ -0,0 +1,36 @@
+package portal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleChecks is the number of times per IdleTimeout the sessions are checked
+const idleChecks = 4
+
+// touch records data read from or written to the connection of the session
+func (si *sessionInfo) touch() {
+	atomic.StoreInt64(&si.active, time.Now().UnixNano())
+}
+
+// idle is whether no data was read or written for the timeout. False before the proxyReader starts
+func (si *sessionInfo) idle(now time.Time, timeout time.Duration) bool {
+	active := atomic.LoadInt64(&si.active)
+	return active != 0 && now.Sub(time.Unix(0, active)) >= timeout
+}
+
+// closeIdle disconnects the sessions idle for the timeout. They end as the proxyWriters close their
+// connections, and the proxyReaders send the last messages with the reason
+func (tn *Tunnel) closeIdle(now time.Time, timeout time.Duration, maps ...map[int32]*session) {
+	for _, m := range maps {
+		for id, s := range m {
+			if s.closed || !s.info.idle(now, timeout) {
+				continue
+			}
+			tn.logf("mapper session idle. id=%d sa=%s timeout=%v", id, s.info.address, timeout)
+			s.closeCode = CloseIdleTimeout
+			s.closeReason = "idle timeout"
+			s.close()
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package portal
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrSessionIDsExhausted is the error the tunnel connection is closed with when the IDAllocator
+// has no id left for a new session
+var ErrSessionIDsExhausted = errors.New("no session id left")
+
+// IDAllocator allocates the ids of sessions initiated on this side of a tunnel connection, see
+// Tunnel.NewIDAllocator. It is only called from the mapper of the connection, so it needs no locking.
+// Next returns a non-negative id for which inUse is false, or false if all ids are in use.
+// Ids only need to be unique among the open sessions of this side, as each side numbers its own
+type IDAllocator interface {
+	Next(inUse func(id int32) bool) (int32, bool)
+}
+
+// sequentialIDs is the default IDAllocator. It allocates ids in increasing order from 0, skipping
+// the ids in use and wrapping around after the maximum. The ids are deterministic for each tunnel
+// connection, i.e. the first session gets 0 and the next 1, so tests can assert on them. Ids only
+// identify sessions within a tunnel, which is trusted, so they don't need to be unpredictable
+type sequentialIDs struct {
+	id int32
+}
+
+func (a *sequentialIDs) Next(inUse func(id int32) bool) (int32, bool) {
+	for i := int32(0); i < math.MaxInt32; i++ {
+		id := a.id + i
+		if id < 0 {
+			// Wrapped around
+			id -= math.MinInt32
+		}
+		if !inUse(id) {
+			a.id = id + 1
+			if a.id < 0 {
+				a.id = 0
+			}
+			return id, true
+		}
+	}
+	return 0, false
+}
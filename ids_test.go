@@ -0,0 +1,145 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSequentialIDs(t *testing.T) {
+	used := map[int32]bool{}
+	inUse := func(id int32) bool { return used[id] }
+	tests := []struct {
+		name  string
+		start int32
+		used  []int32
+		want  []int32
+	}{
+		{name: "from 0", want: []int32{0, 1, 2}},
+		{name: "skips ids in use", used: []int32{1, 2, 4}, want: []int32{0, 3, 5}},
+		{name: "wraps around", start: math.MaxInt32 - 1, want: []int32{math.MaxInt32 - 1, math.MaxInt32, 0, 1}},
+		{name: "wraps around past ids in use", start: math.MaxInt32, used: []int32{math.MaxInt32, 0, 1}, want: []int32{2, 3}},
+		{name: "goes on from the last id", start: 5, used: []int32{5, 6}, want: []int32{7, 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used = map[int32]bool{}
+			for _, id := range tt.used {
+				used[id] = true
+			}
+			a := &sequentialIDs{id: tt.start}
+			for _, want := range tt.want {
+				id, ok := a.Next(inUse)
+				if !ok || id != want {
+					t.Fatalf("got %d %v, want %d", id, ok, want)
+				}
+				used[id] = true
+			}
+		})
+	}
+}
+
+// ringIDs allocates the given ids over and over, as many as there may be sessions
+type ringIDs struct {
+	ids  []int32
+	next int
+}
+
+func (a *ringIDs) Next(inUse func(id int32) bool) (int32, bool) {
+	for range a.ids {
+		id := a.ids[a.next%len(a.ids)]
+		a.next++
+		if !inUse(id) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// TestIDAllocatorReuse checks that the ids of NewIDAllocator are used on the wire, and that an id
+// is used again once its session ended on both sides
+func TestIDAllocatorReuse(t *testing.T) {
+	opened := make(chan int32, 10)
+	ended := make(chan int32, 10)
+	tn := &Tunnel{
+		NewIDAllocator: func() IDAllocator { return &ringIDs{ids: []int32{5, 6}} },
+		OnSessionOpen:  func(id int32, address string, local bool) { opened <- id },
+		OnSessionEnd:   func(id int32, local bool, err error) { ended <- id },
+	}
+	remote := make(chan int32, 10)
+	coch := serveTunnel(t, tn, &Tunnel{OnSessionOpen: func(id int32, address string, local bool) { remote <- id }})
+	address := listen(t, echo)
+	next := func(ch chan int32) int32 {
+		t.Helper()
+		select {
+		case id := <-ch:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+			return 0
+		}
+	}
+
+	c1 := dial(t, coch, address)
+	dial(t, coch, address)
+	if a, b := next(opened), next(opened); a != 5 || b != 6 {
+		t.Fatalf("got ids %d and %d", a, b)
+	}
+	if a, b := next(remote), next(remote); a != 5 || b != 6 {
+		t.Fatalf("got ids %d and %d on the other side", a, b)
+	}
+	c1.Close()
+	if id := next(ended); id != 5 {
+		t.Fatalf("got %d ended", id)
+	}
+	// 6 is still in use, so 5 is used again
+	dial(t, coch, address)
+	if id := next(opened); id != 5 {
+		t.Fatalf("got id %d", id)
+	}
+	if id := next(remote); id != 5 {
+		t.Fatalf("got id %d on the other side", id)
+	}
+}
+
+// badIDs returns an id in use
+type badIDs struct{}
+
+func (badIDs) Next(inUse func(id int32) bool) (int32, bool) { return 0, true }
+
+// TestIDAllocatorInvalid checks that an invalid id refuses the session, and that running out of
+// ids refuses it and ends the tunnel connection
+func TestIDAllocatorInvalid(t *testing.T) {
+	coch := serveTunnel(t, &Tunnel{NewIDAllocator: func() IDAllocator { return badIDs{} }}, &Tunnel{})
+	address := listen(t, echo)
+	dial(t, coch, address)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := DialThrough(ctx, coch, address); !errors.Is(err, ErrServiceUnavailable) {
+		t.Fatalf("got %v, want ErrServiceUnavailable", err)
+	}
+
+	ca, cb := net.Pipe()
+	defer cb.Close()
+	go (&Tunnel{}).Serve(context.Background(), NewConnFramer(cb), nil)
+	coch = make(chan ConnectOperation)
+	done := make(chan error, 1)
+	go func() {
+		done <- (&Tunnel{NewIDAllocator: func() IDAllocator { return &ringIDs{ids: []int32{0}} }}).Serve(context.Background(), NewConnFramer(ca), coch)
+	}()
+	dial(t, coch, address)
+	if _, err := DialThrough(ctx, coch, address); !errors.Is(err, ErrServiceUnavailable) {
+		t.Fatalf("got %v, want ErrServiceUnavailable", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrSessionIDsExhausted) {
+			t.Fatalf("got %v, want ErrSessionIDsExhausted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel connection not ended without ids")
+	}
+}
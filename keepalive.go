@@ -0,0 +1,171 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// ErrKeepaliveTimeout is the error the tunnel connection is closed with when a keepalive ping is not answered
+var ErrKeepaliveTimeout = errors.New("keepalive timeout")
+
+// ErrTransportStalled is the error the tunnel connection is closed with when no message arrives
+// within TransportIdleTimeout
+var ErrTransportStalled = errors.New("tunnel transport stalled")
+
+// SetKeepaliveInterval changes KeepaliveInterval while the tunnel may be serving.
+// The next ping is sent the new interval after the previous one, or right away if that has passed.
+// A ping already sent is still waited for as long as when it was sent
+func (tn *Tunnel) SetKeepaliveInterval(d time.Duration) {
+	tn.keepaliveMu.Lock()
+	defer tn.keepaliveMu.Unlock()
+	tn.KeepaliveInterval = d
+	if tn.keepaliveChanged != nil {
+		// Wake up all keepalive loops
+		close(tn.keepaliveChanged)
+		tn.keepaliveChanged = nil
+	}
+}
+
+// keepaliveInterval returns the current interval and a channel closed when it changes
+func (tn *Tunnel) keepaliveInterval() (time.Duration, <-chan struct{}) {
+	tn.keepaliveMu.Lock()
+	defer tn.keepaliveMu.Unlock()
+	if tn.keepaliveChanged == nil {
+		tn.keepaliveChanged = make(chan struct{})
+	}
+	return tn.KeepaliveInterval, tn.keepaliveChanged
+}
+
+// keepaliveTimeout returns KeepaliveTimeout, or the interval by default
+func (tn *Tunnel) keepaliveTimeout(interval time.Duration) time.Duration {
+	if tn.KeepaliveTimeout > 0 {
+		return tn.KeepaliveTimeout
+	}
+	return interval
+}
+
+// keepalive sends pings to the other side and ends the connection with closeConn if one is not answered in time.
+// kch receives the pongs from the mapper.
+// The oldest unanswered ping keeps its deadline when more pings are sent, as a pong
+// cannot tell which ping it answers
+func (tn *Tunnel) keepalive(ctx context.Context, closeConn func(error) error, och chan<- *message.Message, kch <-chan struct{}) {
+	tc := connOf(ctx)
+	last := time.Now()
+	// Ping due but not yet taken by tunnelWriter
+	due := false
+	// Unanswered ping and its deadline
+	pending := false
+	var deadline time.Time
+	// Time the last ping was taken by tunnelWriter, for measuring the round trip
+	var sent time.Time
+	for {
+		interval, changed := tn.keepaliveInterval()
+		// With LegacyCompat, no pings until the other side announces keepalive, as an older
+		// side does not know PING. Look again when the first message from it is received
+		var ready <-chan struct{}
+		if tn.LegacyCompat && !tc.handshake.get().Keepalive {
+			interval = 0
+			if ready = tc.handshake.wait(); isClosed(ready) {
+				ready = nil
+			}
+		}
+		var timer *time.Timer
+		var tch <-chan time.Time
+		if interval > 0 || pending {
+			var next time.Time
+			if interval > 0 && !due {
+				next = last.Add(interval)
+			}
+			if pending && (next.IsZero() || deadline.Before(next)) {
+				next = deadline
+			}
+			if !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				tch = timer.C
+			}
+		}
+		var pch chan<- *message.Message
+		if due {
+			pch = och
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ready:
+		case <-kch:
+			pending = false
+			if !sent.IsZero() {
+				tn.counters.setKeepaliveRTT(time.Since(sent))
+				sent = time.Time{}
+			}
+		case pch <- &message.Message{Type: message.Message_PING}:
+			due = false
+			sent = time.Now()
+		case now := <-tch:
+			if pending && !now.Before(deadline) {
+				tn.warnf("keepalive timeout")
+				closeConn(ErrKeepaliveTimeout)
+				return
+			}
+			if interval > 0 && !now.Before(last.Add(interval)) {
+				// Deadline counts from when the ping is due, in case tunnelWriter is stuck
+				last = now
+				due = true
+				if !pending {
+					pending = true
+					deadline = now.Add(tn.keepaliveTimeout(interval))
+				}
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// transportIdleTimeout returns TransportIdleTimeout raised to KeepaliveInterval plus
+// KeepaliveTimeout, so that an answered ping always arrives in time
+func (tn *Tunnel) transportIdleTimeout() time.Duration {
+	d := tn.TransportIdleTimeout
+	if d <= 0 {
+		return 0
+	}
+	interval, _ := tn.keepaliveInterval()
+	if interval > 0 {
+		if min := interval + tn.keepaliveTimeout(interval); d < min {
+			d = min
+		}
+	}
+	return d
+}
+
+// idleTimer closes the tunnel connection when no message is read for its timeout.
+// It runs only while waiting for a message, so the time passing messages on is not counted
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, closeConn func(error) error, logf func(string, ...interface{})) *idleTimer {
+	return &idleTimer{
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			logf("tunnel transport stalled. timeout=%v", timeout)
+			closeConn(ErrTransportStalled)
+		}),
+	}
+}
+
+// start restarts the timeout before reading a message
+func (t *idleTimer) start() {
+	t.timer.Reset(t.timeout)
+}
+
+func (t *idleTimer) stop() {
+	t.timer.Stop()
+}
@@ -0,0 +1,80 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveSilent serves tn against another side that reads everything and answers nothing, and
+// returns the error of Serve
+func serveSilent(t *testing.T, tn *Tunnel) <-chan error {
+	ca, cb := net.Pipe()
+	go func() {
+		f := NewConnFramer(cb)
+		for {
+			if _, err := f.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tn.Serve(ctx, NewConnFramer(ca), nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		cb.Close()
+	})
+	return errc
+}
+
+// TestSetKeepaliveInterval starts pings on a serving tunnel, which has none at first
+func TestSetKeepaliveInterval(t *testing.T) {
+	a, b := &Tunnel{}, &Tunnel{}
+	serveTunnel(t, a, b)
+	time.Sleep(50 * time.Millisecond)
+	if rtt := a.Stats().KeepaliveRTT; rtt != 0 {
+		t.Fatalf("got a ping round trip of %v without KeepaliveInterval", rtt)
+	}
+	a.SetKeepaliveInterval(10 * time.Millisecond)
+	waitFor(t, "keepalive", func() bool { return a.Stats().KeepaliveRTT > 0 })
+}
+
+// TestSetKeepaliveIntervalTimeout shortens the interval from an hour with the other side not
+// answering, which must then time out without waiting for the hour
+func TestSetKeepaliveIntervalTimeout(t *testing.T) {
+	tn := &Tunnel{KeepaliveInterval: time.Hour}
+	errc := serveSilent(t, tn)
+	time.Sleep(50 * time.Millisecond)
+	tn.SetKeepaliveInterval(20 * time.Millisecond)
+	if err := <-errc; !errors.Is(err, ErrKeepaliveTimeout) {
+		t.Fatalf("got %v, want %v", err, ErrKeepaliveTimeout)
+	}
+}
+
+// TestTransportIdleTimeout ends a tunnel connection on which nothing arrives
+func TestTransportIdleTimeout(t *testing.T) {
+	started := time.Now()
+	if err := <-serveSilent(t, &Tunnel{TransportIdleTimeout: 50 * time.Millisecond}); !errors.Is(err, ErrTransportStalled) {
+		t.Fatalf("got %v, want %v", err, ErrTransportStalled)
+	}
+	if d := time.Since(started); d < 50*time.Millisecond {
+		t.Fatalf("stalled after %v", d)
+	}
+}
+
+// TestTransportIdleTimeoutKeepalive checks that the pongs of the pings keep a tunnel connection
+// without sessions from stalling, with TransportIdleTimeout raised to a ping round
+func TestTransportIdleTimeoutKeepalive(t *testing.T) {
+	tn := &Tunnel{KeepaliveInterval: 20 * time.Millisecond, TransportIdleTimeout: 10 * time.Millisecond}
+	if d := tn.transportIdleTimeout(); d != 40*time.Millisecond {
+		t.Fatalf("got %v, want the interval and the keepalive timeout", d)
+	}
+	coch := serveTunnel(t, tn, &Tunnel{})
+	time.Sleep(200 * time.Millisecond)
+	transfer(t, dial(t, coch, listen(t, echo)), 100)
+}
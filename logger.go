@@ -0,0 +1,79 @@
+package portal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Levels of the events of Logger
+const (
+	// LevelDebug is for the lifecycle of each session, e.g. starts and connects, and WireDebug
+	LevelDebug = "debug"
+	// LevelInfo is for the normal course of the tunnel, e.g. a session refused by the other side
+	LevelInfo = "info"
+	// LevelWarn is for limits and timeouts, e.g. MaxSessions reached or a keepalive timeout
+	LevelWarn = "warn"
+	// LevelError is for read, write and connect errors
+	LevelError = "error"
+)
+
+// Logger takes the log events of a tunnel as structured data, see Tunnel.Logger
+type Logger interface {
+	// Event logs an event with its level, its message, e.g. "proxyReader read error", and its fields
+	// as pairs of key and value. Common keys are id for the session, sa for the address it connects
+	// to, conn for its connection, and err for the error
+	Event(level, msg string, kv ...interface{})
+}
+
+// logField matches a field of a log line, e.g. id=%d
+var logField = regexp.MustCompile(`(\w+)=(%[-+# 0-9.]*[a-zA-Z])`)
+
+// logEvent splits a log line into the message before ". " and the key=value fields after it.
+// A line not in that form is the message as a whole, without fields
+func logEvent(format string, v ...interface{}) (string, []interface{}) {
+	i := strings.Index(format, ". ")
+	if i < 0 {
+		return fmt.Sprintf(format, v...), nil
+	}
+	head, rest := format[:i], format[i+2:]
+	n := verbs(head)
+	fields := logField.FindAllStringSubmatch(rest, -1)
+	if n+len(fields) != len(v) || verbs(rest) != len(fields) {
+		return fmt.Sprintf(format, v...), nil
+	}
+	kv := make([]interface{}, 0, 2*len(fields))
+	for j, f := range fields {
+		kv = append(kv, f[1], v[n+j])
+	}
+	return fmt.Sprintf(head, v[:n]...), kv
+}
+
+// verbs counts the formatting verbs of a format
+func verbs(format string) int {
+	return strings.Count(format, "%") - 2*strings.Count(format, "%%")
+}
+
+// log logs a line of the tunnel at the level to Logger, or to Logf without it
+func (tn *Tunnel) log(level, format string, v ...interface{}) {
+	if tn.Logger != nil {
+		msg, kv := logEvent(format, v...)
+		tn.Logger.Event(level, msg, kv...)
+		return
+	}
+	if lf := tn.logger(); lf != nil {
+		lf(format, v...)
+	}
+}
+
+func (tn *Tunnel) debugf(format string, v ...interface{}) {
+	tn.log(LevelDebug, format, v...)
+}
+
+func (tn *Tunnel) warnf(format string, v ...interface{}) {
+	tn.log(LevelWarn, format, v...)
+}
+
+func (tn *Tunnel) errorf(format string, v ...interface{}) {
+	tn.log(LevelError, format, v...)
+}
@@ -0,0 +1,71 @@
+package portal
+
+import (
+	"sync"
+	"time"
+)
+
+const sessionLogReportInterval = 10 * time.Second
+
+// sessionLogs counts the session lines left out by SessionLogSampling
+var sessionLogs struct {
+	mu         sync.Mutex
+	suppressed int64
+	reported   time.Time
+	// Sequence of the lines without a session id
+	seq int64
+}
+
+// sessionLogf logs a line of the lifecycle of session id with SessionLogSampling to the package Logf.
+// Lines without a session, id -1, are sampled one by one
+func sessionLogf(id int32, fmt string, v ...interface{}) {
+	sampleSessionLog(Logf, id, fmt, v...)
+}
+
+// sessionLogf logs a line of the lifecycle of session id with SessionLogSampling to the logger of the tunnel,
+// at LevelDebug with Logger
+func (tn *Tunnel) sessionLogf(id int32, fmt string, v ...interface{}) {
+	lf := tn.logger()
+	if tn.Logger != nil {
+		lf = tn.debugf
+	}
+	sampleSessionLog(lf, id, fmt, v...)
+}
+
+// sampleSessionLog logs the session line to lf if it is sampled.
+// The sampling is shared by all the tunnels, like SessionLogSampling
+func sampleSessionLog(lf func(string, ...interface{}), id int32, fmt string, v ...interface{}) {
+	n := SessionLogSampling
+	if lf == nil {
+		return
+	}
+	if n <= 1 {
+		lf(fmt, v...)
+		return
+	}
+	sessionLogs.mu.Lock()
+	var sampled bool
+	if id < 0 {
+		sampled = sessionLogs.seq%int64(n) == 0
+		sessionLogs.seq++
+	} else {
+		sampled = int64(id)%int64(n) == 0
+	}
+	if !sampled {
+		sessionLogs.suppressed++
+	}
+	var suppressed int64
+	now := time.Now()
+	if sessionLogs.suppressed > 0 && now.Sub(sessionLogs.reported) >= sessionLogReportInterval {
+		suppressed = sessionLogs.suppressed
+		sessionLogs.suppressed = 0
+		sessionLogs.reported = now
+	}
+	sessionLogs.mu.Unlock()
+	if suppressed > 0 {
+		lf("session log lines suppressed by sampling. count=%d", suppressed)
+	}
+	if sampled {
+		lf(fmt, v...)
+	}
+}
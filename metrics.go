@@ -0,0 +1,75 @@
+package portal
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats is the record of one session, for OnSessionClosed
+type SessionStats struct {
+	// ID is the id of the session on the tunnel connection
+	ID int32
+
+	// Local is whether the session was initiated on this side
+	Local bool
+
+	// Address is the address the session connected to
+	Address string
+
+	// BytesRead is the number of bytes read from the proxied connection
+	BytesRead int64
+
+	// BytesWritten is the number of bytes written to the proxied connection
+	BytesWritten int64
+
+	// Duration is how long the session was open
+	Duration time.Duration
+
+	// Reason is why the session ended, by this side or the other. Empty for a normal close
+	Reason string
+}
+
+// sessionClosed reports a connected session ending to LogEventsJSON, OnSessionClosed and OnSessionEnd.
+// The mapper calls it once as it removes the session, with nil for a normal close
+func (tn *Tunnel) sessionClosed(id int32, local bool, s *session, err error) {
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	tn.emitSession(eventSessionClose, id, local, s.info, reason)
+	if tn.OnSessionClosed != nil {
+		tn.OnSessionClosed(SessionStats{
+			ID:           id,
+			Local:        local,
+			Address:      s.info.address,
+			BytesRead:    atomic.LoadInt64(&s.info.read),
+			BytesWritten: atomic.LoadInt64(&s.info.written),
+			Duration:     time.Since(s.created),
+			Reason:       reason,
+		})
+	}
+	tn.sessionEnd(id, local, err)
+}
+
+// sessionOpen reports a session added by the mapper to OnSessionOpen
+func (tn *Tunnel) sessionOpen(id int32, local bool, address string) {
+	if tn.OnSessionOpen != nil {
+		tn.OnSessionOpen(id, address, local)
+	}
+}
+
+// sessionEnd reports a session removed by the mapper to OnSessionEnd
+func (tn *Tunnel) sessionEnd(id int32, local bool, err error) {
+	if tn.OnSessionEnd != nil {
+		tn.OnSessionEnd(id, local, err)
+	}
+}
+
+// reasonError returns the reason a session was closed with as an error, nil for a normal close
+func reasonError(reason string) error {
+	if reason == "" {
+		return nil
+	}
+	return errors.New(reason)
+}
@@ -0,0 +1,43 @@
+package portal
+
+import (
+	"context"
+	"time"
+)
+
+// pacer paces the reads of a session to PerSessionBytesPerSec with a token bucket.
+// It holds up to one second of bytes. A read may take the bucket below zero, and the next one
+// waits until it is paid back, so the data already read is sent without waiting.
+// It is only used by the proxyReader of the session
+type pacer struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(rate int) *pacer {
+	return &pacer{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take takes n bytes and waits until the bucket is no longer below zero.
+// It returns false if ctx is done meanwhile
+func (p *pacer) take(ctx context.Context, n int) bool {
+	now := time.Now()
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.rate {
+		p.tokens = p.rate
+	}
+	p.last = now
+	p.tokens -= float64(n)
+	if p.tokens >= 0 {
+		return true
+	}
+	t := time.NewTimer(time.Duration(-p.tokens / p.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
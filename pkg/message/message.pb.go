@@ -28,16 +28,32 @@ const (
 	Message_HTTP_SERVICE_UNAVAILABLE Message_Type = 2
 	Message_DISCONNECTED             Message_Type = 3
 	Message_DATA                     Message_Type = 4
+	Message_HALF_CLOSED              Message_Type = 5
+	Message_ACK                      Message_Type = 6
+	// Keepalive of the tunnel connection. No id
+	Message_PING Message_Type = 7
+	Message_PONG Message_Type = 8
+	// First message on the tunnel connection with the version and features of the sender. No id
+	Message_HELLO Message_Type = 9
+	// HELLO sent again on the connection with the current features of the sender, with
+	// AllowLiveUpgrade. The other side answers with HELLO. No id
+	Message_UPGRADE Message_Type = 10
 )
 
 // Enum value maps for Message_Type.
 var (
 	Message_Type_name = map[int32]string{
-		0: "HTTP_CONNECT",
-		1: "HTTP_CONNECT_OK",
-		2: "HTTP_SERVICE_UNAVAILABLE",
-		3: "DISCONNECTED",
-		4: "DATA",
+		0:  "HTTP_CONNECT",
+		1:  "HTTP_CONNECT_OK",
+		2:  "HTTP_SERVICE_UNAVAILABLE",
+		3:  "DISCONNECTED",
+		4:  "DATA",
+		5:  "HALF_CLOSED",
+		6:  "ACK",
+		7:  "PING",
+		8:  "PONG",
+		9:  "HELLO",
+		10: "UPGRADE",
 	}
 	Message_Type_value = map[string]int32{
 		"HTTP_CONNECT":             0,
@@ -45,6 +61,12 @@ var (
 		"HTTP_SERVICE_UNAVAILABLE": 2,
 		"DISCONNECTED":             3,
 		"DATA":                     4,
+		"HALF_CLOSED":              5,
+		"ACK":                      6,
+		"PING":                     7,
+		"PONG":                     8,
+		"HELLO":                    9,
+		"UPGRADE":                  10,
 	}
 )
 
@@ -131,6 +153,39 @@ type Message struct {
 	Id            int32          `protobuf:"varint,3,opt,name=id,proto3" json:"id,omitempty"`
 	SocketAddress string         `protobuf:"bytes,4,opt,name=socket_address,json=socketAddress,proto3" json:"socket_address,omitempty"`
 	Buf           []byte         `protobuf:"bytes,5,opt,name=buf,proto3" json:"buf,omitempty"`
+	// Receive window of the sender for HTTP_CONNECT and HTTP_CONNECT_OK. 0 for no flow control
+	Window int32 `protobuf:"varint,6,opt,name=window,proto3" json:"window,omitempty"`
+	// Number of bytes written to the connection for ACK
+	Acked int32 `protobuf:"varint,7,opt,name=acked,proto3" json:"acked,omitempty"`
+	// Why the session ended for DISCONNECTED. 0 for unspecified
+	CloseCode int32 `protobuf:"varint,8,opt,name=close_code,json=closeCode,proto3" json:"close_code,omitempty"`
+	// Description of close_code for DISCONNECTED, or why the connect failed for
+	// HTTP_SERVICE_UNAVAILABLE with ReportConnectErrors. Empty if not given
+	CloseReason string `protobuf:"bytes,9,opt,name=close_reason,json=closeReason,proto3" json:"close_reason,omitempty"`
+	// Number of the message on the tunnel connection from 1, for reordering by the receiver.
+	// 0 if the sender does not number messages
+	Seq uint64 `protobuf:"varint,10,opt,name=seq,proto3" json:"seq,omitempty"`
+	// Seconds to wait before connecting again for HTTP_SERVICE_UNAVAILABLE. 0 if unknown
+	RetryAfter int32 `protobuf:"varint,11,opt,name=retry_after,json=retryAfter,proto3" json:"retry_after,omitempty"`
+	// Bits of the features supported and enabled by the sender for HELLO and UPGRADE
+	Features uint32 `protobuf:"varint,12,opt,name=features,proto3" json:"features,omitempty"`
+	// Proxy-Authorization of the client for HTTP_CONNECT with ForwardProxyAuth
+	ProxyAuthorization string `protobuf:"bytes,13,opt,name=proxy_authorization,json=proxyAuthorization,proto3" json:"proxy_authorization,omitempty"`
+	// Most DATA messages of the session the sender queues for HTTP_CONNECT and HTTP_CONNECT_OK,
+	// counted with the window. 0 for no limit
+	MaxQueued int32 `protobuf:"varint,14,opt,name=max_queued,json=maxQueued,proto3" json:"max_queued,omitempty"`
+	// Number of DATA messages written to the connection for ACK
+	AckedMessages int32 `protobuf:"varint,15,opt,name=acked_messages,json=ackedMessages,proto3" json:"acked_messages,omitempty"`
+	// Algorithm buf of DATA is compressed with, see Compression. 0 if not compressed
+	Compression uint32 `protobuf:"varint,16,opt,name=compression,proto3" json:"compression,omitempty"`
+	// Protocol version of the sender for HELLO, and the oldest version of the other side it works
+	// with. 0 for both from a sender before versions
+	Version    uint32 `protobuf:"varint,17,opt,name=version,proto3" json:"version,omitempty"`
+	MinVersion uint32 `protobuf:"varint,18,opt,name=min_version,json=minVersion,proto3" json:"min_version,omitempty"`
+	// HTTP_CONNECT of a session of datagrams: the other side dials UDP, and each DATA is one datagram
+	Datagram bool `protobuf:"varint,19,opt,name=datagram,proto3" json:"datagram,omitempty"`
+	// DATA split for the Framer, with more of the same data in the next DATA of the session
+	More bool `protobuf:"varint,20,opt,name=more,proto3" json:"more,omitempty"`
 }
 
 func (x *Message) Reset() {
@@ -200,11 +255,116 @@ func (x *Message) GetBuf() []byte {
 	return nil
 }
 
+func (x *Message) GetWindow() int32 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+func (x *Message) GetAcked() int32 {
+	if x != nil {
+		return x.Acked
+	}
+	return 0
+}
+
+func (x *Message) GetCloseCode() int32 {
+	if x != nil {
+		return x.CloseCode
+	}
+	return 0
+}
+
+func (x *Message) GetCloseReason() string {
+	if x != nil {
+		return x.CloseReason
+	}
+	return ""
+}
+
+func (x *Message) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Message) GetRetryAfter() int32 {
+	if x != nil {
+		return x.RetryAfter
+	}
+	return 0
+}
+
+func (x *Message) GetFeatures() uint32 {
+	if x != nil {
+		return x.Features
+	}
+	return 0
+}
+
+func (x *Message) GetProxyAuthorization() string {
+	if x != nil {
+		return x.ProxyAuthorization
+	}
+	return ""
+}
+
+func (x *Message) GetMaxQueued() int32 {
+	if x != nil {
+		return x.MaxQueued
+	}
+	return 0
+}
+
+func (x *Message) GetAckedMessages() int32 {
+	if x != nil {
+		return x.AckedMessages
+	}
+	return 0
+}
+
+func (x *Message) GetCompression() uint32 {
+	if x != nil {
+		return x.Compression
+	}
+	return 0
+}
+
+func (x *Message) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Message) GetMinVersion() uint32 {
+	if x != nil {
+		return x.MinVersion
+	}
+	return 0
+}
+
+func (x *Message) GetDatagram() bool {
+	if x != nil {
+		return x.Datagram
+	}
+	return false
+}
+
+func (x *Message) GetMore() bool {
+	if x != nil {
+		return x.More
+	}
+	return false
+}
+
 var File_message_proto protoreflect.FileDescriptor
 
 var file_message_proto_rawDesc = []byte{
 	0x0a, 0x0d, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
-	0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0xc6, 0x02, 0x0a, 0x07, 0x4d, 0x65, 0x73,
+	0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0xd0, 0x06, 0x0a, 0x07, 0x4d, 0x65, 0x73,
 	0x73, 0x61, 0x67, 0x65, 0x12, 0x29, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01,
 	0x28, 0x0e, 0x32, 0x15, 0x2e, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x4d, 0x65, 0x73,
 	0x73, 0x61, 0x67, 0x65, 0x2e, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12,
@@ -215,18 +375,51 @@ var file_message_proto_rawDesc = []byte{
 	0x12, 0x25, 0x0a, 0x0e, 0x73, 0x6f, 0x63, 0x6b, 0x65, 0x74, 0x5f, 0x61, 0x64, 0x64, 0x72, 0x65,
 	0x73, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x73, 0x6f, 0x63, 0x6b, 0x65, 0x74,
 	0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x10, 0x0a, 0x03, 0x62, 0x75, 0x66, 0x18, 0x05,
-	0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x62, 0x75, 0x66, 0x22, 0x67, 0x0a, 0x04, 0x54, 0x79, 0x70,
-	0x65, 0x12, 0x10, 0x0a, 0x0c, 0x48, 0x54, 0x54, 0x50, 0x5f, 0x43, 0x4f, 0x4e, 0x4e, 0x45, 0x43,
-	0x54, 0x10, 0x00, 0x12, 0x13, 0x0a, 0x0f, 0x48, 0x54, 0x54, 0x50, 0x5f, 0x43, 0x4f, 0x4e, 0x4e,
-	0x45, 0x43, 0x54, 0x5f, 0x4f, 0x4b, 0x10, 0x01, 0x12, 0x1c, 0x0a, 0x18, 0x48, 0x54, 0x54, 0x50,
-	0x5f, 0x53, 0x45, 0x52, 0x56, 0x49, 0x43, 0x45, 0x5f, 0x55, 0x4e, 0x41, 0x56, 0x41, 0x49, 0x4c,
-	0x41, 0x42, 0x4c, 0x45, 0x10, 0x02, 0x12, 0x10, 0x0a, 0x0c, 0x44, 0x49, 0x53, 0x43, 0x4f, 0x4e,
-	0x4e, 0x45, 0x43, 0x54, 0x45, 0x44, 0x10, 0x03, 0x12, 0x08, 0x0a, 0x04, 0x44, 0x41, 0x54, 0x41,
-	0x10, 0x04, 0x22, 0x2d, 0x0a, 0x06, 0x4f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x12, 0x10, 0x0a, 0x0c,
-	0x4f, 0x52, 0x49, 0x47, 0x49, 0x4e, 0x5f, 0x4c, 0x4f, 0x43, 0x41, 0x4c, 0x10, 0x00, 0x12, 0x11,
-	0x0a, 0x0d, 0x4f, 0x52, 0x49, 0x47, 0x49, 0x4e, 0x5f, 0x52, 0x45, 0x4d, 0x4f, 0x54, 0x45, 0x10,
-	0x01, 0x42, 0x0d, 0x5a, 0x0b, 0x70, 0x6b, 0x67, 0x2f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
-	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x62, 0x75, 0x66, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x69, 0x6e,
+	0x64, 0x6f, 0x77, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f,
+	0x77, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x63, 0x6b, 0x65, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x05, 0x61, 0x63, 0x6b, 0x65, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x6c, 0x6f, 0x73, 0x65,
+	0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x63, 0x6c, 0x6f,
+	0x73, 0x65, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6c, 0x6f, 0x73, 0x65, 0x5f,
+	0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x63, 0x6c,
+	0x6f, 0x73, 0x65, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x73, 0x65, 0x71,
+	0x18, 0x0a, 0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73, 0x65, 0x71, 0x12, 0x1f, 0x0a, 0x0b, 0x72,
+	0x65, 0x74, 0x72, 0x79, 0x5f, 0x61, 0x66, 0x74, 0x65, 0x72, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x0a, 0x72, 0x65, 0x74, 0x72, 0x79, 0x41, 0x66, 0x74, 0x65, 0x72, 0x12, 0x1a, 0x0a, 0x08,
+	0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08,
+	0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x12, 0x2f, 0x0a, 0x13, 0x70, 0x72, 0x6f, 0x78,
+	0x79, 0x5f, 0x61, 0x75, 0x74, 0x68, 0x6f, 0x72, 0x69, 0x7a, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18,
+	0x0d, 0x20, 0x01, 0x28, 0x09, 0x52, 0x12, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x41, 0x75, 0x74, 0x68,
+	0x6f, 0x72, 0x69, 0x7a, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x61, 0x78,
+	0x5f, 0x71, 0x75, 0x65, 0x75, 0x65, 0x64, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x6d,
+	0x61, 0x78, 0x51, 0x75, 0x65, 0x75, 0x65, 0x64, 0x12, 0x25, 0x0a, 0x0e, 0x61, 0x63, 0x6b, 0x65,
+	0x64, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x0d, 0x61, 0x63, 0x6b, 0x65, 0x64, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x12,
+	0x20, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x10,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f,
+	0x6e, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x11, 0x20, 0x01,
+	0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x6d,
+	0x69, 0x6e, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x12, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x0a, 0x6d, 0x69, 0x6e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08,
+	0x64, 0x61, 0x74, 0x61, 0x67, 0x72, 0x61, 0x6d, 0x18, 0x13, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08,
+	0x64, 0x61, 0x74, 0x61, 0x67, 0x72, 0x61, 0x6d, 0x12, 0x12, 0x0a, 0x04, 0x6d, 0x6f, 0x72, 0x65,
+	0x18, 0x14, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x6d, 0x6f, 0x72, 0x65, 0x22, 0xad, 0x01, 0x0a,
+	0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x10, 0x0a, 0x0c, 0x48, 0x54, 0x54, 0x50, 0x5f, 0x43, 0x4f,
+	0x4e, 0x4e, 0x45, 0x43, 0x54, 0x10, 0x00, 0x12, 0x13, 0x0a, 0x0f, 0x48, 0x54, 0x54, 0x50, 0x5f,
+	0x43, 0x4f, 0x4e, 0x4e, 0x45, 0x43, 0x54, 0x5f, 0x4f, 0x4b, 0x10, 0x01, 0x12, 0x1c, 0x0a, 0x18,
+	0x48, 0x54, 0x54, 0x50, 0x5f, 0x53, 0x45, 0x52, 0x56, 0x49, 0x43, 0x45, 0x5f, 0x55, 0x4e, 0x41,
+	0x56, 0x41, 0x49, 0x4c, 0x41, 0x42, 0x4c, 0x45, 0x10, 0x02, 0x12, 0x10, 0x0a, 0x0c, 0x44, 0x49,
+	0x53, 0x43, 0x4f, 0x4e, 0x4e, 0x45, 0x43, 0x54, 0x45, 0x44, 0x10, 0x03, 0x12, 0x08, 0x0a, 0x04,
+	0x44, 0x41, 0x54, 0x41, 0x10, 0x04, 0x12, 0x0f, 0x0a, 0x0b, 0x48, 0x41, 0x4c, 0x46, 0x5f, 0x43,
+	0x4c, 0x4f, 0x53, 0x45, 0x44, 0x10, 0x05, 0x12, 0x07, 0x0a, 0x03, 0x41, 0x43, 0x4b, 0x10, 0x06,
+	0x12, 0x08, 0x0a, 0x04, 0x50, 0x49, 0x4e, 0x47, 0x10, 0x07, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x4f,
+	0x4e, 0x47, 0x10, 0x08, 0x12, 0x09, 0x0a, 0x05, 0x48, 0x45, 0x4c, 0x4c, 0x4f, 0x10, 0x09, 0x12,
+	0x0b, 0x0a, 0x07, 0x55, 0x50, 0x47, 0x52, 0x41, 0x44, 0x45, 0x10, 0x0a, 0x22, 0x2d, 0x0a, 0x06,
+	0x4f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x12, 0x10, 0x0a, 0x0c, 0x4f, 0x52, 0x49, 0x47, 0x49, 0x4e,
+	0x5f, 0x4c, 0x4f, 0x43, 0x41, 0x4c, 0x10, 0x00, 0x12, 0x11, 0x0a, 0x0d, 0x4f, 0x52, 0x49, 0x47,
+	0x49, 0x4e, 0x5f, 0x52, 0x45, 0x4d, 0x4f, 0x54, 0x45, 0x10, 0x01, 0x42, 0x0d, 0x5a, 0x0b, 0x70,
+	0x6b, 0x67, 0x2f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x33,
 }
 
 var (
@@ -0,0 +1,92 @@
+// Package sshtunnel runs the portal tunnel over SSH with golang.org/x/crypto/ssh, so that an
+// existing SSH trust between the two sides can be used instead of opening a tunnel port.
+//
+// There are two ways to establish the tunnel over an SSH connection:
+//   - DialCommand runs a command on the SSH server that serves the tunnel on its stdin and stdout,
+//     e.g. the stdio-tunnel example with -stdio. This works with any SSH server, e.g. OpenSSH.
+//   - DialChannel opens a channel of ChannelType, which a server built with golang.org/x/crypto/ssh
+//     accepts with AcceptChannel. Use it when the other side is a Go program that embeds the SSH server.
+//
+// Either side of the tunnel can be the SSH client. The SSH client and server are authenticated by
+// SSH itself, set up with ssh.ClientConfig and ssh.ServerConfig: public keys are preferred, as
+// the key of an existing account or an authorized_keys entry restricted to the tunnel command.
+// A password works too but has to be stored on the dialing side. Always verify the host key with
+// HostKeyCallback, e.g. with knownhosts, rather than ssh.InsecureIgnoreHostKey.
+package sshtunnel
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/oatcode/portal"
+	"golang.org/x/crypto/ssh"
+)
+
+// ChannelType is the SSH channel type of the tunnel for DialChannel and AcceptChannel
+const ChannelType = "portal-tunnel@oatcode"
+
+// ErrNotTunnelChannel is returned by AcceptChannel for a channel of another type. The channel is rejected
+var ErrNotTunnelChannel = errors.New("not a tunnel channel")
+
+// DialCommand starts the command on the SSH server and returns a Framer over its stdin and stdout.
+// The command must serve the tunnel on them, e.g. with portal.NewStreamFramer(os.Stdin, os.Stdout),
+// and log to stderr, which is discarded. Closing the Framer closes the SSH session
+func DialCommand(client *ssh.Client, command string) (portal.Framer, error) {
+	s, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.Start(command); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("start tunnel command: %w", err)
+	}
+	return &commandFramer{StreamFramer: portal.NewStreamFramer(r, w), s: s}, nil
+}
+
+// commandFramer closes the SSH session with the Framer
+type commandFramer struct {
+	*portal.StreamFramer
+	s *ssh.Session
+}
+
+func (c *commandFramer) Close(err error) error {
+	ferr := c.StreamFramer.Close(err)
+	c.s.Close()
+	return ferr
+}
+
+// DialChannel opens a channel of ChannelType on the SSH connection and returns a Framer over it.
+// Closing the Framer closes the channel
+func DialChannel(conn ssh.Conn) (portal.Framer, error) {
+	ch, reqs, err := conn.OpenChannel(ChannelType, nil)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return portal.NewStreamFramer(ch, ch), nil
+}
+
+// AcceptChannel accepts a new channel of ChannelType, e.g. from the channels of ssh.NewServerConn,
+// and returns a Framer over it. A channel of another type is rejected with ErrNotTunnelChannel
+func AcceptChannel(nc ssh.NewChannel) (portal.Framer, error) {
+	if nc.ChannelType() != ChannelType {
+		nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+		return nil, ErrNotTunnelChannel
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return portal.NewStreamFramer(ch, ch), nil
+}
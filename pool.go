@@ -0,0 +1,128 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DestinationPool is for keeping connections to destinations dialed ahead, so that a new session
+// to a recently used destination does not wait for the dial.
+//
+// A pooled connection is always a fresh one that no session has used. A connection is never
+// reused after its session ends, as the destination sees the end of the session only as the
+// connection closing. After a session connects to a destination, the pool dials in the background
+// until it has MaxIdlePerHost idle connections to it.
+//
+// A connection that the destination sent data on or closed while idle is discarded before use,
+// so the pool only helps protocols where the client speaks first, e.g. TLS.
+// Idle connections are not closed when Serve ends, but after IdleTimeout
+type DestinationPool struct {
+	// MaxIdlePerHost is the number of idle connections to keep for each destination address
+	MaxIdlePerHost int
+
+	// IdleTimeout closes a connection idle for that long. Defaults to 30 seconds
+	IdleTimeout time.Duration
+}
+
+const defaultPoolIdleTimeout = 30 * time.Second
+
+// pool holds the idle connections of a Tunnel by destination address
+type pool struct {
+	mu      sync.Mutex
+	idle    map[string][]*idleConn
+	dialing map[string]int
+}
+
+type idleConn struct {
+	c     net.Conn
+	timer *time.Timer
+}
+
+// get returns a usable idle connection to the address, or nil if there is none
+func (p *pool) get(address string, logf func(string, ...interface{})) net.Conn {
+	for {
+		p.mu.Lock()
+		cs := p.idle[address]
+		if len(cs) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		// Most recently dialed first
+		ic := cs[len(cs)-1]
+		p.idle[address] = cs[:len(cs)-1]
+		p.mu.Unlock()
+		if !ic.timer.Stop() {
+			// Expired and being closed
+			continue
+		}
+		if idleConnUsable(ic.c) {
+			return ic.c
+		}
+		logf("pool discarded connection. conn=%s", connString(ic.c, address))
+		ic.c.Close()
+	}
+}
+
+// fill dials connections to the address until there are opts.MaxIdlePerHost idle or being dialed
+func (p *pool) fill(ctx context.Context, address string, opts *DestinationPool, dial func(ctx context.Context) (net.Conn, error), logf func(string, ...interface{})) {
+	timeout := opts.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultPoolIdleTimeout
+	}
+	p.mu.Lock()
+	if p.idle == nil {
+		p.idle = make(map[string][]*idleConn)
+		p.dialing = make(map[string]int)
+	}
+	n := opts.MaxIdlePerHost - len(p.idle[address]) - p.dialing[address]
+	if n > 0 {
+		p.dialing[address] += n
+	}
+	p.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		go func() {
+			c, err := dial(ctx)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.dialing[address]--
+			if err != nil {
+				logf("pool connect error. sa=%s err=%v", address, err)
+				return
+			}
+			ic := &idleConn{c: c}
+			ic.timer = time.AfterFunc(timeout, func() { p.remove(address, ic) })
+			p.idle[address] = append(p.idle[address], ic)
+		}()
+	}
+}
+
+// remove closes an expired idle connection
+func (p *pool) remove(address string, ic *idleConn) {
+	p.mu.Lock()
+	cs := p.idle[address]
+	for i := range cs {
+		if cs[i] == ic {
+			p.idle[address] = append(cs[:i], cs[i+1:]...)
+			break
+		}
+	}
+	if len(p.idle[address]) == 0 {
+		delete(p.idle, address)
+	}
+	p.mu.Unlock()
+	ic.c.Close()
+}
+
+// idleConnUsable checks that nothing arrived on an idle connection, neither data nor close
+func idleConnUsable(c net.Conn) bool {
+	var b [1]byte
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := c.Read(b[:])
+	c.SetReadDeadline(time.Time{})
+	var ne net.Error
+	return n == 0 && errors.As(err, &ne) && ne.Timeout()
+}
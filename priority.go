@@ -0,0 +1,122 @@
+package portal
+
+import (
+	"context"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// Lanes of the messages to the other side with SessionPriority
+const (
+	laneHigh = iota
+	laneNormal
+	laneLow
+)
+
+// laneSchedule is the order the tunnelWriter takes the lanes in when all have messages waiting,
+// so that high, normal and low get 4, 2 and 1 of every 7 messages.
+// A lane with nothing waiting is skipped, so its share goes to the others
+var laneSchedule = [...]int{laneHigh, laneNormal, laneHigh, laneLow, laneHigh, laneNormal, laneHigh}
+
+// lanes are the channels of the data of sessions, besides the channel to the other side for all
+// other messages. Data of sessions with a priority other than 0 goes in high or low, and with
+// OutputBuffer the data of the others goes in normal, so that only the other messages are buffered.
+// The channels are unbuffered like the channel to the other side without OutputBuffer, so the data
+// of a session is taken by the tunnelWriter before its proxyReader sends the last message through
+// the mapper
+type lanes struct {
+	high   chan *message.Message
+	normal chan *message.Message
+	low    chan *message.Message
+}
+
+func (tn *Tunnel) newLanes() *lanes {
+	if tn.SessionPriority == nil && tn.outputBuffer() == 0 {
+		return nil
+	}
+	l := &lanes{}
+	if tn.SessionPriority != nil {
+		l.high = make(chan *message.Message)
+		l.low = make(chan *message.Message)
+	}
+	if tn.outputBuffer() > 0 {
+		l.normal = make(chan *message.Message)
+	}
+	return l
+}
+
+// of returns the lane of the data of a session to the address, or nil for the channel to the other side
+func (l *lanes) of(tn *Tunnel, address string) chan<- *message.Message {
+	if l == nil {
+		return nil
+	}
+	if tn.SessionPriority != nil {
+		p := tn.SessionPriority(address)
+		if p > 0 {
+			return l.high
+		} else if p < 0 {
+			return l.low
+		}
+	}
+	return l.normal
+}
+
+// scheduler takes the messages for the tunnelWriter from the lanes by laneSchedule.
+// With a separate channel for the data of the normal lane, the other messages on the channel
+// to the other side are taken first
+type scheduler struct {
+	och <-chan *message.Message
+	chs [3]<-chan *message.Message
+	pos int
+}
+
+func newScheduler(och <-chan *message.Message, l *lanes) *scheduler {
+	s := &scheduler{}
+	s.chs[laneNormal] = och
+	if l != nil {
+		s.chs[laneHigh] = l.high
+		s.chs[laneLow] = l.low
+		if l.normal != nil {
+			s.och = och
+			s.chs[laneNormal] = l.normal
+		}
+	}
+	return s
+}
+
+// next returns the next message to write. It returns false when the channel to the other side
+// is closed or ctx is done
+func (s *scheduler) next(ctx context.Context) (*message.Message, bool) {
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	// The messages sent before the data of a session, e.g. its connect response, are taken
+	// before the data, as the data is sent after them
+	select {
+	case co, ok := <-s.och:
+		return co, ok
+	default:
+	}
+	for i := range laneSchedule {
+		lane := laneSchedule[(s.pos+i)%len(laneSchedule)]
+		select {
+		case co, ok := <-s.chs[lane]:
+			s.pos = (s.pos + i + 1) % len(laneSchedule)
+			return co, ok
+		default:
+		}
+	}
+	// Nothing waiting. Take whichever comes first
+	select {
+	case co, ok := <-s.och:
+		return co, ok
+	case co, ok := <-s.chs[laneHigh]:
+		return co, ok
+	case co, ok := <-s.chs[laneNormal]:
+		return co, ok
+	case co, ok := <-s.chs[laneLow]:
+		return co, ok
+	case <-ctx.Done():
+		return nil, false
+	}
+}
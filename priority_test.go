@@ -0,0 +1,60 @@
+package portal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// fill returns a channel with n messages of id waiting
+func fill(n int, id int32) chan *message.Message {
+	ch := make(chan *message.Message, n)
+	for i := 0; i < n; i++ {
+		ch <- &message.Message{Type: message.Message_DATA, Id: id}
+	}
+	return ch
+}
+
+// TestSchedulerShares takes messages with all lanes full, which must come 4, 2 and 1 of every 7
+// from the high, normal and low lanes
+func TestSchedulerShares(t *testing.T) {
+	l := &lanes{high: fill(100, laneHigh), normal: fill(100, laneNormal), low: fill(100, laneLow)}
+	s := newScheduler(make(chan *message.Message), l)
+	var got [3]int
+	for i := 0; i < 7*10; i++ {
+		co, ok := s.next(context.Background())
+		if !ok {
+			t.Fatal("no message")
+		}
+		got[co.Id]++
+	}
+	if got != [3]int{40, 20, 10} {
+		t.Fatalf("got %v messages of high, normal and low", got)
+	}
+}
+
+// TestSchedulerNotStarved checks that the data of a high priority session is taken right away
+// while a bulk session has data waiting all the time, and the control messages before both
+func TestSchedulerNotStarved(t *testing.T) {
+	och := make(chan *message.Message, 1)
+	l := &lanes{high: make(chan *message.Message, 1), normal: fill(100, laneNormal)}
+	s := newScheduler(och, l)
+	for i := 0; i < 10; i++ {
+		s.next(context.Background())
+	}
+	och <- &message.Message{Type: message.Message_DISCONNECTED}
+	l.high <- &message.Message{Type: message.Message_DATA, Id: laneHigh}
+	if co, _ := s.next(context.Background()); co.Type != message.Message_DISCONNECTED {
+		t.Fatalf("got %v before the control message", co.Type)
+	}
+	for i := 0; ; i++ {
+		co, _ := s.next(context.Background())
+		if co.Id == laneHigh {
+			break
+		}
+		if i == 1 {
+			t.Fatal("high priority data behind bulk data")
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package portal
+
+import (
+	"net"
+	"time"
+)
+
+// Profile is a set of defaults for the buffering options of a Tunnel, for a kind of workload
+type Profile int
+
+const (
+	// ProfileNone uses the default of each option as documented on it
+	ProfileNone Profile = iota
+
+	// ProfileLowLatency is for interactive sessions, e.g. SSH or remote desktop:
+	// 2KB reads, no connect response coalescing, Nagle off, and a 64KB window
+	ProfileLowLatency
+
+	// ProfileBalanced is for a mix of interactive and bulk sessions:
+	// 16KB reads, no connect response coalescing, Nagle off, and a 256KB window
+	ProfileBalanced
+
+	// ProfileHighThroughput is for bulk transfers, e.g. backups or file sync:
+	// 64KB reads, 10ms connect response coalescing, Nagle on, and a 1MB window
+	ProfileHighThroughput
+)
+
+// profileDefaults are the options set by a Profile
+type profileDefaults struct {
+	readBufferSize          int
+	coalesceConnectResponse time.Duration
+	nagle                   bool
+	windowSize              int
+}
+
+var profiles = map[Profile]profileDefaults{
+	ProfileNone:           {readBufferSize: bufferSize},
+	ProfileLowLatency:     {readBufferSize: 2 * 1024, windowSize: 64 * 1024},
+	ProfileBalanced:       {readBufferSize: 16 * 1024, windowSize: 256 * 1024},
+	ProfileHighThroughput: {readBufferSize: 64 * 1024, coalesceConnectResponse: 10 * time.Millisecond, nagle: true, windowSize: 1024 * 1024},
+}
+
+func (p Profile) String() string {
+	switch p {
+	case ProfileNone:
+		return "none"
+	case ProfileLowLatency:
+		return "low latency"
+	case ProfileBalanced:
+		return "balanced"
+	case ProfileHighThroughput:
+		return "high throughput"
+	}
+	return "unknown"
+}
+
+func (tn *Tunnel) profile() profileDefaults {
+	if p, ok := profiles[tn.Profile]; ok {
+		return p
+	}
+	return profiles[ProfileNone]
+}
+
+// readBufferSize returns ReadBufferSize, or the default of the profile
+func (tn *Tunnel) readBufferSize() int {
+	if tn.ReadBufferSize > 0 {
+		return tn.ReadBufferSize
+	}
+	return tn.profile().readBufferSize
+}
+
+// coalesceConnectResponse returns CoalesceConnectResponse, or the default of the profile if zero.
+// Negative is no coalescing
+func (tn *Tunnel) coalesceConnectResponse() time.Duration {
+	if tn.CoalesceConnectResponse != 0 {
+		return tn.CoalesceConnectResponse
+	}
+	return tn.profile().coalesceConnectResponse
+}
+
+// setNagle enables Nagle's algorithm on a TCP connection dialed to a destination with Nagle or the profile
+func (tn *Tunnel) setNagle(c net.Conn) {
+	if !tn.Nagle && !tn.profile().nagle {
+		return
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(false)
+	}
+}
@@ -0,0 +1,49 @@
+package portal
+
+import (
+	"testing"
+	"time"
+)
+
+// TestProfileDefaults checks the options each profile sets, and that the options set on the
+// Tunnel override them
+func TestProfileDefaults(t *testing.T) {
+	tests := []struct {
+		name       string
+		tn         *Tunnel
+		readBuffer int
+		coalesce   time.Duration
+		nagle      bool
+		window     int
+	}{
+		{name: "none", tn: &Tunnel{}, readBuffer: bufferSize},
+		{name: "low latency", tn: &Tunnel{Profile: ProfileLowLatency}, readBuffer: 2 * 1024, window: 64 * 1024},
+		{name: "balanced", tn: &Tunnel{Profile: ProfileBalanced}, readBuffer: 16 * 1024, window: 256 * 1024},
+		{name: "high throughput", tn: &Tunnel{Profile: ProfileHighThroughput}, readBuffer: 64 * 1024, coalesce: 10 * time.Millisecond, nagle: true, window: 1024 * 1024},
+		{name: "unknown", tn: &Tunnel{Profile: Profile(100)}, readBuffer: bufferSize},
+		{
+			name: "overridden",
+			tn: &Tunnel{Profile: ProfileHighThroughput, ReadBufferSize: 4096, CoalesceConnectResponse: -1,
+				WindowSize: -1},
+			readBuffer: 4096, coalesce: -1, nagle: true,
+		},
+		{name: "nagle", tn: &Tunnel{Profile: ProfileLowLatency, Nagle: true}, readBuffer: 2 * 1024, nagle: true, window: 64 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tn := tt.tn
+			if got := tn.readBufferSize(); got != tt.readBuffer {
+				t.Errorf("got read buffer %d, want %d", got, tt.readBuffer)
+			}
+			if got := tn.coalesceConnectResponse(); got != tt.coalesce {
+				t.Errorf("got coalescing %v, want %v", got, tt.coalesce)
+			}
+			if got := tn.Nagle || tn.profile().nagle; got != tt.nagle {
+				t.Errorf("got Nagle %v, want %v", got, tt.nagle)
+			}
+			if got := tn.windowSize(); got != tt.window {
+				t.Errorf("got window %d, want %d", got, tt.window)
+			}
+		})
+	}
+}
@@ -3,13 +3,17 @@ package portal
 
 import (
 	"context"
-	fmt "fmt"
+	"errors"
+	"fmt"
 	"io"
-	"math"
 	"net"
-	"strings"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oatcode/portal/pkg/message"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -28,19 +32,46 @@ Generate protobuf file with:
 
 Appreviations used in code:
 ich = tunnel input channel
-och = tunnel output channel
+och = tunnel output channel, for data and control, or only control with OutputBuffer
 coch = connect operation channel for processing HTTP CONNECT
 pch = proxy writer channel
+cch = control channel for last messages of proxy connectors and readers to the mapper
 co = command
 
+A session is removed when its proxy-reader has sent the last message (sent)
+and the last message from the other side is received (received)
+
 The close sequence for sides s1 and s2
-s1 proxy-reader: read error. send disconnect to tunnel
-s2 mapper: recv disconnect. remove mapping. send to proxy-writer
+s1 proxy-reader: read error. send disconnect to mapper
+s1 mapper: mark sent. send disconnect to tunnel
+s2 mapper: recv disconnect. mark received. send to proxy-writer
 s2 proxy-writer: recv disconnect. close socket.
-s2 proxy-reader: read error (as writer closed it). send disconnect to tunnel
-s1 mapper: recv disconnect. remove mapping. send to proxy-writer
+s2 proxy-reader: read error (as writer closed it). send disconnect to mapper
+s2 mapper: sent and received. remove mapping. send disconnect to tunnel
+s1 mapper: recv disconnect. sent and received. remove mapping. send to proxy-writer
 s1 proxy-writer: recv disconnect. close socket
 
+The half close sequence when s1 reads EOF first
+s1 proxy-reader: read EOF. send half-closed to mapper
+s1 mapper: mark sent. send half-closed to tunnel
+s2 mapper: recv half-closed. mark received. send to proxy-writer
+s2 proxy-writer: recv half-closed. close write side of socket. s2 to s1 data still flows
+s2 proxy-reader: read EOF. send half-closed to mapper
+s2 mapper: sent and received. remove mapping. send half-closed to tunnel
+s1 mapper: recv half-closed. sent and received. remove mapping. send to proxy-writer
+s1 proxy-writer: recv half-closed. close write side of socket. close socket as channel closed
+Without HalfClose in the features of both sides, s1 mapper sends disconnect instead of
+half-closed, and the close sequence follows
+
+The simultaneous close sequence when both proxy-readers fail at once
+s1, s2 proxy-reader: read error. send disconnect to mapper
+s1, s2 mapper: mark sent. send disconnect to tunnel
+s1, s2 mapper: recv disconnect. sent and received. remove mapping. send to proxy-writer
+s1, s2 proxy-writer: recv disconnect. close socket
+Each side sends exactly one last message and removes the session on the other's, so both
+converge whatever the order. Only acknowledgements sent by a proxy-writer may arrive after
+the session is removed. They are dropped quietly
+
 Flow
 C  = Client
 PL = Proxy Listener
@@ -67,6 +98,7 @@ PW = Proxy Writer
 Note
 - Proxy can also run on tunnel client side or both
 - HTTP Connector on remote side will return 503 for any connection error
+- Message types unknown to the mapper, i.e. from a newer version, are logged once and ignored
 */
 
 // ConnectOperation is for handling HTTP CONNECT request
@@ -77,15 +109,49 @@ type ConnectOperation struct {
 
 	// Address section from the HTTP CONNECT line
 	Address string
+
+	// Result is for connections that are not from HTTP CONNECT, e.g. created programmatically.
+	// When set, the HTTP response is not written to Conn. Instead, nil is sent to Result when
+	// connected, or an error if the connection fails. The connection is closed on failure.
+	// It must be a buffered channel, as sending to it does not block
+	Result chan<- error
+
+	// ProxyAuthorization is the Proxy-Authorization header of the HTTP CONNECT request,
+	// sent to the other side with ForwardProxyAuth
+	ProxyAuthorization string
+
+	// Datagram makes a session of datagrams, e.g. for DNS or QUIC: each Read of Conn returns one
+	// datagram and each Write sends one, like a connected UDP socket, and the other side dials
+	// the address with UDP. Datagrams are delivered whole, or not at all if the destination cannot
+	// take them. No HTTP response is written to Conn, so use Result for the connect result.
+	// It is refused with ErrServiceUnavailable if the other side cannot carry datagrams, see
+	// Features.Datagram. As UDP has no close, use IdleTimeout to end the sessions. See UDPForwarder
+	Datagram bool
 }
 
+var (
+	// ErrServiceUnavailable is the connect result when the other side cannot connect to the address.
+	// With ReportConnectErrors on the other side, the result wraps it with the reason
+	ErrServiceUnavailable = errors.New("service unavailable")
+
+	// ErrTunnelClosed is the connect result when the tunnel ends before the connection is connected
+	ErrTunnelClosed = errors.New("tunnel closed")
+
+	// ErrSessionRateLimited is the connect result when the session is refused by
+	// MaxNewSessionsPerSecond on either side. It is also ErrServiceUnavailable for errors.Is
+	ErrSessionRateLimited = fmt.Errorf("%w: session rate exceeded", ErrServiceUnavailable)
+)
+
 // Framer is for reading and writing messages with boundaries (i.e. frame)
+// Messages are expected in the order they are written, without loss, e.g. over TCP or websocket.
+// See Tunnel.ReorderBuffer for a Framer that may reorder them
 type Framer interface {
 	// Read reads a message from the connection
 	// The returned byte array is of the exact length of the message
 	Read() (b []byte, err error)
 
 	// Write writes the entire byte array as a message to the connection
+	// The byte array is not changed after Write returns, so it may be retained
 	Write(b []byte) error
 
 	// Close closes the connection
@@ -93,20 +159,494 @@ type Framer interface {
 	Close(err error) error
 }
 
+// MaxMessageSizer is an optional interface for a Framer that limits the size of its messages.
+// DATA messages that would exceed the limit are split into multiple messages before writing.
+// A Framer not implementing it is assumed to have no limit
+type MaxMessageSizer interface {
+	// MaxMessageSize returns the maximum length in bytes of a message to write
+	MaxMessageSize() int
+}
+
+// Tunnel holds the options for serving a tunnel connection.
+// The zero value serves a tunnel with default options.
+// A Tunnel may serve several tunnel connections at the same time, each with its own sessions and
+// handshake. Stats adds them up, and the methods about the current connection, e.g. Features,
+// are about the one started last
+type Tunnel struct {
+	// ReadTimeout is the maximum duration for each read from a proxied connection.
+	// The deadline is set on the socket before every read, so it is reset on each successful read.
+	// The session is disconnected when it expires. Zero means no timeout.
+	//
+	// This is different from an idle timeout as it only looks at incoming data of the socket.
+	// A session that keeps writing but has nothing to read still times out.
+	// As the deadline is managed here, any deadline set on the connection before handing it
+	// to the tunnel (e.g. cleared after Hijack) is overwritten.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum duration for each write to a proxied connection, e.g. when its
+	// client stops reading. The deadline is set on the socket before every write. The session is
+	// disconnected when it expires, instead of the write blocking it. Zero means no timeout
+	WriteTimeout time.Duration
+
+	// Profile sets the defaults of ReadBufferSize, CoalesceConnectResponse, Nagle and WindowSize for
+	// a kind of workload, see the Profile constants for the values. Each option set explicitly
+	// overrides the profile. The zero value ProfileNone uses the default of each option
+	Profile Profile
+
+	// PerSessionBytesPerSec limits the rate of the data read from each proxied connection, so one
+	// transfer cannot starve the others. The data of a read is sent right away, and the next read
+	// waits until the session is back under the rate, with up to one second worth in a burst.
+	// Zero for no limit
+	PerSessionBytesPerSec int
+
+	// IdleTimeout disconnects a session with CloseIdleTimeout when no data is read from or written
+	// to its connection for this long, e.g. a client that opens a CONNECT and never uses or closes
+	// it. It is checked a few times per timeout, so a session may last up to a quarter longer.
+	// Sessions still connecting are not timed out. Zero for no timeout
+	IdleTimeout time.Duration
+
+	// Compression compresses the DATA sent to the other side, e.g. for a slow link with compressible
+	// traffic like HTTP or JSON. Each message is compressed on its own, and is sent as it is if it
+	// does not get smaller. It is only used when the other side can decompress, see
+	// Features.Compression, so an older version gets the data uncompressed. DATA that cannot be
+	// decompressed closes the tunnel connection with ErrCompression. Serve returns an error for an
+	// unknown value. CompressionNone by default
+	Compression Compression
+
+	// CompressionThreshold is the smallest DATA compressed with Compression, as compressing
+	// small messages saves little for its overhead. Zero for 256 bytes
+	CompressionThreshold int
+
+	// ReadBufferSize is the size of each read from a proxied connection, and so the most data of a
+	// DATA message before splitting for the Framer. Larger reads mean fewer messages for bulk data.
+	// Zero uses the profile, or 2KB without one. Serve returns an error if it is negative
+	ReadBufferSize int
+
+	// Nagle enables Nagle's algorithm on the destination connections dialed on this side, which
+	// delays small writes to fill TCP segments. Go disables it by default. It is also enabled by
+	// ProfileHighThroughput
+	Nagle bool
+
+	// ReportConnectErrors sends the reason a session from the other side failed to connect, e.g.
+	// connection refused or destination not allowed, with its service unavailable. The other side
+	// writes it in the body of the 503 response, and adds it to the ErrServiceUnavailable result,
+	// so the client can tell why without the logs of this side. The reason may tell about the
+	// network of this side, e.g. the addresses of RewriteDestination, so only set it for trusted clients
+	ReportConnectErrors bool
+
+	// KeepAlivePeriod is the TCP keep-alive period of the destination connections dialed on this
+	// side, as in net.Dialer, so that a destination gone without closing ends its session.
+	// This is not the keepalive of the tunnel connection, see KeepaliveInterval.
+	// Zero for the default of net.Dialer, 15 seconds, and negative to disable
+	KeepAlivePeriod time.Duration
+
+	// RewriteDestination maps the address requested by the other side to the address connected to,
+	// e.g. an external host name to an internal address, or a fixed port. It is called first, and
+	// AllowDestination, BlockPrivateMetadata, AuthorizeSession and DestinationPool all see the
+	// rewritten address. The session is refused with service unavailable if it returns an error.
+	// It is called for each session before connecting, not from the mapper. nil connects as requested
+	RewriteDestination func(address string) (string, error)
+
+	// DryRun runs the checks of the sessions from the other side, i.e. RewriteDestination,
+	// AllowDestination, AuthorizeSession, the quota, and resolving the address with
+	// BlockPrivateMetadata, without connecting, to validate a policy before enabling it.
+	// Every session is refused with service unavailable. The decisions are logged and passed to
+	// OnDryRun. The limits checked before a session is created, e.g. MaxSessions, still apply
+	DryRun bool
+
+	// OnDryRun is called with the decision of each session from the other side with DryRun.
+	// It is called for each session, not from the mapper
+	OnDryRun func(DryRunDecision)
+
+	// AllowDestination is called with the address requested by the other side before connecting to it.
+	// The connection is refused with service unavailable if it returns false. nil allows all addresses.
+	// See AllowAddresses for allowing host:port patterns, e.g. *.internal:443.
+	// Use SetAllowDestination to change it while the tunnel is serving
+	AllowDestination func(address string) bool
+
+	// PeerIdentity is the identity of the other side for AuthorizeSession,
+	// e.g. from its TLS client certificate with TLSPeerIdentity. Set it for each tunnel connection
+	PeerIdentity string
+
+	// AuthorizeSession is called with PeerIdentity and the address of every session initiated
+	// by either side. A session initiated on this side is refused with service unavailable before
+	// it is sent to the other side, and one from the other side is refused like AllowDestination.
+	// This gives tunnels of different peers different reachable destinations.
+	// It is called from the mapper for sessions initiated on this side, so it must not block.
+	// nil allows all sessions
+	AuthorizeSession func(peerIdentity, address string) bool
+
+	// WindowSize enables flow control with the receive window in bytes for each session.
+	// The other side pauses reading from its connection once this many bytes of the session are
+	// sent but not yet written to the connection here. This bounds the memory used by a session
+	// with a slow reader, and a slow connection no longer blocks the other sessions.
+	// The other side may go over by one read buffer. The window is sent to the other side when
+	// the session is connected, so the two sides can use different sizes.
+	// Zero uses the profile, which disables flow control without one. Negative disables it with
+	// a profile. Without flow control, the tunnel waits for each write to a connection.
+	// Use SetWindowSize to change it while the tunnel is serving
+	WindowSize int
+
+	// MaxQueuedMessagesPerSession limits the DATA messages of a session sent by the other side but
+	// not yet written to the connection here, on top of the bytes of WindowSize, which bounds the
+	// queue of a session exactly however small the messages are. The other side pauses reading from
+	// its connection at the limit. It needs WindowSize, and is sent to the other side with it, so it
+	// only applies with a version of the other side that knows it. Zero for no limit
+	MaxQueuedMessagesPerSession int
+
+	// BlockPrivateMetadata refuses connections to loopback, link-local and cloud metadata addresses
+	// with service unavailable. It protects the hosts on this side from clients on the other side.
+	// The check is on the resolved IP address being dialed, so a hostname cannot get around it.
+	// Addresses explicitly allowed by AllowDestination are not blocked. An AllowDestination
+	// returning true for all addresses disables it
+	BlockPrivateMetadata bool
+
+	// BlockedNetworks replaces DefaultBlockedNetworks for BlockPrivateMetadata
+	BlockedNetworks []*net.IPNet
+
+	// The session callbacks below are for different uses, and called at different points of a
+	// session. For each session, those set are called in this order:
+	//   - OnSessionOpen when it is added, before it is connected.
+	//   - OnSessionClose when the DISCONNECTED of the other side arrives, whichever side closed
+	//     first, before the session is removed. Not for a session that failed to connect, or
+	//     that ended with half close on both sides or with the tunnel connection.
+	//   - OnSessionClosed when it is removed, only if it connected.
+	//   - OnSessionEnd right after OnSessionClosed, or when it is removed if it failed to connect.
+	// Sessions refused before being added, e.g. by MaxSessions, get none of them. They are called
+	// from the mapper, so they must not block
+
+	// OnSessionClose is called with the reason the other side gave for disconnecting a session,
+	// e.g. to tell a destination that refused the data from one killed by policy. It only has the
+	// address of the session
+	OnSessionClose func(SessionClose)
+
+	// OnSessionClosed is called once for each connected session when it has ended on both sides, or
+	// when the tunnel connection ends, with its bytes and duration, e.g. for billing. Sessions that
+	// failed to connect are not included
+	OnSessionClosed func(SessionStats)
+
+	// OnSessionOpen and OnSessionEnd are called for every session, e.g. for auditing. OnSessionOpen is
+	// called with its id and the address it connects to. local is whether it was initiated on this
+	// side, as each side numbers its sessions, so the same id may be used by both. OnSessionEnd is
+	// called exactly once for each of them, with nil for a normal close, ErrServiceUnavailable or
+	// ErrSessionRateLimited when it failed to connect, ErrTunnelClosed when the tunnel connection
+	// ended, or an error with the reason it was closed with otherwise, e.g. by IdleTimeout
+	OnSessionOpen func(id int32, address string, local bool)
+	OnSessionEnd  func(id int32, local bool, err error)
+
+	// NewIDAllocator creates the IDAllocator of the sessions initiated on this side, once for each
+	// tunnel connection, e.g. for random ids that are easier to tell apart across runs in the logs.
+	// When it has no id left, the session is refused and the tunnel connection is closed with
+	// ErrSessionIDsExhausted, the same as with the default.
+	// An invalid id, negative or in use, refuses the session with service unavailable.
+	// nil for the default, which counts up from 0 and skips the ids in use
+	NewIDAllocator func() IDAllocator
+
+	// MaxTotalBytes is the quota of bytes read from and written to the proxied connections of a
+	// tunnel connection. Once reached, QuotaExceeded returns true and new sessions initiated by
+	// either side are refused with service unavailable. Data in flight may go over it.
+	// Each tunnel connection has its own count, so it restarts when Serve is called again. Zero for no quota
+	MaxTotalBytes int64
+
+	// CloseOnQuota closes the open sessions as well when MaxTotalBytes is reached
+	CloseOnQuota bool
+
+	// CoalesceConnectResponse holds back the 200 response to an HTTP CONNECT for up to this long
+	// after the session is connected, to write it together with the first data from the destination.
+	// This saves a write and possibly a TCP segment for protocols where the server speaks first,
+	// e.g. SMTP or SSH. For protocols where the client speaks first, e.g. TLS, it only adds the
+	// delay, as no data comes before the client gets the response. Zero uses the profile, which
+	// writes it right away without one. Negative writes it right away with a profile
+	CoalesceConnectResponse time.Duration
+
+	// ForwardProxyAuth sends the Proxy-Authorization of the client with each session initiated on
+	// this side, for services on the other side that expect the same credentials. The other side
+	// finds it with ProxyAuthorization in the session context. This sends the client's secret across
+	// the tunnel to whoever serves the other side. It is never logged
+	ForwardProxyAuth bool
+
+	// SessionContext derives the context of a session from the other side, e.g. to add a deadline
+	// or values, from the parent cancelled when the session ends. The context is used for connecting
+	// to the destination, so a deadline bounds the dial. It is called from the mapper,
+	// so it must not block. nil uses the parent as is
+	SessionContext func(parent context.Context, address string) context.Context
+
+	// SpillDir enables spilling the data of a session without flow control to temp files in the
+	// directory, when its connection cannot keep up for a moment. Instead of the tunnel waiting
+	// for the connection, data over 64KB is written to the file and written to the connection
+	// from there in order. It adds the disk latency to spilled data. The file is removed when the
+	// session ends. The data already written is cut from the file as it grows, and once the file
+	// reaches MaxSpillBytes with most of it still to write, the tunnel waits for the connection as
+	// without it. Sessions with WindowSize flow control are not spilled, as the window bounds their data
+	SpillDir string
+
+	// MaxSpillBytes is the limit of the spill file of each session with SpillDir. Defaults to 64MB
+	MaxSpillBytes int64
+
+	// MaxNewSessionsPerSecond limits the rate of new sessions initiated by either side, to protect
+	// destinations from connection storms. Up to NewSessionBurst sessions may come in a burst.
+	// Sessions over it are refused with service unavailable to the other side. The CONNECT client
+	// gets too many requests, with Retry-After telling it when to retry, and the connect result
+	// is ErrSessionRateLimited. Only new sessions are limited, not the data of open ones.
+	// Zero for no limit
+	MaxNewSessionsPerSecond int
+
+	// NewSessionBurst is the most sessions allowed at once by MaxNewSessionsPerSecond after a
+	// quiet period. Defaults to MaxNewSessionsPerSecond, i.e. one second worth
+	NewSessionBurst int
+
+	// ValidateFirstBytes checks the first data read from each destination connected on this side,
+	// e.g. that it looks like a TLS ServerHello or an HTTP response, against misconfigured or
+	// hijacked destinations. The session is closed with ClosePolicy if it returns false.
+	// firstBytes is what the first read returned, which may be only part of the response.
+	// It is called on the read path of the session before the data is sent, so it adds its own
+	// time to the first data, and it must not retain firstBytes. nil sends the data unchecked
+	ValidateFirstBytes func(address string, firstBytes []byte) bool
+
+	// MaxBufferedBytes bounds the data held in memory by the queues of all sessions of the tunnel
+	// connection, with flow control or SpillDir. From three quarters of it, sessions with queued
+	// data stop acknowledging until their queue is written, which pauses their readers on the
+	// other side, and spilled sessions spill all new data to disk. At the limit, the session with
+	// the most queued data is closed with ClosePolicy until the queues are under it.
+	// See Stats.BufferedBytes for the current usage. Zero for no limit
+	MaxBufferedBytes int64
+
+	// SessionPriority gives the data of sessions to an address a priority over others when the tunnel
+	// connection is the bottleneck, e.g. interactive sessions over bulk transfers. Data of sessions
+	// with a positive priority goes in a high lane, zero in the normal lane with the control
+	// messages, and negative in a low lane. With OutputBuffer, the control messages are written
+	// ahead of all lanes instead. When all lanes have data waiting, the tunnel writes
+	// 4, 2 and 1 of every 7 messages from the high, normal and low lanes, so no lane is starved.
+	// A lane with nothing waiting gives its share to the others. The data of a session stays in
+	// order. It is called once for each session on this side, from the mapper, so it must not
+	// block. nil writes the messages in the order they come
+	SessionPriority func(address string) int
+
+	// OutputBuffer is the number of control messages to the other side, e.g. connects, closes and
+	// acknowledgements of sessions, buffered while the tunnel connection is slow, so that a moment
+	// of slowness of the transport does not hold up the mapper and with it all sessions. Data of
+	// sessions is not buffered: their proxyReaders wait for the tunnel connection to take it, which
+	// pauses them like a full window of WindowSize does. Control messages are written ahead of data.
+	// Defaults to 64. Negative for no buffer, writing all messages in the order they come
+	OutputBuffer int
+
+	// MaxSessions limits the sessions open at the same time on the tunnel connection, initiated by
+	// either side. New sessions over it are refused with service unavailable.
+	// Zero for no limit but the ids of the sessions initiated on each side
+	MaxSessions int
+
+	// MaxSessionsPerAddress limits the sessions open at the same time to each address on the tunnel
+	// connection, initiated by either side, so one client cannot overwhelm a destination with
+	// connections. New sessions to an address at the limit are refused with service unavailable,
+	// while other addresses are unaffected. Addresses are compared as requested, before
+	// RewriteDestination, with host names in lower case and IP addresses in any notation.
+	// Zero for no limit
+	MaxSessionsPerAddress int
+
+	// OnCapacityWarning is called when the open sessions reach the high-water mark of MaxSessions,
+	// or of the ids without it, to alert before new sessions are refused. It is called once until
+	// OnCapacityRecovered, which is called when they drop below 90% of the mark again.
+	// Both are called from the mapper, so they must not block
+	OnCapacityWarning   func(active, max int)
+	OnCapacityRecovered func(active, max int)
+
+	// CapacityHighWater is the high-water mark for OnCapacityWarning as a fraction of MaxSessions.
+	// Defaults to 0.8
+	CapacityHighWater float64
+
+	// MaxPendingConnects bounds the sessions from the other side that are still being connected,
+	// i.e. checked and dialed, on this side. Sessions over it are refused with service unavailable
+	// until some of the pending ones connect or fail. This bounds the goroutines and dials a flood
+	// of connects can start. Zero for no limit
+	MaxPendingConnects int
+
+	// DestinationPool keeps connections dialed ahead to the destinations of recent sessions.
+	// nil dials a new connection for every session
+	DestinationPool *DestinationPool
+
+	// ReorderBuffer lets the tunnel work over a Framer that may deliver messages out of order,
+	// e.g. over datagrams. Messages sent are numbered, and up to this many messages received ahead
+	// of a missing one are held until it arrives. The tunnel connection is closed with ErrReorderGap
+	// if the buffer is full or the missing message does not arrive within ReorderTimeout,
+	// so the Framer must still not lose messages. Set it on both sides, as each side reorders
+	// the messages numbered by the other. Zero passes messages in the order they are read
+	ReorderBuffer int
+
+	// ReorderTimeout is how long a missing message is waited for with ReorderBuffer. Defaults to 1 second
+	ReorderTimeout time.Duration
+
+	// TransportIdleTimeout closes the tunnel connection with ErrTransportStalled when no message,
+	// including pings and pongs, is read from it for this long. It catches a stalled transport that
+	// neither delivers nor fails, whatever the Framer. It is raised to KeepaliveInterval plus
+	// KeepaliveTimeout, as the pongs of answered pings keep it from expiring. Without KeepaliveInterval on either
+	// side, an idle tunnel is closed too. Zero for no timeout
+	TransportIdleTimeout time.Duration
+
+	// ShutdownTimeout is how long the tunnel connection is kept open, once the ctx of Serve is done,
+	// to disconnect the sessions with ClosePolicy and write their last messages to the other side,
+	// so that it learns the sessions are gone rather than only seeing the connection drop.
+	// Data already received for a session is delivered to it first. New sessions are refused
+	// meanwhile. Defaults to 5 seconds. Negative closes the connection right away
+	ShutdownTimeout time.Duration
+
+	// DrainTimeout is how long the sessions open at Drain are waited for, before they are
+	// disconnected with ClosePolicy. Zero waits for them without limit
+	DrainTimeout time.Duration
+
+	// WireDebug logs a hex dump of the bytes of every frame read from and written to the Framer,
+	// to debug framing problems, e.g. when bringing up a new Framer. It is extremely verbose and
+	// logs the proxied data as is, so it is for debugging only. The Framer is only wrapped with it set
+	WireDebug bool
+
+	// WireDebugMaxBytes is the most bytes of a frame dumped with WireDebug. Defaults to 256
+	WireDebugMaxBytes int
+
+	// RequireVersion closes the tunnel connection with ErrIncompatibleVersion when the other side
+	// is from before protocol versions, i.e. its first message is not HELLO. Without it, such a side
+	// is served with none of the features, which only works with LegacyCompat, so leave it unset
+	// while older sides are being upgraded. Sides with versions that do not work together are
+	// always refused
+	RequireVersion bool
+
+	// LegacyCompat serves a tunnel connection whose other side may be from before HELLO, such as
+	// the first release of this package. By default each side sends HELLO as its first message,
+	// which breaks the wire protocol for such a side: it takes HELLO for a message of session 0
+	// and hangs. With LegacyCompat, this side sends HELLO only in answer to the HELLO of the other
+	// side, and sends keepalive pings and the acknowledgements of WindowSize only when the other
+	// side announced keepalive and flow control in it, so a side from before HELLO only gets the
+	// messages it knows. A newer side gets the answer and the features are agreed as usual, unless
+	// this side started a session first, in which case neither side uses any. Set it on the side
+	// that must work with both while the other sides are being upgraded. Two sides with it use
+	// none of the features
+	LegacyCompat bool
+
+	// AllowLiveUpgrade lets the features of the tunnel connection be agreed again while it is
+	// serving, with Upgrade, e.g. after SetWindowSize enables flow control, without reconnecting.
+	// Set it on both sides. See Upgrade for which features can change
+	AllowLiveUpgrade bool
+
+	// OnClose is called once with the summary of the tunnel connection when Serve returns
+	OnClose func(Summary)
+
+	// Logf logs the lines of the tunnel instead of the package Logf, e.g. to add the client the
+	// tunnel is for. SessionLogSampling applies to it the same. nil uses the package Logf
+	Logf func(string, ...interface{})
+
+	// Logger takes the log lines of the tunnel as structured events with a level instead of Logf,
+	// e.g. to filter out the sessions or to count the errors. The events have the messages and
+	// fields of the lines, and SessionLogSampling applies to it the same. nil uses Logf
+	Logger Logger
+
+	// KeepaliveInterval is the interval of pings sent to the other side to detect a dead tunnel connection.
+	// The connection is closed with ErrKeepaliveTimeout, which Serve returns, if a ping is not
+	// answered within KeepaliveTimeout. The other side answers pings whether it sends its own or not.
+	// Zero disables pings. Use SetKeepaliveInterval to change it while the tunnel is serving
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout is how long a ping is waited for its pong. Defaults to KeepaliveInterval,
+	// i.e. until the next ping is due
+	KeepaliveTimeout time.Duration
+
+	allowMu          sync.RWMutex
+	dialOnce         sync.Once
+	dialCh           chan ConnectOperation
+	keepaliveMu      sync.Mutex
+	keepaliveChanged chan struct{}
+	pool             pool
+	conns            connections
+	rate             rateLimiter
+	upgradeMu        sync.Mutex
+	upgradeCh        chan struct{}
+	drainMu          sync.Mutex
+	drainCh          chan struct{}
+	draining         bool
+	windowMu         sync.Mutex
+	dumpers          dumpers
+	events           events
+	readFirstByte    latency
+	writeFirstByte   latency
+	counters         counters
+	mapperLatency    histogram
+}
+
+// SetAllowDestination replaces AllowDestination while the tunnel may be serving.
+// Connections checked after it returns use the new function. Established sessions and dials
+// that already passed the check are not affected
+func (tn *Tunnel) SetAllowDestination(fn func(address string) bool) {
+	tn.allowMu.Lock()
+	defer tn.allowMu.Unlock()
+	tn.AllowDestination = fn
+}
+
+// allowDestination returns whether the address is allowed,
+// and whether it is allowed explicitly by AllowDestination rather than by default
+func (tn *Tunnel) allowDestination(address string) (allowed bool, explicit bool) {
+	tn.allowMu.RLock()
+	fn := tn.AllowDestination
+	tn.allowMu.RUnlock()
+	if fn == nil {
+		return true, false
+	}
+	allowed = fn(address)
+	return allowed, allowed
+}
+
 var (
 	// Logf is for setting logging function
 	Logf func(string, ...interface{})
+
+	// SessionLogSampling logs the lifecycle of only 1 in this many sessions, e.g. starts, connects
+	// and ends, to keep high session churn from flooding the log. All lines of a sampled session
+	// are logged. The number of lines left out is logged every 10 seconds with the next session
+	// line. Errors and refusals are never sampled. 0 or 1 logs all sessions
+	SessionLogSampling int
 )
 
 type key int
 
 const (
 	connectKey key = iota
-	bufferSize     = 2048
+	// State of the tunnel connection, see tunnelConn
+	connStateKey
+	// Proxy-Authorization forwarded with a session from the other side
+	proxyAuthorizationKey
 )
 
-func connString(c net.Conn) string {
-	return fmt.Sprintf("%v->%v", c.LocalAddr(), c.RemoteAddr())
+const bufferSize = 2048
+
+// ProxyAuthorization returns the Proxy-Authorization of the client forwarded with ForwardProxyAuth
+// from the context of a session from the other side, e.g. in SessionContext
+func ProxyAuthorization(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(proxyAuthorizationKey).(string)
+	return v, ok
+}
+
+// connString describes the connection by its addresses for logs.
+// label, e.g. the destination address, describes it instead when it has no addresses,
+// like net.Pipe or some wrapped connections
+func connString(c net.Conn, label string) string {
+	l, r := addrString(c.LocalAddr()), addrString(c.RemoteAddr())
+	if l == "" && r == "" {
+		if label == "" {
+			return "unknown"
+		}
+		return label
+	}
+	if l == "" {
+		l = "?"
+	}
+	if r == "" {
+		r = "?"
+	}
+	return l + "->" + r
+}
+
+// addrString returns the address, or empty if it is nil or a placeholder
+func addrString(a net.Addr) string {
+	if a == nil || a.Network() == "pipe" {
+		return ""
+	}
+	return a.String()
 }
 
 func logf(fmt string, v ...interface{}) {
@@ -115,214 +655,1253 @@ func logf(fmt string, v ...interface{}) {
 	}
 }
 
-func proxyWriter(c net.Conn, pch <-chan *message.Message, id int32) {
-	logf("proxyWriter starts. id=%d conn=%s", id, connString(c))
+// logger returns Logf of the tunnel, or the package Logf without one
+func (tn *Tunnel) logger() func(string, ...interface{}) {
+	if tn.Logf != nil {
+		return tn.Logf
+	}
+	return Logf
+}
+
+// logf logs with the logger of the tunnel, at LevelInfo with Logger
+func (tn *Tunnel) logf(fmt string, v ...interface{}) {
+	tn.log(LevelInfo, fmt, v...)
+}
+
+// send sends the message to the channel unless the tunnel has ended.
+// It returns false if the message is not sent
+func send(ctx context.Context, ch chan<- *message.Message, co *message.Message) bool {
+	select {
+	case ch <- co:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// proxyWriter measures the time to the first data from when it starts or, for local initiated
+// connections, from when the connection is connected
+// For local initiated connections, the connect result is written as HTTP response,
+// or sent to the result channel if there is one. The response may be held back to be written
+// with the first data, see CoalesceConnectResponse
+// With flow control, the written bytes are acknowledged to the other side
+func (tn *Tunnel) proxyWriter(ctx context.Context, c net.Conn, och chan<- *message.Message, pch <-chan *message.Message, si *sessionInfo, id int32, origin message.Message_Origin, result chan<- error) {
+	tn.sessionLogf(id, "proxyWriter starts. id=%d conn=%s", id, connString(c, si.address))
+	tc := connOf(ctx)
+	reported := result == nil
+	report := func(err error) {
+		if !reported {
+			select {
+			case result <- err:
+			default:
+			}
+			reported = true
+		}
+	}
 	defer func() {
-		logf("proxyWriter ends. id=%d conn=%s", id, connString(c))
+		tn.sessionLogf(id, "proxyWriter ends. id=%d conn=%s", id, connString(c, si.address))
+		report(ErrTunnelClosed)
 		c.Close()
 	}()
-	for co := range pch {
+	connected := time.Now()
+	first := true
+	acked := 0
+	ackThreshold := si.window / 4
+	if ackThreshold < 1 {
+		ackThreshold = 1
+	}
+	// With MaxQueuedMessagesPerSession, the messages are acknowledged too, so that the other side
+	// does not wait at the limit for the bytes to reach the threshold
+	ackedMessages := 0
+	ackMessageThreshold := si.maxQueued / 4
+	if ackMessageThreshold < 1 {
+		ackMessageThreshold = 1
+	}
+	// write writes to the connection within WriteTimeout. On timeout the connection is closed,
+	// so the proxyReader disconnects the session as it fails to read
+	write := func(b []byte) int {
+		if tn.WriteTimeout > 0 {
+			c.SetWriteDeadline(time.Now().Add(tn.WriteTimeout))
+		}
+		n, err := c.Write(b)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			tn.warnf("proxyWriter write timeout. id=%d conn=%s", id, connString(c, si.address))
+			atomic.StoreInt32(&si.writeTimedOut, 1)
+			c.Close()
+		}
+		return n
+	}
+	// Connect response held back with CoalesceConnectResponse, and the timer to write it alone
+	var held []byte
+	var hold *time.Timer
+	var hch <-chan time.Time
+	flush := func() {
+		if held != nil {
+			write(held)
+			held = nil
+			hold.Stop()
+			hch = nil
+		}
+	}
+	defer flush()
+	// Datagram split for the Framer, until its last part
+	var partial []byte
+	for {
+		var co *message.Message
+		var ok bool
+		select {
+		case co, ok = <-pch:
+		case <-hch:
+			flush()
+			continue
+		}
+		if !ok {
+			return
+		}
+		if co.Type != message.Message_DATA {
+			flush()
+		}
 		if co.Type == message.Message_HTTP_CONNECT_OK {
-			c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-			logf("proxyWriter connected. id=%d conn=%s", id, connString(c))
+			if result != nil {
+				report(nil)
+			} else if d := tn.coalesceConnectResponse(); d > 0 {
+				held = []byte("HTTP/1.1 200 OK\r\n\r\n")
+				hold = time.NewTimer(d)
+				hch = hold.C
+			} else {
+				write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			}
+			connected = time.Now()
+			tn.sessionLogf(id, "proxyWriter connected. id=%d conn=%s", id, connString(c, si.address))
 		} else if co.Type == message.Message_HTTP_SERVICE_UNAVAILABLE {
-			c.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
-			logf("proxyWriter service unavailable. id=%d conn=%s", id, connString(c))
+			if result != nil {
+				report(unavailableError(co))
+			} else if co.RetryAfter > 0 {
+				// Only set when refused by MaxNewSessionsPerSecond
+				write([]byte(fmt.Sprintf("HTTP/1.1 429 Too Many Requests\r\nRetry-After: %d\r\n\r\n", co.RetryAfter)))
+			} else if co.CloseReason != "" {
+				// The reason of the other side with ReportConnectErrors
+				write([]byte(fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s",
+					len(co.CloseReason), co.CloseReason)))
+			} else {
+				write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
+			}
+			tn.logf("proxyWriter service unavailable. id=%d conn=%s reason=%s", id, connString(c, si.address), co.CloseReason)
 			return
 		} else if co.Type == message.Message_DISCONNECTED {
-			logf("proxyWriter disconnected. id=%d conn=%s", id, connString(c))
+			tn.sessionLogf(id, "proxyWriter disconnected. id=%d conn=%s", id, connString(c, si.address))
 			return
+		} else if co.Type == message.Message_HALF_CLOSED {
+			// Other side has no more data. Keep reading from the connection until the channel is closed
+			if cw, ok := c.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+				tn.sessionLogf(id, "proxyWriter half closed. id=%d conn=%s", id, connString(c, si.address))
+			} else {
+				c.Close()
+				tn.sessionLogf(id, "proxyWriter half close unsupported. id=%d conn=%s", id, connString(c, si.address))
+			}
 		} else if co.Type == message.Message_DATA {
-			c.Write(co.Buf)
+			if first {
+				tn.writeFirstByte.add(time.Since(connected))
+				first = false
+			}
+			var n int
+			if si.datagram && co.More {
+				// Rest of the datagram is in the next messages
+				partial = append(partial, co.Buf...)
+			} else if si.datagram && partial != nil {
+				n = write(append(partial, co.Buf...))
+				partial = nil
+			} else if held != nil {
+				// One write for both
+				n = write(append(held, co.Buf...))
+				n -= len(held)
+				if n < 0 {
+					n = 0
+				}
+				held = nil
+				hold.Stop()
+				hch = nil
+			} else {
+				n = write(co.Buf)
+			}
+			tn.counters.add(&tn.counters.bytesWritten, int64(n))
+			atomic.AddInt64(&tc.summary.bytesWritten, int64(n))
+			atomic.AddInt64(&si.written, int64(n))
+			si.touch()
+			tc.quota.add(int64(n), tn.MaxTotalBytes)
+			if si.window > 0 {
+				// Acknowledge in batches. The other side is not blocked as the threshold is less than the window.
+				// Near MaxBufferedBytes, hold them back while the queue of the session still has data,
+				// so the other side pauses until it is written. The last write of the queue acknowledges
+				acked += len(co.Buf)
+				ackedMessages++
+				due := acked >= ackThreshold || (si.maxQueued > 0 && ackedMessages >= ackMessageThreshold)
+				if due && !(atomic.LoadInt64(&si.buffered) > 0 && tn.bufferPressure()) {
+					send(ctx, och, &message.Message{
+						Type:          message.Message_ACK,
+						Origin:        origin,
+						Id:            id,
+						Acked:         int32(acked),
+						AckedMessages: int32(ackedMessages),
+					})
+					acked = 0
+					ackedMessages = 0
+				}
+			}
 		}
 	}
 }
 
 // proxyReader uses the origin to denote if it is handling a local initiated connection or a remote one
-func proxyReader(c net.Conn, och chan<- *message.Message, id int32, origin message.Message_Origin) {
-	logf("proxyReader starts. id=%d conn=%s", id, connString(c))
-	defer logf("proxyReader ends. id=%d conn=%s", id, connString(c))
+// It starts when the connection is connected, so the time to the first data is measured from its start
+// Data is sent to the tunnel. The last message, half-closed on EOF or disconnected on error, goes to the mapper
+// With flow control, it waits for room in the window w before each read
+func (tn *Tunnel) proxyReader(ctx context.Context, c net.Conn, och chan<- *message.Message, cch chan<- *message.Message, w *window, si *sessionInfo, id int32, origin message.Message_Origin) {
+	tn.sessionLogf(id, "proxyReader starts. id=%d conn=%s", id, connString(c, si.address))
+	defer tn.sessionLogf(id, "proxyReader ends. id=%d conn=%s", id, connString(c, si.address))
+	tc := connOf(ctx)
+	connected := time.Now()
+	si.touch()
+	first := true
+	size := tn.readBufferSize()
+	// Datagrams are read into one buffer of the largest size, as a read of less would truncate
+	// them, and copied out at their length, as most are much smaller
+	var dbuf []byte
+	if si.datagram {
+		size = maxDatagramSize
+		dbuf = make([]byte, size)
+	}
+	// Data goes through the lane of the session with SessionPriority
+	dch := och
+	if si.lane != nil {
+		dch = si.lane
+	}
+	var p *pacer
+	if tn.PerSessionBytesPerSec > 0 {
+		p = newPacer(tn.PerSessionBytesPerSec)
+		if size > tn.PerSessionBytesPerSec && !si.datagram {
+			// No read waits for more than a second after it
+			size = tn.PerSessionBytesPerSec
+		}
+	}
 	for {
-		buf := make([]byte, bufferSize)
+		if w != nil && !w.wait(ctx) {
+			return
+		}
+		buf := dbuf
+		if buf == nil {
+			buf = make([]byte, size)
+		}
+		if tn.ReadTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(tn.ReadTimeout))
+		}
 		len, err := c.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				logf("proxyReader local disconnected. id=%d conn=%s", id, connString(c))
-			} else if strings.Contains(err.Error(), "use of closed network connection") {
-				logf("proxyReader remote disconnected. id=%d conn=%s", id, connString(c))
-			} else {
-				logf("proxyReader read error. id=%d conn=%s err=%v", id, connString(c), err)
+		if err == io.EOF {
+			tn.sessionLogf(id, "proxyReader local half closed. id=%d conn=%s", id, connString(c, si.address))
+			co := &message.Message{
+				Type:   message.Message_HALF_CLOSED,
+				Origin: origin,
+				Id:     id,
 			}
-
+			send(ctx, cch, co)
+			return
+		}
+		if err != nil {
 			co := &message.Message{
 				Type:   message.Message_DISCONNECTED,
 				Origin: origin,
 				Id:     id,
 			}
-			och <- co
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				tn.warnf("proxyReader read timeout. id=%d conn=%s", id, connString(c, si.address))
+				co.CloseCode = int32(CloseReadTimeout)
+			} else if errors.Is(err, net.ErrClosed) && atomic.LoadInt32(&si.writeTimedOut) != 0 {
+				// Closed by the proxyWriter
+				co.CloseCode = int32(CloseWriteTimeout)
+			} else if errors.Is(err, net.ErrClosed) {
+				tn.sessionLogf(id, "proxyReader remote disconnected. id=%d conn=%s", id, connString(c, si.address))
+			} else {
+				tn.errorf("proxyReader read error. id=%d conn=%s err=%v", id, connString(c, si.address), err)
+				co.CloseCode = int32(CloseReadError)
+				co.CloseReason = err.Error()
+			}
+
+			send(ctx, cch, co)
 			return
 		}
 
+		if first {
+			tn.readFirstByte.add(time.Since(connected))
+			first = false
+			if origin == message.Message_ORIGIN_REMOTE && tn.ValidateFirstBytes != nil && !tn.ValidateFirstBytes(si.address, buf[:len]) {
+				tn.warnf("proxyReader unexpected first bytes. id=%d conn=%s", id, connString(c, si.address))
+				c.Close()
+				send(ctx, cch, &message.Message{
+					Type:        message.Message_DISCONNECTED,
+					Origin:      origin,
+					Id:          id,
+					CloseCode:   int32(ClosePolicy),
+					CloseReason: "unexpected data from destination",
+				})
+				return
+			}
+		}
+		if w != nil {
+			w.use(len)
+		}
+		tn.counters.add(&tn.counters.bytesRead, int64(len))
+		atomic.AddInt64(&tc.summary.bytesRead, int64(len))
+		atomic.AddInt64(&si.read, int64(len))
+		si.touch()
+		tc.quota.add(int64(len), tn.MaxTotalBytes)
+		data := buf[0:len]
+		if dbuf != nil {
+			data = append([]byte(nil), data...)
+		}
 		co := &message.Message{
 			Type:   message.Message_DATA,
 			Origin: origin,
 			Id:     id,
-			Buf:    buf[0:len],
+			Buf:    data,
+		}
+		if !send(ctx, dch, co) {
+			return
+		}
+		if p != nil && !p.take(ctx, len) {
+			return
 		}
-		och <- co
 	}
 }
 
-func proxyConnector(sa string, och chan<- *message.Message, pch <-chan *message.Message, id int32) {
-	logf("proxyConnector connecting. id=%d sa=%s", id, sa)
-	c, err := net.Dial("tcp", sa)
-	if err != nil {
+// proxyConnector reports a failed connection to the mapper through cch instead of the tunnel,
+// so that the mapper can remove the session before the failure is forwarded to the other side
+// The dial uses the session context sctx, so it is aborted when the session or the tunnel ends.
+// Messages are sent with the tunnel context, so the mapper always gets the result
+func (tn *Tunnel) proxyConnector(ctx context.Context, sctx context.Context, sa string, och chan<- *message.Message, cch chan<- *message.Message, pch <-chan *message.Message, w *window, si *sessionInfo, id int32) {
+	d := DryRunDecision{Address: sa}
+	// report logs the decision with DryRun and passes it to OnDryRun
+	report := func(reason string) {
+		if !tn.DryRun {
+			return
+		}
+		d.Destination, d.Allowed, d.Reason = sa, reason == "", reason
+		tn.logf("proxyConnector dry run. id=%d sa=%s to=%s allowed=%v reason=%s", id, d.Address, d.Destination, d.Allowed, d.Reason)
+		if tn.OnDryRun != nil {
+			tn.OnDryRun(d)
+		}
+	}
+	// unavailable reports the failed connect to the mapper, with the reason for ReportConnectErrors
+	unavailable := func(reason string) {
 		co := &message.Message{
 			Type: message.Message_HTTP_SERVICE_UNAVAILABLE,
 			Id:   id,
 		}
-		och <- co
-		logf("proxyConnector connect error. id=%d sa=%s err=%v", id, sa, err)
+		if tn.ReportConnectErrors {
+			co.CloseReason = reason
+		}
+		send(ctx, cch, co)
+	}
+	if tn.RewriteDestination != nil {
+		rewritten, err := tn.RewriteDestination(sa)
+		if err != nil {
+			report("rewrite error: " + err.Error())
+			unavailable("rewrite error: " + err.Error())
+			tn.warnf("proxyConnector destination rejected. id=%d sa=%s err=%v", id, sa, err)
+			return
+		}
+		if rewritten != sa {
+			tn.sessionLogf(id, "proxyConnector destination rewritten. id=%d sa=%s to=%s", id, sa, rewritten)
+			sa = rewritten
+		}
+	}
+	allowed, explicit := tn.allowDestination(sa)
+	if !allowed {
+		report("destination not allowed")
+		unavailable("destination not allowed")
+		tn.warnf("proxyConnector destination not allowed. id=%d sa=%s", id, sa)
 		return
 	}
-	logf("proxyConnector connected. id=%d conn=%s", id, connString(c))
-
-	go proxyWriter(c, pch, id)
-	go proxyReader(c, och, id, message.Message_ORIGIN_REMOTE)
+	if tn.AuthorizeSession != nil && !tn.AuthorizeSession(tn.PeerIdentity, sa) {
+		report("session not authorized")
+		unavailable("session not authorized")
+		tn.warnf("proxyConnector session not authorized. id=%d peer=%s sa=%s", id, tn.PeerIdentity, sa)
+		return
+	}
+	if connOf(ctx).quota.isExceeded() {
+		report("quota exceeded")
+		unavailable("quota exceeded")
+		tn.warnf("proxyConnector quota exceeded. id=%d sa=%s", id, sa)
+		return
+	}
+	if tn.DryRun {
+		// Resolve without connecting, and refuse whatever the decision
+		ips, err := tn.resolve(sctx, sa, tn.BlockPrivateMetadata && !explicit)
+		d.Resolved = ips
+		if err != nil {
+			report(err.Error())
+		} else {
+			report("")
+		}
+		unavailable("dry run")
+		return
+	}
+	tn.sessionLogf(id, "proxyConnector connecting. id=%d sa=%s", id, sa)
+	dialer := net.Dialer{KeepAlive: tn.KeepAlivePeriod}
+	if tn.BlockPrivateMetadata && !explicit {
+		dialer.Control = tn.blockControl
+	}
+	network := "tcp"
+	if si.datagram {
+		network = "udp"
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		c, err := dialer.DialContext(ctx, network, sa)
+		if err == nil {
+			tn.setNagle(c)
+		}
+		return c, err
+	}
+	var c net.Conn
+	var err error
+	po := tn.DestinationPool
+	if si.datagram {
+		// Not for pooling. A UDP socket has nothing to set up ahead
+		po = nil
+	}
+	if po != nil && po.MaxIdlePerHost > 0 {
+		c = tn.pool.get(sa, tn.logf)
+	}
+	if c == nil {
+		c, err = dial(sctx)
+	}
+	if err != nil {
+		tn.emitSession(eventConnectFail, id, false, si, err.Error())
+		unavailable(err.Error())
+		if errors.Is(err, errBlockedAddress) {
+			tn.warnf("proxyConnector destination blocked. id=%d sa=%s err=%v", id, sa, err)
+		} else {
+			tn.errorf("proxyConnector connect error. id=%d sa=%s err=%v", id, sa, err)
+		}
+		return
+	}
+	tn.sessionLogf(id, "proxyConnector connected. id=%d conn=%s", id, connString(c, si.address))
+	si.setConn(c)
+	tn.counters.add(&tn.counters.connects, 1)
+	atomic.AddInt64(&connOf(ctx).summary.sessions, 1)
+	tn.emitSession(eventSessionOpen, id, false, si, "")
+	if po != nil && po.MaxIdlePerHost > 0 {
+		tn.pool.fill(ctx, sa, po, dial, tn.errorf)
+	}
 
+	// Send connected before starting proxyReader so that no data goes ahead of it
 	co := &message.Message{
-		Type: message.Message_HTTP_CONNECT_OK,
-		Id:   id,
+		Type:      message.Message_HTTP_CONNECT_OK,
+		Id:        id,
+		Window:    int32(si.window),
+		MaxQueued: int32(si.maxQueued),
+	}
+	if !send(ctx, och, co) {
+		tn.logf("proxyConnector tunnel ended. id=%d conn=%s", id, connString(c, si.address))
+		c.Close()
+		return
+	}
+
+	tn.spawn(func() { tn.proxyWriter(ctx, c, och, pch, si, id, message.Message_ORIGIN_REMOTE, nil) })
+	tn.spawn(func() { tn.proxyReader(ctx, c, och, cch, w, si, id, message.Message_ORIGIN_REMOTE) })
+}
+
+// session is the mapper's state of a proxy connection
+type session struct {
+	pch     chan<- *message.Message
+	created time.Time
+	// Shared with the proxyReader and proxyWriter
+	info *sessionInfo
+	// Reason of closing the session on this side, sent with the last message of the proxyReader
+	closeCode   CloseCode
+	closeReason string
+	// Flow control of data sent to the other side. nil without flow control
+	window *window
+	// Normalized address the session is counted to for MaxSessionsPerAddress. Empty if not counted
+	addressKey string
+	// Cancels the session context of a session from the other side. nil for sessions from this side
+	cancel context.CancelFunc
+	// Closed by MaxBufferedBytes
+	shed bool
+	// Reason of closing the session given by the other side, for LogEventsJSON
+	remoteReason string
+	// Last message sent by proxyReader
+	sent bool
+	// Last message received from the other side
+	received bool
+	// pch is closed
+	closed bool
+}
+
+func (s *session) close() {
+	if !s.closed {
+		close(s.pch)
+		s.closed = true
+	}
+	if s.window != nil {
+		// Let proxyReader find out the connection is closed
+		s.window.close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// reason describes why the session ended, by this side or the other, for LogEventsJSON
+func (s *session) reason() string {
+	if s.closeReason != "" {
+		return s.closeReason
+	}
+	return s.remoteReason
+}
+
+// unavailableError returns the connect result of HTTP_SERVICE_UNAVAILABLE from the other side,
+// with the reason it gave
+func unavailableError(co *message.Message) error {
+	err := ErrServiceUnavailable
+	if co.RetryAfter > 0 {
+		err = ErrSessionRateLimited
+	}
+	if co.CloseReason != "" {
+		return fmt.Errorf("%w: %s", err, co.CloseReason)
+	}
+	return err
+}
+
+// refuse responds to a connection initiated on this side with service unavailable without a session.
+// retryAfter is the seconds for the client to wait before retrying, or 0
+func (tn *Tunnel) refuse(ctx context.Context, co ConnectOperation, och chan<- *message.Message, retryAfter int32) {
+	tn.counters.add(&tn.counters.connectErrors, 1)
+	tn.emit(event{Type: eventConnectFail, Origin: "local", Address: co.Address, Reason: "refused"})
+	rch := make(chan *message.Message, 1)
+	rch <- &message.Message{Type: message.Message_HTTP_SERVICE_UNAVAILABLE, RetryAfter: retryAfter}
+	close(rch)
+	tn.spawn(func() {
+		tn.proxyWriter(ctx, co.Conn, och, rch, &sessionInfo{address: co.Address}, -1, message.Message_ORIGIN_LOCAL, co.Result)
+	})
+}
+
+// newSession creates a session with the channel for its proxyWriter.
+// With flow control, the proxyWriter reads from a queue so that the mapper does not wait for it.
+// Without it, the queue spills to disk with SpillDir
+func (tn *Tunnel) newSession(ctx context.Context, address string, ln *lanes) (*session, <-chan *message.Message) {
+	pch := make(chan *message.Message)
+	s := &session{pch: pch, created: time.Now(), info: &sessionInfo{address: address, window: tn.sessionWindow(connOf(ctx).handshake.get()), lane: ln.of(tn, address)}}
+	if s.info.window > 0 && tn.MaxQueuedMessagesPerSession > 0 {
+		s.info.maxQueued = tn.MaxQueuedMessagesPerSession
+	}
+	b := &bufferAccount{tn: tn, si: s.info}
+	if s.info.window > 0 {
+		qch := make(chan *message.Message)
+		tn.spawn(func() { queue(ctx, pch, qch, b) })
+		return s, qch
+	}
+	if tn.SpillDir != "" {
+		max := tn.MaxSpillBytes
+		if max <= 0 {
+			max = defaultMaxSpillBytes
+		}
+		qch := make(chan *message.Message)
+		tn.spawn(func() { spillQueue(ctx, pch, qch, tn.SpillDir, max, b, tn.errorf) })
+		return s, qch
 	}
-	och <- co
+	return s, pch
 }
 
 // Requires 2 maps to differenciate local and remote originated connections
-//   lm is local channel map
-//   rm is remote channel map
+//   lm is local session map
+//   rm is remote session map
 // Connection map is only used until connection is connected
 //   lcm is local connection map
-func mapper(ich <-chan *message.Message, coch <-chan ConnectOperation, och chan<- *message.Message) {
-	logf("mapper starts")
-	defer logf("mapper ends")
+// The mapper is the only sender to the proxy writer channels. It is also the only one closing them.
+// A channel is never sent to after it is closed.
+// A session is removed after both sides have sent their last messages (half-closed or disconnected),
+// so neither side uses the id afterwards and it is safe to reuse.
+// Sending stops once ctx is done, so the mapper never blocks after the tunnel ends.
+// It answers pings and passes pongs to keepalive with kch.
+// It waits for the pending proxyConnectors before returning
+//
+// All session control and data of a tunnel go through this one goroutine, which bounds the
+// throughput of a tunnel. The time to handle each message is in Stats as MapperP99Latency.
+// Use multiple tunnels for more parallelism
+func (tn *Tunnel) mapper(ctx context.Context, ich <-chan *message.Message, coch <-chan ConnectOperation, och chan<- *message.Message, ln *lanes, sch <-chan struct{}, drained chan<- struct{}, kch chan<- struct{}, dch <-chan chan<- string) {
+	tn.logf("mapper starts")
+	defer tn.logf("mapper ends")
+	tc := connOf(ctx)
 
-	var id int32
-	lm := make(map[int32]chan<- *message.Message)
-	rm := make(map[int32]chan<- *message.Message)
+	var ids IDAllocator = &sequentialIDs{}
+	if tn.NewIDAllocator != nil {
+		ids = tn.NewIDAllocator()
+	}
+	var wg sync.WaitGroup
+	lm := make(map[int32]*session)
+	rm := make(map[int32]*session)
 	lcm := make(map[int32]net.Conn)
+	// Open sessions by normalized address, with MaxSessionsPerAddress
+	perAddress := make(map[string]int)
+	// atAddressLimit tells whether a new session to the address would be over MaxSessionsPerAddress
+	atAddressLimit := func(address string) bool {
+		return tn.MaxSessionsPerAddress > 0 && perAddress[normalizeAddress(address)] >= tn.MaxSessionsPerAddress
+	}
+	// count and uncount track the session to its address while it is in lm or rm
+	count := func(s *session) {
+		if tn.MaxSessionsPerAddress > 0 {
+			s.addressKey = normalizeAddress(s.info.address)
+			perAddress[s.addressKey]++
+		}
+	}
+	uncount := func(s *session) {
+		if s.addressKey == "" {
+			return
+		}
+		if perAddress[s.addressKey] <= 1 {
+			delete(perAddress, s.addressKey)
+		} else {
+			perAddress[s.addressKey]--
+		}
+	}
+	cch := make(chan *message.Message)
+	// Unknown message types already logged
+	unknownTypes := make(map[message.Message_Type]bool)
+	// Number of sessions counted in the active sessions stats
+	active := 0
+	// Open sessions reached the high-water mark for OnCapacityWarning
+	warned := false
+	// Shutdown requested with sch. New sessions are refused
+	shuttingDown := false
+	// The tunnelWriter is to be told once the last messages of all sessions are sent
+	flushPending := false
+	// Drain called. New sessions are refused, and drained is closed once the sessions end
+	draining := false
+	// Number of proxyConnectors not yet returned. Decremented by them
+	var pending int64
 	defer func() {
 		// Channel closed. Clear connections
-		for _, ch := range lm {
-			close(ch)
+		tn.counters.add(&tn.counters.activeSessions, int64(-active))
+		for id, s := range lm {
+			if _, ok := lcm[id]; ok {
+				tn.emitSession(eventConnectFail, id, true, s.info, "tunnel closed")
+				tn.sessionEnd(id, true, ErrTunnelClosed)
+			} else {
+				tn.sessionClosed(id, true, s, ErrTunnelClosed)
+			}
+			s.close()
 		}
-		for _, ch := range rm {
-			close(ch)
+		for id, s := range rm {
+			if s.info.connected() {
+				// The proxyConnector of the others emits their failure
+				tn.sessionClosed(id, false, s, ErrTunnelClosed)
+			} else {
+				tn.sessionEnd(id, false, ErrTunnelClosed)
+			}
+			s.close()
 		}
+		wg.Wait()
 	}()
 
+	// First message from the other side received
+	hello := false
+	// This side sent a message before the first one from the other side, which then took this side
+	// for one from before HELLO. Only with LegacyCompat, as this side sends HELLO first otherwise
+	spoke := false
+
+	// connect starts a session initiated on this side, from coch or Dial.
+	// It returns false if the mapper cannot go on
+	connect := func(co ConnectOperation) bool {
+		if co.Datagram && co.Result == nil {
+			// Never write an HTTP response as a datagram
+			co.Result = make(chan error, 1)
+		}
+		if co.Datagram && !tc.handshake.get().Datagram {
+			tn.warnf("mapper datagrams unsupported by the other side. sa=%s", co.Address)
+			tn.refuse(ctx, co, och, 0)
+			return true
+		}
+		if tn.AuthorizeSession != nil && !tn.AuthorizeSession(tn.PeerIdentity, co.Address) {
+			tn.warnf("mapper session not authorized. peer=%s sa=%s", tn.PeerIdentity, co.Address)
+			tn.refuse(ctx, co, och, 0)
+			return true
+		}
+		if tc.quota.isExceeded() {
+			tn.warnf("mapper quota exceeded. sa=%s", co.Address)
+			tn.refuse(ctx, co, och, 0)
+			return true
+		}
+		if ok, wait := tn.allowNewSession(); !ok {
+			tn.warnf("mapper session rate exceeded. sa=%s", co.Address)
+			tn.refuse(ctx, co, och, retryAfterSeconds(wait))
+			return true
+		}
+		if tn.MaxSessions > 0 && len(lm)+len(rm) >= tn.MaxSessions {
+			tn.warnf("mapper too many sessions. sa=%s", co.Address)
+			tn.refuse(ctx, co, och, 0)
+			return true
+		}
+		if atAddressLimit(co.Address) {
+			tn.warnf("mapper too many sessions to address. sa=%s", co.Address)
+			tn.refuse(ctx, co, och, 0)
+			return true
+		}
+		if shuttingDown || draining {
+			tn.logf("mapper shutting down or draining. sa=%s", co.Address)
+			tn.refuse(ctx, co, och, 0)
+			return true
+		}
+		inUse := func(id int32) bool {
+			_, used := lm[id]
+			return used
+		}
+		id, ok := ids.Next(inUse)
+		if !ok {
+			tn.warnf("Too many connections")
+			tn.refuse(ctx, co, och, 0)
+			return false
+		}
+		if id < 0 || inUse(id) {
+			tn.errorf("mapper invalid id from IDAllocator. id=%d sa=%s", id, co.Address)
+			tn.refuse(ctx, co, och, 0)
+			return true
+		}
+		// New connection from local
+		lcm[id] = co.Conn
+		s, pch := tn.newSession(ctx, co.Address, ln)
+		s.info.datagram = co.Datagram
+		lm[id] = s
+		count(s)
+		tn.sessionOpen(id, true, co.Address)
+		s.info.setConn(co.Conn)
+		tn.spawn(func() { tn.proxyWriter(ctx, co.Conn, och, pch, s.info, id, message.Message_ORIGIN_LOCAL, co.Result) })
+
+		m := &message.Message{
+			Type:          message.Message_HTTP_CONNECT,
+			Id:            id,
+			SocketAddress: co.Address,
+			Window:        int32(s.info.window),
+			MaxQueued:     int32(s.info.maxQueued),
+			Datagram:      co.Datagram,
+		}
+		if tn.ForwardProxyAuth {
+			m.ProxyAuthorization = co.ProxyAuthorization
+		}
+		if !hello && tn.LegacyCompat {
+			// Before anything from the other side. Without LegacyCompat, both sides send HELLO first
+			spoke = true
+		}
+		send(ctx, och, m)
+		return true
+	}
+
+	// Start of handling the current message
+	var start time.Time
+	var idleTick <-chan time.Time
+	if tn.IdleTimeout > 0 {
+		t := time.NewTicker(tn.IdleTimeout / idleChecks)
+		defer t.Stop()
+		idleTick = t.C
+	}
+	qch := tc.quota.done()
+	dials := tn.dials()
+	local := tn.localFeatures()
+	if !tn.LegacyCompat {
+		send(ctx, och, helloMessage(local))
+	}
+	uch := tn.upgrades()
+	drch := tn.drains()
+	var dtch <-chan time.Time
 	for {
+		if !start.IsZero() {
+			tn.mapperLatency.add(time.Since(start))
+		}
+		if n := len(lm) + len(rm); n != active {
+			tn.counters.add(&tn.counters.activeSessions, int64(n-active))
+			tc.summary.active(int64(n))
+			active = n
+			tn.checkCapacity(n, &warned)
+		}
+		if draining && drained != nil && len(lm)+len(rm) == 0 {
+			tn.logf("mapper drained")
+			flushPending = true
+			close(drained)
+			drained = nil
+		}
+		if flushPending && allSent(lm, rm) {
+			// nil marks the end of the last messages for the tunnelWriter
+			send(ctx, och, nil)
+			flushPending = false
+		}
 		select {
+		case <-ctx.Done():
+			// The tunnel is closed. The sessions are closed without waiting for ich to be closed
+			return
 		case i, ok := <-ich:
 			if !ok {
 				return
 			}
+			start = time.Now()
 			// From remote
-			if i.Type == message.Message_HTTP_CONNECT {
+			first := !hello
+			if first {
+				hello = true
+				if i.Type != message.Message_HELLO || spoke {
+					// From before HELLO, or it got a message from this side before the answer
+					tc.handshake.receive(nil, local)
+				} else {
+					if tn.LegacyCompat {
+						// Answer, as the other side is known to understand HELLO now
+						send(ctx, och, helloMessage(local))
+					}
+					tc.handshake.receive(i, local)
+				}
+			}
+			if i.Type == message.Message_HELLO {
+				tn.logf("mapper hello. features=%d version=%d", i.Features, i.Version)
+				if !first && tn.AllowLiveUpgrade {
+					// Answer to UPGRADE
+					tc.handshake.upgrade(i, local)
+				}
+			} else if i.Type == message.Message_UPGRADE {
+				if !tn.AllowLiveUpgrade {
+					tn.warnf("mapper upgrade not allowed. features=%d", i.Features)
+					continue
+				}
+				tn.logf("mapper upgrade. features=%d", i.Features)
+				local = tn.upgradeFeatures(local)
+				tc.handshake.upgrade(i, local)
+				send(ctx, och, helloMessage(local))
+			} else if i.Type == message.Message_PING {
+				send(ctx, och, &message.Message{Type: message.Message_PONG})
+			} else if i.Type == message.Message_PONG {
+				select {
+				case kch <- struct{}{}:
+				default:
+				}
+			} else if i.Type == message.Message_HTTP_CONNECT {
 				// Remote initiated
-				pch := make(chan *message.Message)
-				rm[i.Id] = pch
-				go proxyConnector(i.SocketAddress, och, pch, i.Id)
+				if ok, wait := tn.allowNewSession(); !ok {
+					tn.warnf("mapper session rate exceeded. id=%d sa=%s", i.Id, i.SocketAddress)
+					tn.counters.add(&tn.counters.connectErrors, 1)
+					send(ctx, och, &message.Message{
+						Type:       message.Message_HTTP_SERVICE_UNAVAILABLE,
+						Id:         i.Id,
+						RetryAfter: retryAfterSeconds(wait),
+					})
+					continue
+				}
+				if tn.MaxSessions > 0 && len(lm)+len(rm) >= tn.MaxSessions {
+					tn.warnf("mapper too many sessions. id=%d sa=%s", i.Id, i.SocketAddress)
+					tn.counters.add(&tn.counters.connectErrors, 1)
+					send(ctx, och, &message.Message{
+						Type: message.Message_HTTP_SERVICE_UNAVAILABLE,
+						Id:   i.Id,
+					})
+					continue
+				}
+				if atAddressLimit(i.SocketAddress) {
+					tn.warnf("mapper too many sessions to address. id=%d sa=%s", i.Id, i.SocketAddress)
+					tn.counters.add(&tn.counters.connectErrors, 1)
+					send(ctx, och, &message.Message{
+						Type: message.Message_HTTP_SERVICE_UNAVAILABLE,
+						Id:   i.Id,
+					})
+					continue
+				}
+				if shuttingDown || draining {
+					tn.logf("mapper shutting down or draining. id=%d sa=%s", i.Id, i.SocketAddress)
+					send(ctx, och, &message.Message{
+						Type: message.Message_HTTP_SERVICE_UNAVAILABLE,
+						Id:   i.Id,
+					})
+					continue
+				}
+				if tn.MaxPendingConnects > 0 && atomic.LoadInt64(&pending) >= int64(tn.MaxPendingConnects) {
+					tn.warnf("mapper too many pending connects. id=%d sa=%s", i.Id, i.SocketAddress)
+					tn.counters.add(&tn.counters.connectErrors, 1)
+					send(ctx, och, &message.Message{
+						Type: message.Message_HTTP_SERVICE_UNAVAILABLE,
+						Id:   i.Id,
+					})
+					continue
+				}
+				s, pch := tn.newSession(ctx, i.SocketAddress, ln)
+				s.info.datagram = i.Datagram
+				if i.Window > 0 {
+					s.window = newWindow(int(i.Window), int(i.MaxQueued))
+				}
+				var sctx context.Context
+				sctx, s.cancel = context.WithCancel(ctx)
+				if i.ProxyAuthorization != "" {
+					sctx = context.WithValue(sctx, proxyAuthorizationKey, i.ProxyAuthorization)
+				}
+				if tn.SessionContext != nil {
+					sctx = tn.SessionContext(sctx, i.SocketAddress)
+				}
+				rm[i.Id] = s
+				count(s)
+				tn.sessionOpen(i.Id, false, i.SocketAddress)
+				atomic.AddInt64(&pending, 1)
+				tn.counters.add(&tn.counters.pendingConnects, 1)
+				wg.Add(1)
+				sa, id := i.SocketAddress, i.Id
+				tn.spawn(func() {
+					defer wg.Done()
+					tn.proxyConnector(ctx, sctx, sa, och, cch, pch, s.window, s.info, id)
+					atomic.AddInt64(&pending, -1)
+					tn.counters.add(&tn.counters.pendingConnects, -1)
+				})
 			} else if i.Type == message.Message_HTTP_CONNECT_OK {
 				// Local initiated
-				c := lcm[i.Id]
+				c, ok := lcm[i.Id]
+				if !ok {
+					tn.logf("mapper unknown connection. id=%d type=%v", i.Id, i.Type)
+					continue
+				}
 				delete(lcm, i.Id)
-				go proxyReader(c, och, i.Id, message.Message_ORIGIN_LOCAL)
-				pch := lm[i.Id]
-				pch <- i
+				tn.counters.add(&tn.counters.connects, 1)
+				atomic.AddInt64(&tc.summary.sessions, 1)
+				s := lm[i.Id]
+				tn.emitSession(eventSessionOpen, i.Id, true, s.info, "")
+				if i.Window > 0 {
+					s.window = newWindow(int(i.Window), int(i.MaxQueued))
+				}
+				w, id := s.window, i.Id
+				tn.spawn(func() { tn.proxyReader(ctx, c, och, cch, w, s.info, id, message.Message_ORIGIN_LOCAL) })
+				if !s.closed {
+					send(ctx, s.pch, i)
+				}
 			} else if i.Type == message.Message_HTTP_SERVICE_UNAVAILABLE {
 				// Local initiated
+				s, ok := lm[i.Id]
+				if !ok {
+					tn.logf("mapper unknown connection. id=%d type=%v", i.Id, i.Type)
+					continue
+				}
 				delete(lcm, i.Id)
-				pch := lm[i.Id]
 				delete(lm, i.Id)
-				pch <- i
+				uncount(s)
+				tn.counters.add(&tn.counters.connectErrors, 1)
+				tn.emitSession(eventConnectFail, i.Id, true, s.info, "service unavailable")
+				tn.sessionEnd(i.Id, true, unavailableError(i))
+				if !s.closed {
+					send(ctx, s.pch, i)
+				}
+				s.close()
+			} else if i.Type != message.Message_DATA && i.Type != message.Message_DISCONNECTED &&
+				i.Type != message.Message_HALF_CLOSED && i.Type != message.Message_ACK {
+				// From a newer version of the other side. Ignore it for forward compatibility
+				if !unknownTypes[i.Type] {
+					tn.logf("mapper unknown message type. id=%d type=%v", i.Id, i.Type)
+					unknownTypes[i.Type] = true
+				}
 			} else {
-				var m map[int32]chan<- *message.Message
+				var m map[int32]*session
 				if i.Origin == message.Message_ORIGIN_LOCAL {
 					// Received from other side with local origin. Use remote map
 					m = rm
 				} else {
 					m = lm
 				}
-				pch := m[i.Id]
-				if i.Type == message.Message_DISCONNECTED {
-					delete(m, i.Id)
+				s, ok := m[i.Id]
+				if !ok {
+					// Session already removed. Nothing to deliver to
+					if i.Type != message.Message_ACK {
+						// Acknowledgements may trail the last message of the other side
+						tn.logf("mapper unknown connection. id=%d type=%v", i.Id, i.Type)
+					}
+					continue
+				}
+				if i.Type == message.Message_ACK {
+					if s.window != nil {
+						s.window.release(int(i.Acked), int(i.AckedMessages))
+					}
+					continue
+				}
+				if i.Type == message.Message_DATA {
+					tn.shedBuffered(lm, rm)
+				}
+				if i.Type == message.Message_DISCONNECTED && CloseCode(i.CloseCode) != CloseUnspecified && !s.closed {
+					// The connection on the other side failed. Close this one now instead of after the
+					// data still queued or being written to it, which also keeps a slow write from
+					// blocking the mapper. Unspecified is left in order, as it is also sent after a
+					// close of the proxyWriter on the other side with data still to deliver here
+					tn.sessionLogf(i.Id, "mapper aborting. id=%d conn=%s", i.Id, s.info.address)
+					s.info.abort()
+				}
+				if i.Type == message.Message_DISCONNECTED && s.cancel != nil && !s.info.connected() {
+					// Still connecting, with nothing taking the messages until connected. Cancel the
+					// session context to abort the connect, which the proxyConnector then reports
+					tn.sessionLogf(i.Id, "mapper canceling connect. id=%d sa=%s", i.Id, s.info.address)
+					s.close()
+				}
+				if !s.closed {
+					send(ctx, s.pch, i)
+				}
+				if i.Type == message.Message_DISCONNECTED && tn.OnSessionClose != nil {
+					tn.OnSessionClose(SessionClose{
+						Address: s.info.address,
+						Code:    CloseCode(i.CloseCode),
+						Reason:  i.CloseReason,
+					})
+				}
+				if i.Type == message.Message_DISCONNECTED || i.Type == message.Message_HALF_CLOSED {
+					s.received = true
+					if i.Type == message.Message_DISCONNECTED {
+						// proxyWriter ends on disconnected
+						s.close()
+						s.remoteReason = i.CloseReason
+						if s.remoteReason == "" && CloseCode(i.CloseCode) != CloseUnspecified {
+							s.remoteReason = CloseCode(i.CloseCode).String()
+						}
+					}
+					if s.sent {
+						delete(m, i.Id)
+						uncount(s)
+						s.close()
+						tn.sessionEnded(tc, time.Since(s.created))
+						tn.sessionClosed(i.Id, i.Origin == message.Message_ORIGIN_REMOTE, s, reasonError(s.reason()))
+					}
 				}
-				pch <- i
 			}
-		case co := <-coch:
-			// Find next available id
-			used := true
-			for i := int32(0); i < math.MaxInt32; i++ {
-				if _, used = lm[id+i]; !used {
-					id = id + i
-					break
+		case r := <-dch:
+			r <- dumpSessions(lm, rm, lcm)
+		case <-qch:
+			start = time.Now()
+			qch = nil
+			tn.warnf("mapper quota exceeded")
+			if tn.CloseOnQuota {
+				// Sessions end as the proxyWriters close their connections
+				for _, m := range []map[int32]*session{lm, rm} {
+					for _, s := range m {
+						s.closeCode = ClosePolicy
+						s.closeReason = "quota exceeded"
+						s.close()
+					}
+				}
+			}
+		case now := <-idleTick:
+			start = time.Now()
+			tn.closeIdle(now, tn.IdleTimeout, lm, rm)
+		case <-drch:
+			start = time.Now()
+			drch = nil
+			draining = true
+			tn.logf("mapper draining. sessions=%d", len(lm)+len(rm))
+			var stop func() bool
+			dtch, stop = tn.drainTimer()
+			defer stop()
+		case <-dtch:
+			start = time.Now()
+			dtch = nil
+			tn.warnf("mapper drain timed out. sessions=%d", len(lm)+len(rm))
+			// Sessions end as the proxyWriters close their connections, like on shutdown
+			for _, m := range []map[int32]*session{lm, rm} {
+				for _, s := range m {
+					s.closeCode = ClosePolicy
+					s.closeReason = "tunnel drain timed out"
+					s.close()
+				}
+			}
+		case <-sch:
+			start = time.Now()
+			sch = nil
+			tn.logf("mapper shutting down. sessions=%d", len(lm)+len(rm))
+			shuttingDown = true
+			flushPending = true
+			// Sessions end as the proxyWriters close their connections, and the proxyReaders send
+			// the last messages with the reason
+			for _, m := range []map[int32]*session{lm, rm} {
+				for _, s := range m {
+					s.closeCode = ClosePolicy
+					s.closeReason = "tunnel shutting down"
+					s.close()
 				}
 			}
-			if used {
-				logf("Too many connections")
+		case <-uch:
+			start = time.Now()
+			uch = tn.upgrades()
+			local = tn.upgradeFeatures(local)
+			tn.logf("mapper upgrade requested. features=%d", local)
+			send(ctx, och, &message.Message{Type: message.Message_UPGRADE, Features: local})
+		case co := <-cch:
+			start = time.Now()
+			// From local proxyConnector or proxyReader
+			if co.Type == message.Message_HALF_CLOSED && !tc.handshake.get().HalfClose {
+				// The other side does not know HALF_CLOSED. Disconnect as before half close
+				tn.sessionLogf(co.Id, "mapper half close unsupported by the other side. id=%d", co.Id)
+				co.Type = message.Message_DISCONNECTED
+			}
+			if co.Type == message.Message_HTTP_SERVICE_UNAVAILABLE {
+				// Remote initiated connection failed. Its proxy writer was never started
+				tn.counters.add(&tn.counters.connectErrors, 1)
+				if s, ok := rm[co.Id]; ok {
+					delete(rm, co.Id)
+					uncount(s)
+					s.close()
+					tn.sessionEnd(co.Id, false, ErrServiceUnavailable)
+				}
+			} else {
+				var m map[int32]*session
+				if co.Origin == message.Message_ORIGIN_LOCAL {
+					m = lm
+				} else {
+					m = rm
+				}
+				if s, ok := m[co.Id]; ok {
+					if co.Type == message.Message_DISCONNECTED && s.closeCode != CloseUnspecified {
+						co.CloseCode = int32(s.closeCode)
+						co.CloseReason = s.closeReason
+					} else if co.Type == message.Message_DISCONNECTED && CloseCode(co.CloseCode) != CloseUnspecified {
+						// Why the proxyReader ended, e.g. WriteTimeout, for OnSessionEnd
+						s.closeReason = co.CloseReason
+						if s.closeReason == "" {
+							s.closeReason = CloseCode(co.CloseCode).String()
+						}
+					}
+					s.sent = true
+					if s.received {
+						delete(m, co.Id)
+						uncount(s)
+						s.close()
+						tn.sessionEnded(tc, time.Since(s.created))
+						tn.sessionClosed(co.Id, co.Origin == message.Message_ORIGIN_LOCAL, s, reasonError(s.reason()))
+					}
+				}
+			}
+			send(ctx, och, co)
+		case co := <-coch:
+			start = time.Now()
+			if !connect(co) {
 				return
 			}
-			// New connection from local
-			lcm[id] = co.Conn
-			pch := make(chan *message.Message)
-			lm[id] = pch
-			go proxyWriter(co.Conn, pch, id)
-
-			och <- &message.Message{
-				Type:          message.Message_HTTP_CONNECT,
-				Id:            id,
-				SocketAddress: co.Address,
+		case co := <-dials:
+			start = time.Now()
+			if !connect(co) {
+				return
 			}
-			id++
 		}
 	}
 }
 
+// splitData splits a DATA message into parts that each fit into max bytes when marshalled.
+// All parts but the last are marked with more, so the other side can put a datagram back together.
+// Data of a byte stream is handled like any other DATA messages.
+// Other messages, or when max is not set, are returned as is
+func splitData(co *message.Message, max int) []*message.Message {
+	if max <= 0 || co.Type != message.Message_DATA || proto.Size(co) <= max {
+		return []*message.Message{co}
+	}
+	h := &message.Message{Type: co.Type, Origin: co.Origin, Id: co.Id, More: true}
+	n := max - proto.Size(h) - protowire.SizeTag(5) - protowire.SizeVarint(uint64(max))
+	if n <= 0 {
+		// Limit too small for any data. Let the framer fail on it
+		return []*message.Message{co}
+	}
+	var cos []*message.Message
+	for b := co.Buf; len(b) > 0; {
+		l := len(b)
+		if l > n {
+			l = n
+		}
+		cos = append(cos, &message.Message{
+			Type:   co.Type,
+			Origin: co.Origin,
+			Id:     co.Id,
+			Buf:    b[:l],
+			More:   l < len(b),
+		})
+		b = b[l:]
+	}
+	return cos
+}
+
 // Send data to the other side of the tunnel
-func tunnelWriter(ctx context.Context, c Framer, och <-chan *message.Message) {
-	logf("tunnelWriter starts")
-	defer logf("tunnelWriter ends")
+// A marshal or write error closes the connection with closeConn, so Serve returns it
+func (tn *Tunnel) tunnelWriter(ctx context.Context, c Framer, och <-chan *message.Message, ln *lanes, numbered bool, flushed chan<- struct{}, closeConn func(error) error) {
+	tn.logf("tunnelWriter starts")
+	defer tn.logf("tunnelWriter ends")
+	tc := connOf(ctx)
+	max := 0
+	if s, ok := c.(MaxMessageSizer); ok {
+		max = s.MaxMessageSize()
+	}
+	// Marshal buffer reused for every message to save allocations, if the Framer is done with it
+	// when Write returns
+	reuse := copiesOnWrite(c)
+	var data []byte
+	// Number of the last message written, when numbered for the reordering on the other side
+	var seq uint64
+	s := newScheduler(och, ln)
 	for {
-		select {
-		case co, ok := <-och:
-			if !ok {
-				logf("tunnelWriter channel closed")
-				return
+		co, ok := s.next(ctx)
+		if !ok {
+			if ctx.Err() == nil {
+				tn.logf("tunnelWriter channel closed")
 			}
-			var data []byte
-			data, err := proto.Marshal(co)
+			return
+		}
+		if co == nil {
+			// The messages before it are written. See shutdown and drained
+			if flushed != nil {
+				close(flushed)
+				flushed = nil
+			}
+			continue
+		}
+		for _, co := range splitData(co, max) {
+			tn.compress(co, tc.handshake.get())
+			if numbered {
+				seq++
+				co.Seq = seq
+			}
+			if !reuse {
+				data = nil
+			}
+			var err error
+			data, err = proto.MarshalOptions{}.MarshalAppend(data[:0], co)
 			if err != nil {
-				logf("tunnelWriter marshal error: %v", err)
+				tn.errorf("tunnelWriter marshal error. err=%v", err)
+				closeConn(err)
 				return
 			}
 			if err = c.Write(data); err != nil {
-				logf("tunnelWriter write error: %v", err)
+				tn.errorf("tunnelWriter write error. err=%v", err)
+				closeConn(err)
 				return
 			}
-		case <-ctx.Done():
-			return
 		}
 	}
 }
 
 // Read commands comming from the other side of the tunnel
-func tunnelReader(c Framer, ich chan<- *message.Message) {
-	logf("tunnelReader starts")
-	defer logf("tunnelReader ends")
+// The first one closes the connection with ErrIncompatibleVersion if the versions do not work together.
+// With r, they are passed in the order they were sent. With idle, the connection is closed
+// when none arrives in time
+// It returns the error that ended the connection
+func (tn *Tunnel) tunnelReader(c Framer, ich chan<- *message.Message, r *reorder, idle *idleTimer) error {
+	tn.logf("tunnelReader starts")
+	defer tn.logf("tunnelReader ends")
+	if r != nil {
+		defer r.stop()
+	}
+	if idle != nil {
+		defer idle.stop()
+	}
 	var err error
 	var buf []byte
+	// The first message from the other side is still to be checked for its version
+	check := true
 	for {
+		if idle != nil {
+			idle.start()
+		}
 		buf, err = c.Read()
+		if idle != nil {
+			idle.stop()
+		}
 		if err != nil {
 			break
 		}
@@ -330,38 +1909,193 @@ func tunnelReader(c Framer, ich chan<- *message.Message) {
 		if err = proto.Unmarshal(buf, co); err != nil {
 			break
 		}
-		ich <- co
+		if err = decompress(co); err != nil {
+			break
+		}
+		cos := []*message.Message{co}
+		if r != nil {
+			var ok bool
+			if cos, ok = r.add(co); !ok {
+				err = ErrReorderGap
+				break
+			}
+		}
+		for _, co := range cos {
+			if check {
+				check = false
+				if err = tn.checkVersion(co); err != nil {
+					break
+				}
+			}
+			ich <- co
+		}
+		if err != nil {
+			break
+		}
 	}
 	if err == io.EOF {
-		logf("tunnelReader disconnected")
+		tn.logf("tunnelReader disconnected")
 	} else {
-		logf("tunnelReader error: %v", err)
+		tn.errorf("tunnelReader error. err=%v", err)
 	}
 	c.Close(err)
+	return err
+}
+
+// serve handles the tunnel messages on channels instead of a Framer.
+// ich has the messages from the other side and och takes the messages to it, so the session
+// handling can be driven directly, e.g. by tests. closeConn ends the tunnel connection on keepalive timeout.
+// It returns when ich is closed or ctx is done, after the pending proxyConnectors end
+func (tn *Tunnel) serve(ctx context.Context, ich <-chan *message.Message, och chan<- *message.Message, ln *lanes, coch <-chan ConnectOperation, sch <-chan struct{}, drained chan<- struct{}, closeConn func(error) error) {
+	if coch == nil {
+		// Create an unused coch for mapper
+		coch = make(<-chan ConnectOperation)
+	}
+	tc, ok := ctx.Value(connStateKey).(*tunnelConn)
+	if !ok {
+		// Driven directly, e.g. by tests
+		tc = &tunnelConn{}
+		ctx = context.WithValue(ctx, connStateKey, tc)
+	}
+	tn.conns.start(tc)
+	defer tc.handshake.end()
+	kch := make(chan struct{}, 1)
+	kctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tn.spawn(func() { tn.keepalive(kctx, closeConn, och, kch) })
+	dch := tn.dumpers.add()
+	defer tn.dumpers.remove(dch)
+	tn.mapper(ctx, ich, coch, och, ln, sch, drained, kch, dch)
 }
 
 // TunnelServe starts the communication with the remote side with tunnel messages connection c.
 // It handles new proxy connections coming into connection channel cch.
-func TunnelServe(ctx context.Context, c Framer, coch <-chan ConnectOperation) {
-	logf("TunnelServe starts")
-	defer logf("TunnelServe ends")
+// It is a shorthand for Serve of a Tunnel with the default options, and behaves the same.
+// Tunnel.Serve is the canonical form, as options are set on the Tunnel. See Serve for the error returned
+func TunnelServe(ctx context.Context, c Framer, coch <-chan ConnectOperation) error {
+	tn := &Tunnel{}
+	return tn.Serve(ctx, c, coch)
+}
 
-	ich := make(chan *message.Message)
-	och := make(chan *message.Message)
+// validate returns the error of an invalid option, which Serve rejects
+func (tn *Tunnel) validate() error {
+	if tn.ReadBufferSize < 0 {
+		return fmt.Errorf("invalid ReadBufferSize %d", tn.ReadBufferSize)
+	}
+	if !tn.Compression.valid() {
+		return fmt.Errorf("invalid Compression %d", tn.Compression)
+	}
+	return nil
+}
 
-	if coch == nil {
-		// Create an unused coch for mapper
-		coch = make(<-chan ConnectOperation)
+// Serve starts the communication with the remote side with tunnel messages connection c.
+// It handles new proxy connections coming into connection channel cch.
+// It returns when the connection is closed. The connection is closed when ctx is done,
+// after disconnecting the sessions within ShutdownTimeout. It may be called again while serving,
+// to serve another connection with the same options.
+// It returns nil when the other side closed the connection, or after Drain. Otherwise it returns why the
+// connection ended, the same as Summary.Err: the read or write error of c, the error the tunnel
+// closed it with, e.g. ErrKeepaliveTimeout, or the error of ctx. Only the first one is returned
+// when several happen together. An invalid option, e.g. a negative ReadBufferSize, closes the
+// connection without serving it and returns the error
+func (tn *Tunnel) Serve(ctx context.Context, c Framer, coch <-chan ConnectOperation) (err error) {
+	tn.logf("TunnelServe starts")
+	defer tn.logf("TunnelServe ends")
+
+	if err := tn.validate(); err != nil {
+		c.Close(err)
+		return err
 	}
 
-	ctx = context.WithValue(ctx, connectKey, c)
+	started := time.Now()
+	tc := &tunnelConn{}
+	if tn.WireDebug {
+		c = newWireDebugFramer(c, tn.WireDebugMaxBytes, tn.debugf)
+	}
+	defer func() {
+		sm := tn.makeSummary(tc, started)
+		e := event{Type: eventTunnelClose, BytesRead: sm.BytesRead, BytesWritten: sm.BytesWritten}
+		if sm.Err != nil {
+			e.Reason = sm.Err.Error()
+		}
+		tn.emit(e)
+		if tn.OnClose != nil {
+			tn.OnClose(sm)
+		}
+		if sm.Err != io.EOF && sm.Err != ErrDrained {
+			err = sm.Err
+		}
+	}()
+	// Records why the connection is closed, for the summary
+	closeConn := func(err error) error {
+		tc.summary.closed(err)
+		return c.Close(err)
+	}
 
-	go mapper(ich, coch, och)
-	go tunnelWriter(ctx, c, och)
+	ich := make(chan *message.Message)
+	// Buffered for control messages only. The data of sessions goes through the lanes then
+	och := make(chan *message.Message, tn.outputBuffer())
+	ln := tn.newLanes()
+	// Shutdown request to the mapper, and the tunnelWriter telling the last messages are written
+	sch := make(chan struct{})
+	flushed := make(chan struct{})
+	// Closed by the mapper when the sessions have ended after Drain
+	drained := make(chan struct{})
+
+	// Cancelled when the connection is closed to stop the goroutines still using the tunnel.
+	// Not by the caller's ctx, so the sessions can be disconnected first
+	tctx := context.WithValue(context.WithValue(ctx, connectKey, c), connStateKey, tc)
+	tctx, cancel := context.WithCancel(detachedContext{tctx})
+
+	// Closes the connection when the caller's ctx is done, after disconnecting the sessions.
+	// Then the mapper closes the remaining session connections and the dials in progress are
+	// aborted right away, without waiting for the tunnelReader to end.
+	// After Drain, it is closed once the sessions have ended
+	stop := make(chan struct{})
+	defer close(stop)
+	go func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			tn.shutdown(sch, flushed, stop)
+			closeConn(ctx.Err())
+			cancel()
+		case <-drained:
+			tn.drained(tc, c, flushed, stop)
+		case <-stop:
+		}
+	}(ctx)
+
+	ctx = tctx
+	done := make(chan struct{})
+
+	tn.spawn(func() {
+		tn.serve(ctx, ich, och, ln, coch, sch, drained, closeConn)
+		if ctx.Err() == nil {
+			// The mapper ended on its own, as there is no session id left
+			closeConn(ErrSessionIDsExhausted)
+		}
+		close(done)
+		// The mapper may end before the tunnelReader. Don't let it block on the messages still read
+		for range ich {
+		}
+	})
+	var r *reorder
+	if tn.ReorderBuffer > 0 {
+		r = newReorder(tn.ReorderBuffer, tn.ReorderTimeout, closeConn, tn.warnf)
+	}
+	var idle *idleTimer
+	if d := tn.transportIdleTimeout(); d > 0 {
+		idle = newIdleTimer(d, closeConn, tn.warnf)
+	}
+	tn.spawn(func() { tn.tunnelWriter(ctx, c, och, ln, r != nil, flushed, closeConn) })
 	// This blocks until connection closed
-	tunnelReader(c, ich)
+	tc.summary.closed(tn.tunnelReader(c, ich, r, idle))
 
+	cancel()
 	close(ich)
-	// Don't close och, as mapper may still use it. Let GC takes care of it.
-	// Don't close coch, as proxyConnect may still use it. Let GC takes care of it.
+	// Wait for mapper, which waits for pending proxyConnectors
+	<-done
+	// Don't close och, as proxyReaders may still use it. Let GC takes care of it.
+	// Don't close coch, as it is owned by the caller.
+	return nil
 }
@@ -0,0 +1,1149 @@
+package portal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oatcode/portal/pkg/message"
+	"google.golang.org/protobuf/proto"
+)
+
+// serveTunnel serves a tunnel connection between a and b over net.Pipe until the test ends.
+// The operations sent to the returned channel connect from the side of a to destinations on the side of b
+func serveTunnel(t testing.TB, a, b *Tunnel) chan ConnectOperation {
+	t.Helper()
+	ca, cb := net.Pipe()
+	return serveFramers(t, a, b, NewConnFramer(ca), NewConnFramer(cb))
+}
+
+// serveFramers is serveTunnel over the two ends fa and fb of a tunnel connection
+func serveFramers(t testing.TB, a, b *Tunnel, fa, fb Framer) chan ConnectOperation {
+	t.Helper()
+	coch := make(chan ConnectOperation)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.Serve(ctx, fa, coch)
+	}()
+	go func() {
+		defer wg.Done()
+		b.Serve(ctx, fb, nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return coch
+}
+
+// dial connects to the address through the tunnel of coch, failing the test on error
+func dial(t testing.TB, coch chan<- ConnectOperation, address string) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialThrough(ctx, coch, address)
+	if err != nil {
+		t.Fatalf("dial %s: %v", address, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// listen starts a TCP destination that serves each connection with serve until the test ends
+func listen(t testing.TB, serve func(c net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// echo writes back what it reads until EOF
+func echo(c net.Conn) {
+	defer c.Close()
+	io.Copy(c, c)
+}
+
+// tcpPair returns the two ends of a TCP connection, which unlike net.Pipe support half close
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+	c := dial(t, coch, listen(t, echo))
+	msg := strings.Repeat("hello ", 10000)
+	go io.WriteString(c, msg)
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != msg {
+		t.Fatal("echo mismatch")
+	}
+}
+
+// proxyClient starts the proxy of the side of coch and returns an HTTP client using it,
+// which reaches backend as example.com through the tunnel
+func proxyClient(t *testing.T, coch chan<- ConnectOperation, backend *httptest.Server, opts HTTPHandlerOptions, user *url.Userinfo) *http.Client {
+	t.Helper()
+	opts.ConnectOperations = coch
+	proxy := httptest.NewServer(NewHTTPHandler(opts))
+	t.Cleanup(proxy.Close)
+	pu, _ := url.Parse(proxy.URL)
+	pu.User = user
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(pu),
+		TLSClientConfig: backend.Client().Transport.(*http.Transport).TLSClientConfig.Clone(),
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+}
+
+// TestConnectHTTPClient fetches from a TLS server reachable only through the tunnel with a real
+// HTTP client, which sends CONNECT to the proxy and expects its 200 before the TLS handshake
+func TestConnectHTTPClient(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer backend.Close()
+	// The client asks for example.com, which only the other side maps to the backend
+	remote := &Tunnel{RewriteDestination: func(address string) (string, error) {
+		if address != "example.com:443" {
+			return "", &net.AddrError{Err: "unexpected destination", Addr: address}
+		}
+		return backend.Listener.Addr().String(), nil
+	}}
+	coch := serveTunnel(t, &Tunnel{}, remote)
+
+	tests := []struct {
+		name   string
+		auth   func(r *http.Request) bool
+		user   *url.Userinfo
+		status int
+	}{
+		{name: "no auth", status: http.StatusOK},
+		{name: "basic auth", auth: BasicAuth("Proxy-Authorization", "user:secret"), user: url.UserPassword("user", "secret"), status: http.StatusOK},
+		{name: "wrong password", auth: BasicAuth("Proxy-Authorization", "user:secret"), user: url.UserPassword("user", "wrong"), status: http.StatusProxyAuthRequired},
+		{name: "no credentials", auth: BasicAuth("Proxy-Authorization", "user:secret"), status: http.StatusProxyAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := proxyClient(t, coch, backend, HTTPHandlerOptions{ProxyAuth: tt.auth}, tt.user)
+			resp, err := client.Get("https://example.com/path")
+			if tt.status != http.StatusOK {
+				// The transport fails the request with the status of the CONNECT
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got %s, want %d", resp.Status, tt.status)
+				}
+				if !strings.Contains(err.Error(), http.StatusText(tt.status)) {
+					t.Fatalf("got %v, want %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != "hello /path" {
+				t.Fatalf("got %s %q", resp.Status, body)
+			}
+		})
+	}
+}
+
+// TestConnectUnavailable checks the 503 of a destination that cannot be connected
+func TestConnectUnavailable(t *testing.T) {
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+	proxy := httptest.NewServer(NewHTTPHandler(HTTPHandlerOptions{ConnectOperations: coch}))
+	defer proxy.Close()
+	c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// A port that nothing listens on
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := l.Addr().String()
+	l.Close()
+	io.WriteString(c, "CONNECT "+address+" HTTP/1.1\r\nHost: "+address+"\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, _ := io.ReadAll(c)
+	if !strings.HasPrefix(string(b), "HTTP/1.1 503 ") {
+		t.Fatalf("got %q", b)
+	}
+}
+
+// TestHalfClose sends a request and closes writing, like a one-shot protocol, and reads the
+// answer the destination only writes after the end of the request
+func TestHalfClose(t *testing.T) {
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+	address := listen(t, func(c net.Conn) {
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		io.WriteString(c, "got "+string(b))
+	})
+	c, s := tcpPair(t)
+	result := make(chan error, 1)
+	coch <- ConnectOperation{Conn: s, Address: address, Result: result}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "request")
+	c.CloseWrite()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "got request" {
+		t.Fatalf("got %q %v", b, err)
+	}
+}
+
+// retainingFramer keeps the byte arrays written to it, as Framer allows
+type retainingFramer struct {
+	writes [][]byte
+}
+
+func (f *retainingFramer) Read() ([]byte, error) { return nil, io.EOF }
+func (f *retainingFramer) Write(b []byte) error {
+	f.writes = append(f.writes, b)
+	return nil
+}
+func (f *retainingFramer) Close(err error) error { return nil }
+
+// writeAll writes the messages with tunnelWriter to c
+func writeAll(tn *Tunnel, c Framer, cos []*message.Message) {
+	och := make(chan *message.Message, len(cos))
+	for _, co := range cos {
+		och <- co
+	}
+	close(och)
+	ctx := context.WithValue(context.Background(), connStateKey, &tunnelConn{})
+	tn.tunnelWriter(ctx, c, och, nil, false, nil, func(error) error { return nil })
+}
+
+// TestTunnelWriterRetain checks that the messages written to a Framer that retains them are not
+// overwritten by the next ones
+func TestTunnelWriterRetain(t *testing.T) {
+	var cos []*message.Message
+	for i := 0; i < 10; i++ {
+		cos = append(cos, &message.Message{Type: message.Message_DATA, Id: int32(i), Buf: []byte(strings.Repeat("x", i))})
+	}
+	f := &retainingFramer{}
+	writeAll(&Tunnel{}, f, cos)
+	if len(f.writes) != len(cos) {
+		t.Fatalf("got %d writes", len(f.writes))
+	}
+	for i, b := range f.writes {
+		co := &message.Message{}
+		if err := proto.Unmarshal(b, co); err != nil || !proto.Equal(co, cos[i]) {
+			t.Fatalf("write %d: got %v %v", i, co, err)
+		}
+	}
+}
+
+// discardFramer drops the byte arrays written to it
+type discardFramer struct{}
+
+func (discardFramer) Read() ([]byte, error) { return nil, io.EOF }
+func (discardFramer) Write(b []byte) error  { return nil }
+func (discardFramer) Close(err error) error { return nil }
+
+// BenchmarkTunnelWriter compares the allocations per message of the framers of this package,
+// whose marshal buffer is reused, with those of any other Framer
+func BenchmarkTunnelWriter(b *testing.B) {
+	ca, cb := net.Pipe()
+	defer ca.Close()
+	go io.Copy(io.Discard, cb)
+	framers := []struct {
+		name string
+		f    Framer
+	}{
+		{name: "ConnFramer", f: NewConnFramer(ca)},
+		{name: "other", f: discardFramer{}},
+	}
+	co := &message.Message{Type: message.Message_DATA, Id: 1, Buf: make([]byte, 1024)}
+	for _, fr := range framers {
+		b.Run(fr.name, func(b *testing.B) {
+			cos := make([]*message.Message, b.N)
+			for i := range cos {
+				cos[i] = co
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			writeAll(&Tunnel{}, fr.f, cos)
+		})
+	}
+}
+
+// forwardClient starts the proxy of the side of coch with ForwardHTTP and returns an HTTP client using it
+func forwardClient(t *testing.T, coch chan<- ConnectOperation, opts HTTPHandlerOptions) *http.Client {
+	t.Helper()
+	opts.ConnectOperations = coch
+	opts.ForwardHTTP = true
+	proxy := httptest.NewServer(NewHTTPHandler(opts))
+	t.Cleanup(proxy.Close)
+	pu, _ := url.Parse(proxy.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(pu)}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+}
+
+// TestForwardStreaming checks that a forwarded response is passed on as it arrives, by reading
+// each chunk before the backend writes the next one
+func TestForwardStreaming(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "chunk\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+	resp, err := forwardClient(t, coch, HTTPHandlerOptions{}).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b := make([]byte, len("chunk\n"))
+	for i := 0; i < 3; i++ {
+		if _, err := io.ReadFull(resp.Body, b); err != nil || string(b) != "chunk\n" {
+			t.Fatalf("chunk %d: got %q %v", i, b, err)
+		}
+		next <- struct{}{}
+	}
+	if rest, err := io.ReadAll(resp.Body); err != nil || len(rest) != 0 {
+		t.Fatalf("got %q %v after the chunks", rest, err)
+	}
+}
+
+// TestForwardIdleConns checks that the connections through the tunnel are reused for the next
+// requests, and closed after ForwardIdleTimeout
+func TestForwardIdleConns(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+	client := forwardClient(t, coch, HTTPHandlerOptions{ForwardIdleTimeout: 50 * time.Millisecond})
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+
+	for i := 0; i < 3; i++ {
+		get()
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("got %d connections for requests one after the other, want 1", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	get()
+	if n := count(); n != 2 {
+		t.Fatalf("got %d connections after the idle timeout, want 2", n)
+	}
+}
+
+// TestConnectCanceled checks that a CONNECT the tunnel does not take, e.g. as it is not being
+// served, is given up when the context of the server is done, freeing the connection
+func TestConnectCanceled(t *testing.T) {
+	// Nothing takes the connect operations
+	coch := make(chan ConnectOperation)
+	h := NewHTTPHandler(HTTPHandlerOptions{ConnectOperations: coch, MaxConnectsPerClient: 1}).(*httpHandler)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy := httptest.NewUnstartedServer(h)
+	proxy.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	proxy.Start()
+	defer proxy.Close()
+
+	c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	active := func() int {
+		h.clients.mu.Lock()
+		defer h.clients.mu.Unlock()
+		return len(h.clients.active)
+	}
+	waitFor(t, "the CONNECT", func() bool { return active() == 1 })
+	cancel()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(c); err != nil || len(b) != 0 {
+		t.Fatalf("got %q %v, want the connection closed", b, err)
+	}
+	waitFor(t, "the client released", func() bool { return active() == 0 })
+}
+
+// TestConnectHalfClose has the destination end its data first, while the client goes on writing,
+// on a CONNECT whose request came with the first data. The hijacked connection is then wrapped
+// for the buffered data and for MaxConnectsPerClient, which must pass on the half close
+func TestConnectHalfClose(t *testing.T) {
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{})
+	got := make(chan string, 1)
+	address := listen(t, func(c net.Conn) {
+		defer c.Close()
+		io.WriteString(c, "hello")
+		c.(*net.TCPConn).CloseWrite()
+		b, _ := io.ReadAll(c)
+		got <- string(b)
+	})
+	proxy := httptest.NewServer(NewHTTPHandler(HTTPHandlerOptions{ConnectOperations: coch, MaxConnectsPerClient: 1}))
+	defer proxy.Close()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.(*net.TCPConn)
+	defer c.Close()
+	io.WriteString(c, "CONNECT "+address+" HTTP/1.1\r\nHost: "+address+"\r\n\r\nearly ")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil || !strings.HasPrefix(string(b), "HTTP/1.1 200 ") || !strings.HasSuffix(string(b), "\r\n\r\nhello") {
+		t.Fatalf("got %q %v", b, err)
+	}
+	io.WriteString(c, "request")
+	c.CloseWrite()
+	select {
+	case s := <-got:
+		if s != "early request" {
+			t.Fatalf("destination got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+// TestSessionCallbacks checks the order of the session callbacks of a session that connects and
+// one that fails to
+func TestSessionCallbacks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	add := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	tn := &Tunnel{
+		OnSessionOpen:   func(id int32, address string, local bool) { add("open") },
+		OnSessionClose:  func(SessionClose) { add("close") },
+		OnSessionClosed: func(SessionStats) { add("closed") },
+		OnSessionEnd: func(id int32, local bool, err error) {
+			if err != nil {
+				add("end " + err.Error())
+			} else {
+				add("end")
+			}
+		},
+	}
+	coch := serveTunnel(t, tn, &Tunnel{})
+	get := func(n int) []string {
+		waitFor(t, "the callbacks", func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(events) >= n
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		e := events
+		events = nil
+		return e
+	}
+
+	// Half closed on both sides, without DISCONNECTED
+	c := dial(t, coch, listen(t, echo))
+	c.Close()
+	if e := strings.Join(get(3), ","); e != "open,closed,end" {
+		t.Fatalf("got %s", e)
+	}
+
+	// Reset by the destination after the first byte, which disconnects
+	c = dial(t, coch, listen(t, func(c net.Conn) {
+		c.Read(make([]byte, 1))
+		c.(*net.TCPConn).SetLinger(0)
+		c.Close()
+	}))
+	c.Write([]byte("x"))
+	// The end may have the error of the local read on the closed connection
+	if e := strings.Join(get(4), ","); !strings.HasPrefix(e, "open,close,closed,end") {
+		t.Fatalf("got %s", e)
+	}
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := l.Addr().String()
+	l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := DialThrough(ctx, coch, address); err == nil {
+		t.Fatal("connected to a closed port")
+	}
+	if e := strings.Join(get(2), ","); e != "open,end "+ErrServiceUnavailable.Error() {
+		t.Fatalf("got %s", e)
+	}
+}
+
+// TestStressOpenClose opens and closes many sessions at once, each closed while data is still
+// flowing both ways, so that the DATA and DISCONNECTED of a session race. Run it with -race
+func TestStressOpenClose(t *testing.T) {
+	a, b := &Tunnel{}, &Tunnel{}
+	coch := serveTunnel(t, a, b)
+	address := listen(t, echo)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				c, err := DialThrough(ctx, coch, address)
+				cancel()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				go io.Copy(io.Discard, c)
+				c.Write([]byte(strings.Repeat("x", 1000*j)))
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the sessions to end", func() bool { return a.ActiveSessions() == 0 && b.ActiveSessions() == 0 })
+	c := dial(t, coch, address)
+	io.WriteString(c, "still working")
+	buf := make([]byte, len("still working"))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cappedFramer is a Framer that fails on messages over max bytes, like a transport with a limit
+type cappedFramer struct {
+	*ConnFramer
+	max     int
+	mu      sync.Mutex
+	largest int
+}
+
+func (c *cappedFramer) Write(b []byte) error {
+	c.mu.Lock()
+	if len(b) > c.largest {
+		c.largest = len(b)
+	}
+	c.mu.Unlock()
+	if len(b) > c.max {
+		return ErrFrameTooLarge
+	}
+	return c.ConnFramer.Write(b)
+}
+
+func (c *cappedFramer) MaxMessageSize() int {
+	return c.max
+}
+
+// TestSplitData sends data much larger than the messages of a framer capped at 512 bytes, which
+// is split to fit and put back together in order
+func TestSplitData(t *testing.T) {
+	ca, cb := net.Pipe()
+	fa, fb := &cappedFramer{ConnFramer: NewConnFramer(ca), max: 512}, &cappedFramer{ConnFramer: NewConnFramer(cb), max: 512}
+	coch := serveFramers(t, &Tunnel{}, &Tunnel{}, fa, fb)
+	c := dial(t, coch, listen(t, echo))
+	msg := make([]byte, 100000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go c.Write(msg)
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, msg) {
+		t.Fatal("echo mismatch")
+	}
+	for _, f := range []*cappedFramer{fa, fb} {
+		f.mu.Lock()
+		largest := f.largest
+		f.mu.Unlock()
+		if largest > f.max || largest < f.max/2 {
+			t.Fatalf("largest message %d bytes", largest)
+		}
+	}
+}
+
+// TestShutdownPendingConnect ends Serve on the side of the destination while a session from
+// the other side is still being connected. Serve waits for it, and it does not connect after
+func TestShutdownPendingConnect(t *testing.T) {
+	accepted := make(chan struct{}, 1)
+	address := listen(t, func(c net.Conn) {
+		accepted <- struct{}{}
+		c.Close()
+	})
+	connecting := make(chan struct{})
+	release := make(chan struct{})
+	remote := &Tunnel{RewriteDestination: func(address string) (string, error) {
+		// A slow step of connecting, e.g. a lookup
+		close(connecting)
+		<-release
+		return address, nil
+	}}
+	ca, cb := net.Pipe()
+	coch := make(chan ConnectOperation)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&Tunnel{}).Serve(ctx, NewConnFramer(ca), coch)
+	rctx, rcancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		remote.Serve(rctx, NewConnFramer(cb), nil)
+		close(served)
+	}()
+
+	dialed := make(chan error, 1)
+	go func() {
+		dctx, dcancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer dcancel()
+		_, err := DialThrough(dctx, coch, address)
+		dialed <- err
+	}()
+	<-connecting
+	rcancel()
+	select {
+	case <-served:
+		t.Fatal("Serve returned before the pending connect")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if err := <-dialed; err == nil {
+		t.Fatal("connected after shutdown")
+	}
+	select {
+	case <-accepted:
+		t.Fatal("destination dialed after shutdown")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// serveChannels runs the session handling of tn on channels until the test ends, and returns
+// the channel of the messages from the other side and the one of the messages to it
+func serveChannels(t *testing.T, tn *Tunnel) (chan<- *message.Message, <-chan *message.Message) {
+	ich := make(chan *message.Message)
+	och := make(chan *message.Message, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tn.serve(ctx, ich, och, nil, nil, nil, nil, func(error) error { return nil })
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ich, och
+}
+
+// receive returns the next message to the other side, after HELLO
+func receive(t *testing.T, och <-chan *message.Message) *message.Message {
+	t.Helper()
+	for {
+		select {
+		case m := <-och:
+			if m.Type != message.Message_HELLO {
+				return m
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message")
+		}
+	}
+}
+
+// TestServeChannels drives a session initiated by the other side with messages alone
+func TestServeChannels(t *testing.T) {
+	ich, och := serveChannels(t, &Tunnel{})
+	ich <- &message.Message{Type: message.Message_HTTP_CONNECT, Id: 1, SocketAddress: listen(t, echo)}
+	if m := receive(t, och); m.Type != message.Message_HTTP_CONNECT_OK || m.Id != 1 {
+		t.Fatalf("got %v of %d", m.Type, m.Id)
+	}
+	ich <- &message.Message{Type: message.Message_DATA, Id: 1, Buf: []byte("hi")}
+	if m := receive(t, och); m.Type != message.Message_DATA || m.Origin != message.Message_ORIGIN_REMOTE || string(m.Buf) != "hi" {
+		t.Fatalf("got %v from %v %q", m.Type, m.Origin, m.Buf)
+	}
+	ich <- &message.Message{Type: message.Message_DISCONNECTED, Id: 1}
+	if m := receive(t, och); m.Type != message.Message_DISCONNECTED || m.Id != 1 {
+		t.Fatalf("got %v of %d", m.Type, m.Id)
+	}
+
+	ich <- &message.Message{Type: message.Message_HTTP_CONNECT, Id: 2, SocketAddress: "bad address"}
+	if m := receive(t, och); m.Type != message.Message_HTTP_SERVICE_UNAVAILABLE || m.Id != 2 {
+		t.Fatalf("got %v of %d", m.Type, m.Id)
+	}
+}
+
+// TestUnknownMessageType sends messages of a type from a newer version, which must be ignored and
+// logged once, rather than handled as DATA of a session
+func TestUnknownMessageType(t *testing.T) {
+	var mu sync.Mutex
+	var logged []string
+	tn := &Tunnel{Logf: func(format string, v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}}
+	ich, och := serveChannels(t, tn)
+	ich <- &message.Message{Type: message.Message_HTTP_CONNECT, Id: 1, SocketAddress: listen(t, echo)}
+	if m := receive(t, och); m.Type != message.Message_HTTP_CONNECT_OK {
+		t.Fatalf("got %v", m.Type)
+	}
+	ich <- &message.Message{Type: message.Message_Type(99), Id: 1, Buf: []byte("unknown")}
+	ich <- &message.Message{Type: message.Message_Type(99), Id: 2}
+	ich <- &message.Message{Type: message.Message_DATA, Id: 1, Buf: []byte("data")}
+	if m := receive(t, och); m.Type != message.Message_DATA || string(m.Buf) != "data" {
+		t.Fatalf("got %v %q", m.Type, m.Buf)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	unknown := 0
+	for _, l := range logged {
+		if strings.Contains(l, "unknown connection") {
+			t.Errorf("handled as a session message: %s", l)
+		}
+		if strings.Contains(l, "unknown message type") {
+			unknown++
+		}
+	}
+	if unknown != 1 {
+		t.Errorf("logged the unknown type %d times, want once", unknown)
+	}
+}
+
+// TestMaxPendingConnects floods connects against a slow dialer. The ones over MaxPendingConnects
+// are refused while the others wait, and connects are accepted again once those complete
+func TestMaxPendingConnects(t *testing.T) {
+	const max, flood = 4, 20
+	release := make(chan struct{})
+	remote := &Tunnel{MaxPendingConnects: max, RewriteDestination: func(address string) (string, error) {
+		// A slow step of connecting, e.g. a lookup
+		<-release
+		return address, nil
+	}}
+	coch := serveTunnel(t, &Tunnel{}, remote)
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	// Before the tunnel ends, which waits for the pending connects
+	t.Cleanup(unblock)
+	address := listen(t, echo)
+
+	errc := make(chan error, flood)
+	for i := 0; i < flood; i++ {
+		go func() { errc <- dialErr(coch, address) }()
+	}
+	for i := 0; i < flood-max; i++ {
+		if err := <-errc; err == nil {
+			t.Fatal("connected while the dials were pending")
+		}
+	}
+	if n := remote.Stats().PendingConnects; n != max {
+		t.Fatalf("got %d pending connects, want %d", n, max)
+	}
+
+	unblock()
+	for i := 0; i < max; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "pending connects", func() bool { return remote.Stats().PendingConnects == 0 })
+	transfer(t, dial(t, coch, address), 100)
+}
+
+// countingConn counts the writes to the connection
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// BenchmarkCoalesceConnectResponse connects CONNECT clients to a destination that answers right
+// away, and reports the writes to the client up to the first data, with and without coalescing
+func BenchmarkCoalesceConnectResponse(b *testing.B) {
+	const greeting = "220 ready\r\n"
+	address := listen(b, func(c net.Conn) {
+		defer c.Close()
+		io.WriteString(c, greeting)
+		io.Copy(io.Discard, c)
+	})
+	for _, coalesce := range []time.Duration{0, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("coalesce=%v", coalesce), func(b *testing.B) {
+			coch := serveTunnel(b, &Tunnel{CoalesceConnectResponse: coalesce}, &Tunnel{})
+			want := len("HTTP/1.1 200 OK\r\n\r\n") + len(greeting)
+			buf := make([]byte, want)
+			var writes int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c, s := net.Pipe()
+				coch <- ConnectOperation{Conn: countingConn{s, &writes}, Address: address}
+				if _, err := io.ReadFull(c, buf); err != nil {
+					b.Fatal(err)
+				}
+				c.Close()
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&writes))/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// TestSessionContextCanceled disconnects a session from the other side while it is being
+// connected, which must cancel its session context and abort the dial
+func TestSessionContextCanceled(t *testing.T) {
+	accepted := make(chan struct{}, 1)
+	address := listen(t, func(c net.Conn) {
+		accepted <- struct{}{}
+		c.Close()
+	})
+	connecting := make(chan struct{})
+	release := make(chan struct{})
+	sctxs := make(chan context.Context, 1)
+	tn := &Tunnel{
+		SessionContext: func(parent context.Context, address string) context.Context {
+			sctxs <- parent
+			return parent
+		},
+		RewriteDestination: func(address string) (string, error) {
+			// A slow step of connecting, e.g. a lookup
+			close(connecting)
+			<-release
+			return address, nil
+		},
+	}
+	ich, och := serveChannels(t, tn)
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+
+	ich <- &message.Message{Type: message.Message_HTTP_CONNECT, Id: 1, SocketAddress: address}
+	<-connecting
+	ich <- &message.Message{Type: message.Message_DISCONNECTED, Id: 1}
+	select {
+	case <-(<-sctxs).Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session context not canceled")
+	}
+	unblock()
+	if m := receive(t, och); m.Type == message.Message_HTTP_CONNECT_OK {
+		t.Fatal("connected a disconnected session")
+	}
+	select {
+	case <-accepted:
+		t.Fatal("dialed the destination of a disconnected session")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestSessionContextDeadline bounds the connecting of the sessions with a deadline added by
+// SessionContext
+func TestSessionContextDeadline(t *testing.T) {
+	accepted := make(chan struct{}, 1)
+	address := listen(t, func(c net.Conn) {
+		accepted <- struct{}{}
+		c.Close()
+	})
+	remote := &Tunnel{
+		SessionContext: func(parent context.Context, address string) context.Context {
+			// The parent is cancelled when the session ends, which releases the timer
+			ctx, cancel := context.WithTimeout(parent, 20*time.Millisecond)
+			go func() {
+				<-ctx.Done()
+				cancel()
+			}()
+			return ctx
+		},
+		RewriteDestination: func(address string) (string, error) {
+			time.Sleep(50 * time.Millisecond)
+			return address, nil
+		},
+	}
+	coch := serveTunnel(t, &Tunnel{}, remote)
+	if err := dialErr(coch, address); !errors.Is(err, ErrServiceUnavailable) {
+		t.Fatalf("got %v, want %v", err, ErrServiceUnavailable)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("dialed past the deadline")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestSimultaneousClose closes many sessions on both ends at once, gracefully and with resets,
+// so that both sides end the same sessions together. Both must end all of them without leaking
+// and without taking the other side's close for an unknown session
+func TestSimultaneousClose(t *testing.T) {
+	const n = 50
+	for _, reset := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reset=%v", reset), func(t *testing.T) {
+			var mu sync.Mutex
+			var logged []string
+			logf := func(format string, v ...interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				logged = append(logged, fmt.Sprintf(format, v...))
+			}
+			a, b := &Tunnel{Logf: logf}, &Tunnel{Logf: logf}
+			coch := serveTunnel(t, a, b)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := a.WaitReady(ctx); err != nil {
+				t.Fatal(err)
+			}
+			idle := [2]int64{a.Stats().Goroutines, b.Stats().Goroutines}
+
+			start := make(chan struct{})
+			closeConn := func(c *net.TCPConn) {
+				<-start
+				if reset {
+					c.SetLinger(0)
+				}
+				c.Close()
+			}
+			var wg sync.WaitGroup
+			wg.Add(2 * n)
+			address := listen(t, func(c net.Conn) {
+				defer wg.Done()
+				closeConn(c.(*net.TCPConn))
+			})
+			for i := 0; i < n; i++ {
+				c, s := tcpPair(t)
+				result := make(chan error, 1)
+				coch <- ConnectOperation{Conn: s, Address: address, Result: result}
+				if err := <-result; err != nil {
+					t.Fatal(err)
+				}
+				go func() {
+					defer wg.Done()
+					closeConn(c)
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			waitFor(t, "sessions ended", func() bool {
+				return a.ActiveSessions() == 0 && b.ActiveSessions() == 0 &&
+					a.Stats().Goroutines == idle[0] && b.Stats().Goroutines == idle[1]
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			for _, l := range logged {
+				if strings.Contains(l, "unknown connection") {
+					t.Errorf("close of the other side taken for an unknown session: %s", l)
+				}
+			}
+		})
+	}
+}
+
+// TestValidateFirstBytes connects to a destination answering HTTP and to one answering garbage,
+// which ValidateFirstBytes rejects before any of it reaches the client
+func TestValidateFirstBytes(t *testing.T) {
+	closes := make(chan SessionClose, 2)
+	local := &Tunnel{OnSessionClose: func(sc SessionClose) { closes <- sc }}
+	remote := &Tunnel{ValidateFirstBytes: func(address string, firstBytes []byte) bool {
+		return bytes.HasPrefix(firstBytes, []byte("HTTP/"))
+	}}
+	coch := serveTunnel(t, local, remote)
+	answer := func(s string) string {
+		return listen(t, func(c net.Conn) {
+			defer c.Close()
+			io.WriteString(c, s)
+			io.Copy(io.Discard, c)
+		})
+	}
+
+	c := dial(t, coch, answer("HTTP/1.1 200 OK\r\n\r\n"))
+	b := make([]byte, 5)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "HTTP/" {
+		t.Fatalf("got %q %v", b, err)
+	}
+
+	c = dial(t, coch, answer("\x00garbage"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(c); err != nil || len(b) != 0 {
+		t.Fatalf("got %q %v, want the session closed without data", b, err)
+	}
+	select {
+	case sc := <-closes:
+		if sc.Code != ClosePolicy {
+			t.Fatalf("got close code %v, want %v", sc.Code, ClosePolicy)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no close from the other side")
+	}
+}
+
+// TestRewriteDestination rewrites the host of CONNECT requests to a loopback destination, which
+// AllowDestination then sees instead of the requested one, and rejects the others
+func TestRewriteDestination(t *testing.T) {
+	address := listen(t, echo)
+	var mu sync.Mutex
+	var allowed []string
+	remote := &Tunnel{
+		RewriteDestination: func(a string) (string, error) {
+			if a == "app.example.com:443" {
+				return address, nil
+			}
+			return "", errors.New("unknown host")
+		},
+		AllowDestination: func(a string) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			allowed = append(allowed, a)
+			return strings.HasPrefix(a, "127.0.0.1:")
+		},
+	}
+	coch := serveTunnel(t, &Tunnel{}, remote)
+	proxy := httptest.NewServer(NewHTTPHandler(HTTPHandlerOptions{ConnectOperations: coch}))
+	defer proxy.Close()
+
+	c, resp := connect(t, proxy, "app.example.com:443")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+	transfer(t, c, 100)
+	if _, resp := connect(t, proxy, "other.example.com:443"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(allowed) != 1 || allowed[0] != address {
+		t.Fatalf("AllowDestination got %q, want the rewritten address only", allowed)
+	}
+}
+
+// TestDisconnectSlowDestination resets a client while the other side is blocked writing its data
+// to a destination that does not read. The session must end there promptly all the same.
+// The data fits in the window, so the reset is read after it. Without flow control the tunnel
+// waits for the destination, see SpillDir, and with the window used up nothing reads the reset
+func TestDisconnectSlowDestination(t *testing.T) {
+	const window = 32 << 20
+	remote := &Tunnel{WindowSize: window}
+	coch := serveTunnel(t, &Tunnel{WindowSize: window}, remote)
+	closed := make(chan struct{})
+	address := listen(t, func(c net.Conn) {
+		defer close(closed)
+		// Not reading until the session ends on the other side
+		waitFor(t, "session ended", func() bool { return remote.ActiveSessions() == 0 })
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, c)
+	})
+	c, s := tcpPair(t)
+	result := make(chan error, 1)
+	coch <- ConnectOperation{Conn: s, Address: address, Result: result}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	go c.Write(make([]byte, window/2))
+	waitFor(t, "the destination full", func() bool {
+		before := remote.Stats().BytesWritten
+		time.Sleep(50 * time.Millisecond)
+		return before > 0 && remote.Stats().BytesWritten == before
+	})
+	c.SetLinger(0)
+	c.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("destination not closed")
+	}
+}
@@ -0,0 +1,56 @@
+package portal
+
+import "sync"
+
+// quota counts the bytes of a tunnel connection against MaxTotalBytes
+type quota struct {
+	mu   sync.Mutex
+	used int64
+	// Closed when the quota is exceeded
+	exceeded chan struct{}
+}
+
+func (q *quota) add(n int64, max int64) {
+	if max <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used += n
+	if ch := q.exceededLocked(); q.used >= max && !isClosed(ch) {
+		close(ch)
+	}
+}
+
+// done returns a channel closed when the quota is exceeded
+func (q *quota) done() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.exceededLocked()
+}
+
+func (q *quota) isExceeded() bool {
+	return isClosed(q.done())
+}
+
+func (q *quota) exceededLocked() chan struct{} {
+	if q.exceeded == nil {
+		q.exceeded = make(chan struct{})
+	}
+	return q.exceeded
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// QuotaExceeded returns whether MaxTotalBytes is reached on the current tunnel connection
+func (tn *Tunnel) QuotaExceeded() bool {
+	tc, _ := tn.conns.current()
+	return tc != nil && tc.quota.isExceeded()
+}
@@ -0,0 +1,99 @@
+package portal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// transfer echoes n bytes over c
+func transfer(t *testing.T, c io.ReadWriter, n int) {
+	t.Helper()
+	go c.Write(bytes.Repeat([]byte("q"), n))
+	if _, err := io.ReadFull(c, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialErr connects to the address through the tunnel of coch and returns the error
+func dialErr(coch chan<- ConnectOperation, address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialThrough(ctx, coch, address)
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+// TestQuotaPause transfers past MaxTotalBytes of either side, which pauses new sessions while the
+// open ones go on, until the next Serve
+func TestQuotaPause(t *testing.T) {
+	const max = 4096
+	address := listen(t, echo)
+	for _, local := range []bool{true, false} {
+		a, b := &Tunnel{}, &Tunnel{}
+		tn := b
+		if local {
+			tn = a
+		}
+		tn.MaxTotalBytes = max
+		t.Run("exceed", func(t *testing.T) {
+			coch := serveTunnel(t, a, b)
+			c := dial(t, coch, address)
+			transfer(t, c, max)
+			waitFor(t, "quota", tn.QuotaExceeded)
+			if err := dialErr(coch, address); err == nil {
+				t.Fatal("connected over the quota")
+			}
+			transfer(t, c, 100)
+		})
+		t.Run("reset", func(t *testing.T) {
+			coch := serveTunnel(t, a, b)
+			transfer(t, dial(t, coch, address), 100)
+			if tn.QuotaExceeded() {
+				t.Fatal("quota exceeded after Serve again")
+			}
+		})
+	}
+}
+
+// TestQuotaClose transfers past MaxTotalBytes with CloseOnQuota, which closes the open sessions
+func TestQuotaClose(t *testing.T) {
+	const max = 4096
+	coch := serveTunnel(t, &Tunnel{}, &Tunnel{MaxTotalBytes: max, CloseOnQuota: true})
+	c := dial(t, coch, listen(t, echo))
+	go c.Write(make([]byte, max))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		t.Fatalf("got %v, want the session closed", err)
+	}
+}
+
+// TestQuotaPerConnection serves two tunnel connections at the same time with MaxTotalBytes, and
+// exceeds it on the first, which leaves the second open to new sessions
+func TestQuotaPerConnection(t *testing.T) {
+	const max = 4096
+	address := listen(t, echo)
+	hub := &Tunnel{MaxTotalBytes: max}
+	// connect serves hub with a new peer and returns the channel for its sessions
+	connect := func() chan<- ConnectOperation {
+		ca, cb := net.Pipe()
+		t.Cleanup(func() { cb.Close() })
+		coch := make(chan ConnectOperation)
+		peer := &Tunnel{}
+		go hub.Serve(context.Background(), NewConnFramer(ca), nil)
+		go peer.Serve(context.Background(), NewConnFramer(cb), coch)
+		return coch
+	}
+
+	first, second := connect(), connect()
+	transfer(t, dial(t, first, address), max)
+	waitFor(t, "quota", func() bool { return dialErr(first, address) != nil })
+	if err := dialErr(second, address); err != nil {
+		t.Fatalf("got %v on the second connection, want connected", err)
+	}
+}
@@ -0,0 +1,61 @@
+package portal
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket for MaxNewSessionsPerSecond, shared by the sessions initiated on
+// either side. It holds up to burst tokens, so a burst of that many is allowed after idle
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if there is one at the rate per second. Otherwise it returns false and
+// the time until the next token
+func (l *rateLimiter) allow(rate, burst int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / float64(rate) * float64(time.Second))
+}
+
+// allowNewSession checks MaxNewSessionsPerSecond for a new session and counts it if throttled
+func (tn *Tunnel) allowNewSession() (bool, time.Duration) {
+	if tn.MaxNewSessionsPerSecond <= 0 {
+		return true, 0
+	}
+	burst := tn.NewSessionBurst
+	if burst <= 0 {
+		burst = tn.MaxNewSessionsPerSecond
+	}
+	ok, wait := tn.rate.allow(tn.MaxNewSessionsPerSecond, burst)
+	if !ok {
+		tn.counters.add(&tn.counters.sessionsThrottled, 1)
+	}
+	return ok, wait
+}
+
+// retryAfterSeconds rounds the wait up to whole seconds for Retry-After
+func retryAfterSeconds(d time.Duration) int32 {
+	s := int32((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
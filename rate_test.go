@@ -0,0 +1,55 @@
+package portal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestMaxNewSessionsPerSecond bursts connects over MaxNewSessionsPerSecond of either side, which
+// are throttled past NewSessionBurst
+func TestMaxNewSessionsPerSecond(t *testing.T) {
+	const burst = 3
+	address := listen(t, echo)
+	for _, local := range []bool{true, false} {
+		t.Run(fmt.Sprintf("local=%v", local), func(t *testing.T) {
+			a, b := &Tunnel{}, &Tunnel{}
+			tn := b
+			if local {
+				tn = a
+			}
+			// A token comes back each second, later than the burst takes
+			tn.MaxNewSessionsPerSecond, tn.NewSessionBurst = 1, burst
+			coch := serveTunnel(t, a, b)
+			for i := 0; i < burst; i++ {
+				dial(t, coch, address)
+			}
+			for i := 0; i < 2; i++ {
+				if err := dialErr(coch, address); !errors.Is(err, ErrSessionRateLimited) {
+					t.Fatalf("got %v, want %v", err, ErrSessionRateLimited)
+				}
+			}
+			if n := tn.Stats().SessionsThrottled; n != 2 {
+				t.Fatalf("got %d throttled, want 2", n)
+			}
+		})
+	}
+}
+
+// TestMaxNewSessionsPerSecondConnect checks that a CONNECT client over the rate gets too many
+// requests with Retry-After
+func TestMaxNewSessionsPerSecondConnect(t *testing.T) {
+	coch := serveTunnel(t, &Tunnel{MaxNewSessionsPerSecond: 1}, &Tunnel{})
+	srv := httptest.NewServer(NewHTTPHandler(HTTPHandlerOptions{ConnectOperations: coch}))
+	defer srv.Close()
+	address := listen(t, echo)
+	if _, resp := connect(t, srv, address); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+	_, resp := connect(t, srv, address)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("got %d with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
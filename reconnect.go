@@ -0,0 +1,104 @@
+package portal
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff is the delay between the connections of DialAndServeWithReconnect. The delay starts at
+// Initial and grows by Multiplier after each connection that failed or ended early, up to Max.
+// The zero value waits 1s, 2s, 4s and so on up to a minute
+type Backoff struct {
+	// Initial is the delay after the first failure. Defaults to one second
+	Initial time.Duration
+
+	// Max is the longest delay. Defaults to one minute
+	Max time.Duration
+
+	// Multiplier grows the delay after each failure. Defaults to 2
+	Multiplier float64
+
+	// Jitter is the fraction of the delay taken off at random, from 0 to 1, so that clients that
+	// lost the server together do not all come back at once. Zero for none
+	Jitter float64
+
+	// ResetAfter is how long a connection must be served to count as a success. The delay starts
+	// again from Initial after it. Defaults to Max
+	ResetAfter time.Duration
+}
+
+func (b *Backoff) initial() time.Duration {
+	if b.Initial > 0 {
+		return b.Initial
+	}
+	return time.Second
+}
+
+func (b *Backoff) max() time.Duration {
+	if b.Max > 0 {
+		return b.Max
+	}
+	return time.Minute
+}
+
+func (b *Backoff) multiplier() float64 {
+	if b.Multiplier > 1 {
+		return b.Multiplier
+	}
+	return 2
+}
+
+func (b *Backoff) resetAfter() time.Duration {
+	if b.ResetAfter > 0 {
+		return b.ResetAfter
+	}
+	return b.max()
+}
+
+// DialAndServeWithReconnect connects with dial and serves the connection with tn, again and again
+// until ctx is done, e.g. on a client that should stay connected to the tunnel server. It waits
+// with backoff after a failed dial, and after a connection that ended within ResetAfter.
+// It returns the error of ctx, or nil once the tunnel ended after Drain.
+// An invalid option of tn is returned right away, as reconnecting would not help
+func DialAndServeWithReconnect(ctx context.Context, dial func() (Framer, error), tn *Tunnel, coch <-chan ConnectOperation, backoff Backoff) error {
+	if err := tn.validate(); err != nil {
+		return err
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	delay := backoff.initial()
+	for {
+		started := time.Now()
+		c, err := dial()
+		if err != nil {
+			tn.errorf("tunnel dial error. err=%v", err)
+		} else {
+			err = tn.Serve(ctx, c, coch)
+			if tn.Draining() {
+				return nil
+			}
+			if time.Since(started) >= backoff.resetAfter() {
+				delay = backoff.initial()
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		d := delay
+		if backoff.Jitter > 0 {
+			d -= time.Duration(rnd.Float64() * backoff.Jitter * float64(d))
+		}
+		tn.logf("tunnel reconnect. delay=%v err=%v", d, err)
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if delay = time.Duration(float64(delay) * backoff.multiplier()); delay > backoff.max() {
+			delay = backoff.max()
+		}
+	}
+}
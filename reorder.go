@@ -0,0 +1,105 @@
+package portal
+
+import (
+	"errors"
+	"time"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// ErrReorderGap is the error the tunnel connection is closed with when a missing message
+// does not arrive in time with ReorderBuffer
+var ErrReorderGap = errors.New("missing tunnel message")
+
+const defaultReorderTimeout = time.Second
+
+// reorder puts the messages read from the tunnel connection back into the order they were sent.
+// Messages ahead of a missing one are held until it arrives. The connection is closed with
+// closeConn when the missing message takes longer than the timeout.
+// Messages without a number are passed as is, for a sender that does not number them
+type reorder struct {
+	max       int
+	timeout   time.Duration
+	closeConn func(error) error
+	logf      func(string, ...interface{})
+
+	// Number of the next message to pass
+	next uint64
+	held map[uint64]*message.Message
+
+	// Closes the connection if the gap is not filled in time. Set while messages are held
+	timer *time.Timer
+}
+
+func newReorder(max int, timeout time.Duration, closeConn func(error) error, logf func(string, ...interface{})) *reorder {
+	if timeout <= 0 {
+		timeout = defaultReorderTimeout
+	}
+	return &reorder{
+		max:       max,
+		timeout:   timeout,
+		closeConn: closeConn,
+		logf:      logf,
+		next:      1,
+		held:      make(map[uint64]*message.Message),
+	}
+}
+
+// add takes a message read from the connection and returns the messages that can be passed on in order.
+// It returns false if the buffer is full, and the connection is to be closed
+func (r *reorder) add(co *message.Message) ([]*message.Message, bool) {
+	if co.Seq == 0 {
+		return []*message.Message{co}, true
+	}
+	if co.Seq < r.next || r.held[co.Seq] != nil {
+		r.logf("reorder duplicate message. seq=%d", co.Seq)
+		return nil, true
+	}
+	if co.Seq > r.next {
+		if len(r.held) >= r.max {
+			r.logf("reorder buffer full. seq=%d missing=%d", co.Seq, r.next)
+			return nil, false
+		}
+		r.held[co.Seq] = co
+		if r.timer == nil {
+			r.wait()
+		}
+		return nil, true
+	}
+	cos := []*message.Message{co}
+	r.next++
+	for {
+		h, ok := r.held[r.next]
+		if !ok {
+			break
+		}
+		delete(r.held, r.next)
+		cos = append(cos, h)
+		r.next++
+	}
+	if r.timer != nil {
+		// Gap filled. Wait anew for the next missing message, if any
+		r.stop()
+		if len(r.held) > 0 {
+			r.wait()
+		}
+	}
+	return cos, true
+}
+
+// wait starts the timeout for the next missing message
+func (r *reorder) wait() {
+	missing := r.next
+	r.timer = time.AfterFunc(r.timeout, func() {
+		r.logf("reorder timeout. missing=%d", missing)
+		r.closeConn(ErrReorderGap)
+	})
+}
+
+// stop stops waiting for a missing message
+func (r *reorder) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
@@ -0,0 +1,73 @@
+package portal
+
+import (
+	"context"
+	"time"
+)
+
+const defaultShutdownTimeout = 5 * time.Second
+
+// detachedContext has the values of its parent but is not done with it, so that the tunnel can
+// still send to the other side while shutting down after the caller's ctx is done
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (tn *Tunnel) shutdownTimeout() time.Duration {
+	if tn.ShutdownTimeout == 0 {
+		return defaultShutdownTimeout
+	}
+	return tn.ShutdownTimeout
+}
+
+// shutdown asks the mapper with sch to disconnect the sessions, and waits for the tunnelWriter to
+// close flushed after writing their last messages, for up to ShutdownTimeout.
+// It returns early when stop is closed as the tunnel ended anyway
+func (tn *Tunnel) shutdown(sch chan<- struct{}, flushed <-chan struct{}, stop <-chan struct{}) {
+	d := tn.shutdownTimeout()
+	if d < 0 {
+		return
+	}
+	tn.logf("tunnel shutting down. timeout=%v", d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case sch <- struct{}{}:
+	case <-timer.C:
+		tn.warnf("tunnel shutdown timed out before disconnecting sessions")
+		return
+	case <-stop:
+		return
+	}
+	select {
+	case <-flushed:
+		tn.logf("tunnel shutdown flushed")
+	case <-timer.C:
+		tn.warnf("tunnel shutdown timed out before flushing")
+	case <-stop:
+	}
+}
+
+// allSent is whether the last messages of all sessions were sent to the other side
+func allSent(maps ...map[int32]*session) bool {
+	for _, m := range maps {
+		for _, s := range m {
+			if !s.sent {
+				return false
+			}
+		}
+	}
+	return true
+}
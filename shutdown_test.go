@@ -0,0 +1,61 @@
+package portal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestShutdownFlush ends the Serve of one side with sessions open, and checks that the other side
+// gets their DISCONNECTEDs with ClosePolicy before the tunnel connection closes
+func TestShutdownFlush(t *testing.T) {
+	const sessions = 5
+	closes := make(chan SessionClose, sessions)
+	a := &Tunnel{}
+	b := &Tunnel{OnSessionClose: func(sc SessionClose) { closes <- sc }}
+	ca, cb := net.Pipe()
+	coch := make(chan ConnectOperation)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aDone := make(chan struct{})
+	go func() {
+		defer close(aDone)
+		a.Serve(ctx, NewConnFramer(ca), coch)
+	}()
+	bDone := make(chan struct{})
+	go func() {
+		defer close(bDone)
+		b.Serve(context.Background(), NewConnFramer(cb), nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-aDone
+		<-bDone
+	})
+
+	address := listen(t, echo)
+	for i := 0; i < sessions; i++ {
+		c := dial(t, coch, address)
+		transfer(t, c, 1000)
+	}
+	cancel()
+	select {
+	case <-bDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not closed after shutdown")
+	}
+	if len(closes) != sessions {
+		t.Fatalf("got %d of %d disconnects before the tunnel closed", len(closes), sessions)
+	}
+	for i := 0; i < sessions; i++ {
+		if sc := <-closes; sc.Code != ClosePolicy {
+			t.Fatalf("got close %v, want ClosePolicy", sc.Code)
+		}
+	}
+	select {
+	case <-aDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve not returned after shutdown")
+	}
+}
@@ -0,0 +1,151 @@
+package portal
+
+import (
+	"context"
+	"os"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+const (
+	// Data of a session kept in memory before spilling to disk
+	spillMemoryBytes     = 64 * 1024
+	defaultMaxSpillBytes = 64 * 1024 * 1024
+)
+
+// spilled is a queued message, with the data in the spill file if spilled is not 0
+type spilled struct {
+	co      *message.Message
+	spilled int
+}
+
+// spillQueue forwards messages from in to out in order like queue, for a proxyWriter without flow control.
+// Data over spillMemoryBytes is written to a temp file in dir instead of being held in memory,
+// and read back when the proxyWriter gets to it. The file is kept within max bytes, plus the
+// message taken last: once it reaches max, the data already sent is cut from the start of the
+// file by moving the rest there, if that is at most as much as was sent. Otherwise it stops taking
+// messages from in until the proxyWriter catches up, which blocks the mapper like without it.
+// The file is removed when the queue ends. out is closed after in is closed and the queue is empty,
+// when ctx is done, or on a read error of the file.
+// The data held in memory is counted in b, and all new data is spilled when it is under pressure
+func spillQueue(ctx context.Context, in <-chan *message.Message, out chan<- *message.Message, dir string, max int64, b *bufferAccount, logf func(string, ...interface{})) {
+	defer close(out)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	var q []spilled
+	// Bytes of data held in memory, and in the file between the read and write offsets
+	memory := 0
+	defer func() {
+		b.add(-memory)
+	}()
+	var roff, woff int64
+	// Next message to send, with the data read back if spilled
+	var head *message.Message
+	for in != nil || len(q) > 0 {
+		var och chan<- *message.Message
+		if len(q) > 0 {
+			och = out
+			if head == nil {
+				head = q[0].co
+				if q[0].spilled > 0 {
+					buf := make([]byte, q[0].spilled)
+					if _, err := f.ReadAt(buf, roff); err != nil {
+						logf("spillQueue read error. id=%d err=%v", head.Id, err)
+						return
+					}
+					head.Buf = buf
+				}
+			}
+		}
+		if woff >= max && roff >= woff-roff {
+			// The data still to send is no more than the data sent. Move it to the start
+			if err := compact(f, roff, woff); err != nil {
+				logf("spillQueue compact error. err=%v", err)
+				return
+			}
+			roff, woff = 0, woff-roff
+		}
+		ich := in
+		if woff >= max {
+			// Spill file full. Wait for the proxyWriter
+			ich = nil
+		}
+		select {
+		case i, ok := <-ich:
+			if !ok {
+				in = nil
+				continue
+			}
+			e := spilled{co: i}
+			if i.Type == message.Message_DATA && (memory+len(i.Buf) > spillMemoryBytes || b.pressure()) {
+				if n, err := spill(&f, dir, i.Buf, woff); err == nil {
+					// The message keeps the rest, e.g. More of a datagram, until the data is read back
+					i.Buf = nil
+					e.spilled = n
+					woff += int64(n)
+				} else {
+					// Keep it in memory
+					logf("spillQueue write error. id=%d err=%v", i.Id, err)
+				}
+			}
+			if e.spilled == 0 {
+				memory += len(i.Buf)
+				b.add(len(i.Buf))
+			}
+			q = append(q, e)
+		case och <- head:
+			if q[0].spilled > 0 {
+				roff += int64(q[0].spilled)
+				if roff == woff {
+					// File drained. Reuse it from the start
+					roff, woff = 0, 0
+					f.Truncate(0)
+				}
+			} else {
+				memory -= len(head.Buf)
+				b.add(-len(head.Buf))
+			}
+			head = nil
+			q[0] = spilled{}
+			q = q[1:]
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// spill writes the data to the spill file at off, creating the file in dir if needed
+func spill(f **os.File, dir string, b []byte, off int64) (int, error) {
+	if *f == nil {
+		var err error
+		if *f, err = os.CreateTemp(dir, "portal-spill-*"); err != nil {
+			return 0, err
+		}
+	}
+	return (*f).WriteAt(b, off)
+}
+
+// compact moves the data between roff and woff of the spill file to its start, and truncates it.
+// The data is copied forward in chunks, so it may overlap its old place
+func compact(f *os.File, roff, woff int64) error {
+	buf := make([]byte, 32*1024)
+	for off := roff; off < woff; {
+		n := len(buf)
+		if int64(n) > woff-off {
+			n = int(woff - off)
+		}
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], off-roff); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return f.Truncate(woff - roff)
+}
@@ -0,0 +1,97 @@
+package portal
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// TestSpillQueueFileSize keeps a steady backlog of spilled data that never drains, and checks that
+// the spill file stays within the limit while all the data goes through in order
+func TestSpillQueueFileSize(t *testing.T) {
+	const max = 64 * 1024
+	const size = 4096
+	const backlog = 8
+	dir := t.TempDir()
+	// Under pressure all data is spilled
+	b := &bufferAccount{tn: &Tunnel{MaxBufferedBytes: 1}, si: &sessionInfo{}}
+	in, out := make(chan *message.Message), make(chan *message.Message)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go spillQueue(ctx, in, out, dir, max, b, t.Logf)
+
+	data := func(i int) *message.Message {
+		return &message.Message{Type: message.Message_DATA, Id: 1, Buf: bytes.Repeat([]byte{byte(i)}, size)}
+	}
+	for i := 0; i < backlog; i++ {
+		in <- data(i)
+	}
+	for i := 0; i < 100*max/size; i++ {
+		in <- data(backlog + i)
+		co := <-out
+		if !bytes.Equal(co.Buf, data(i).Buf) {
+			t.Fatalf("message %d out of order", i)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("got %d spill files, %v", len(entries), err)
+		}
+		info, err := entries[0].Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > max+size {
+			t.Fatalf("spill file of %d bytes, limit %d", info.Size(), max)
+		}
+	}
+}
+
+// TestSpillDatagram sends a datagram split into parts for the framer to a destination whose
+// session spills them all, and checks that it arrives and is answered whole
+func TestSpillDatagram(t *testing.T) {
+	ca, cb := net.Pipe()
+	fa, fb := &cappedFramer{ConnFramer: NewConnFramer(ca), max: 1024}, &cappedFramer{ConnFramer: NewConnFramer(cb), max: 1024}
+	// Under pressure all data of the destination side is spilled
+	local, remote := &Tunnel{}, &Tunnel{SpillDir: t.TempDir(), MaxBufferedBytes: 1}
+	coch := serveFramers(t, local, remote, fa, fb)
+	// Datagram sessions need the features of the other side
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := local.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &UDPForwarder{Address: udpEcho(t), ConnectOperations: coch}
+	go f.Serve(ctx, pc)
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	msg := make([]byte, 3000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("got a datagram of %d bytes, sent %d", n, len(msg))
+	}
+}
@@ -0,0 +1,244 @@
+package portal
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the statistics of a tunnel
+type Stats struct {
+	// ReadFirstByte is the time from a session being connected to the first data read from
+	// the proxied connection. Only sessions that actually transferred data are measured
+	ReadFirstByte LatencyStats
+
+	// WriteFirstByte is the time from a session being connected to the first data written to
+	// the proxied connection. Only sessions that actually transferred data are measured
+	WriteFirstByte LatencyStats
+
+	// ActiveSessions is the number of sessions currently open
+	ActiveSessions int64
+
+	// SessionCapacity is the most sessions open at the same time, MaxSessions or the ids without it.
+	// SessionHighWater is the number of open sessions for OnCapacityWarning
+	SessionCapacity  int64
+	SessionHighWater int64
+
+	// PendingConnects is the number of sessions from the other side being connected on this side
+	PendingConnects int64
+
+	// Connects is the number of sessions connected, initiated by either side
+	Connects int64
+
+	// ConnectErrors is the number of sessions that failed to connect, initiated by either side.
+	// Each of them was answered with service unavailable
+	ConnectErrors int64
+
+	// SessionsThrottled is the number of sessions refused by MaxNewSessionsPerSecond, initiated by either side
+	SessionsThrottled int64
+
+	// BufferedBytes is the data currently held in memory by the queues of the sessions.
+	// MaxBufferedBytes is the limit of it, zero for none
+	BufferedBytes    int64
+	MaxBufferedBytes int64
+
+	// SessionsShed is the number of sessions closed by MaxBufferedBytes
+	SessionsShed int64
+
+	// BytesRead is the number of bytes read from the proxied connections
+	BytesRead int64
+
+	// BytesWritten is the number of bytes written to the proxied connections
+	BytesWritten int64
+
+	// EventsDropped is the number of events not written by LogEventsJSON as a writer was behind
+	EventsDropped int64
+
+	// Goroutines is the number of goroutines of the tunnel running: per tunnel connection, the
+	// mapper, tunnelWriter and keepalive, and per session, the proxyReader and proxyWriter, the
+	// queue with flow control or SpillDir, and the proxyConnector while connecting. It drops back
+	// once the sessions and connections end. MaxSessions bounds it with the sessions
+	Goroutines int64
+
+	// MapperP99Latency is the 99th percentile of the time the mapper takes to handle a message,
+	// since the tunnel started. It is rounded up to a power of 2 microseconds.
+	// It includes waiting for proxy writers without flow control. When it is high, the mapper
+	// is the bottleneck and more tunnels in parallel may help
+	MapperP99Latency time.Duration
+
+	// SessionDurations counts the sessions ended on both sides by how long they were open, in
+	// buckets of up to 1 second, 10 seconds, 1 minute, 10 minutes, 1 hour, and longer.
+	// Sessions that failed to connect or were cut by the tunnel ending are not counted
+	SessionDurations [6]int64
+
+	// KeepaliveRTT is the round trip time of the last answered keepalive ping. Zero if none
+	KeepaliveRTT time.Duration
+
+	// Uptime is how long the tunnel has been connected, since the longest served tunnel connection
+	// started. Zero while not serving
+	Uptime time.Duration
+}
+
+// LatencyStats summarizes a set of measured durations
+type LatencyStats struct {
+	Count int64
+	Min   time.Duration
+	Avg   time.Duration
+	Max   time.Duration
+}
+
+// latency accumulates durations from multiple goroutines
+type latency struct {
+	mu    sync.Mutex
+	count int64
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+}
+
+func (l *latency) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count == 0 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	l.count++
+	l.total += d
+}
+
+func (l *latency) stats() LatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := LatencyStats{Count: l.count, Min: l.min, Max: l.max}
+	if l.count > 0 {
+		s.Avg = l.total / time.Duration(l.count)
+	}
+	return s
+}
+
+// histogram counts durations in buckets of powers of 2 microseconds
+type histogram struct {
+	mu      sync.Mutex
+	count   int64
+	buckets [32]int64
+}
+
+func (h *histogram) add(d time.Duration) {
+	// Bucket i has durations up to 2^i microseconds
+	i := 0
+	for us := d.Microseconds(); us > 1<<i && i < len(h.buckets)-1; {
+		i++
+	}
+	h.mu.Lock()
+	h.count++
+	h.buckets[i]++
+	h.mu.Unlock()
+}
+
+// quantile returns the upper bound of the bucket with the q quantile
+func (h *histogram) quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	var n int64
+	for i, c := range h.buckets {
+		n += c
+		if float64(n) >= q*float64(h.count) {
+			return time.Duration(1<<i) * time.Microsecond
+		}
+	}
+	return time.Duration(1<<(len(h.buckets)-1)) * time.Microsecond
+}
+
+// sessionDurationBounds are the upper bounds of the buckets of SessionDurations but the last
+var sessionDurationBounds = [...]time.Duration{time.Second, 10 * time.Second, time.Minute, 10 * time.Minute, time.Hour}
+
+// counters are the counts of Stats updated from multiple goroutines. They are atomic, as the
+// proxyReaders and proxyWriters count each read and write
+type counters struct {
+	activeSessions    int64
+	pendingConnects   int64
+	connects          int64
+	connectErrors     int64
+	sessionsThrottled int64
+	bufferedBytes     int64
+	sessionsShed      int64
+	bytesRead         int64
+	bytesWritten      int64
+	goroutines        int64
+	eventsDropped     int64
+	keepaliveRTT      int64 // time.Duration
+	sessionDurations  [len(sessionDurationBounds) + 1]int64
+}
+
+func (c *counters) add(n *int64, d int64) {
+	atomic.AddInt64(n, d)
+}
+
+func (c *counters) addSessionDuration(d time.Duration) {
+	i := 0
+	for i < len(sessionDurationBounds) && d > sessionDurationBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&c.sessionDurations[i], 1)
+}
+
+func (c *counters) setKeepaliveRTT(d time.Duration) {
+	atomic.StoreInt64(&c.keepaliveRTT, int64(d))
+}
+
+// spawn runs f in a goroutine counted in Stats as Goroutines
+func (tn *Tunnel) spawn(f func()) {
+	tn.counters.add(&tn.counters.goroutines, 1)
+	go func() {
+		defer tn.counters.add(&tn.counters.goroutines, -1)
+		f()
+	}()
+}
+
+// Stats returns a snapshot of the tunnel statistics
+func (tn *Tunnel) Stats() Stats {
+	var uptime time.Duration
+	if started := tn.dumpers.oldest(); !started.IsZero() {
+		uptime = time.Since(started)
+	}
+	c := &tn.counters
+	var durations [len(c.sessionDurations)]int64
+	for i := range durations {
+		durations[i] = atomic.LoadInt64(&c.sessionDurations[i])
+	}
+	return Stats{
+		ReadFirstByte:     tn.readFirstByte.stats(),
+		WriteFirstByte:    tn.writeFirstByte.stats(),
+		ActiveSessions:    atomic.LoadInt64(&c.activeSessions),
+		SessionCapacity:   int64(tn.sessionCapacity()),
+		SessionHighWater:  int64(tn.sessionHighWater()),
+		PendingConnects:   atomic.LoadInt64(&c.pendingConnects),
+		Connects:          atomic.LoadInt64(&c.connects),
+		ConnectErrors:     atomic.LoadInt64(&c.connectErrors),
+		SessionsThrottled: atomic.LoadInt64(&c.sessionsThrottled),
+		BufferedBytes:     atomic.LoadInt64(&c.bufferedBytes),
+		MaxBufferedBytes:  tn.MaxBufferedBytes,
+		SessionsShed:      atomic.LoadInt64(&c.sessionsShed),
+		BytesRead:         atomic.LoadInt64(&c.bytesRead),
+		BytesWritten:      atomic.LoadInt64(&c.bytesWritten),
+		Goroutines:        atomic.LoadInt64(&c.goroutines),
+		EventsDropped:     atomic.LoadInt64(&c.eventsDropped),
+
+		MapperP99Latency: tn.mapperLatency.quantile(0.99),
+		SessionDurations: durations,
+		KeepaliveRTT:     time.Duration(atomic.LoadInt64(&c.keepaliveRTT)),
+		Uptime:           uptime,
+	}
+}
+
+// ActiveSessions returns the number of sessions currently open, initiated by either side, the
+// same as ActiveSessions of Stats, e.g. for a health endpoint. It is 0 while the tunnel is not serving
+func (tn *Tunnel) ActiveSessions() int {
+	return int(atomic.LoadInt64(&tn.counters.activeSessions))
+}
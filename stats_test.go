@@ -0,0 +1,73 @@
+package portal
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// TestGoroutines checks that Goroutines counts those of the sessions, and drops back to the
+// baseline once they close and to zero once the tunnel ends
+func TestGoroutines(t *testing.T) {
+	const sessions = 10
+	a, b := &Tunnel{}, &Tunnel{}
+	ca, cb := net.Pipe()
+	coch := make(chan ConnectOperation)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.Serve(ctx, NewConnFramer(ca), coch)
+	}()
+	go func() {
+		defer wg.Done()
+		b.Serve(ctx, NewConnFramer(cb), nil)
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	address := listen(t, echo)
+	idle := func() bool {
+		return a.Stats().ActiveSessions == 0 && b.Stats().ActiveSessions == 0
+	}
+
+	// The goroutines of the tunnel are all running once a session went through
+	c := dial(t, coch, address)
+	transfer(t, c, 100)
+	c.Close()
+	waitFor(t, "first session closed", idle)
+	base := [2]int64{a.Stats().Goroutines, b.Stats().Goroutines}
+	if base[0] <= 0 || base[1] <= 0 {
+		t.Fatalf("got %v goroutines of the tunnels", base)
+	}
+
+	var cs []net.Conn
+	for i := 0; i < sessions; i++ {
+		c := dial(t, coch, address)
+		transfer(t, c, 100)
+		cs = append(cs, c)
+	}
+	// A proxyReader and a proxyWriter for each session on each side
+	if n := a.Stats().Goroutines; n < base[0]+2*sessions {
+		t.Fatalf("got %d goroutines with %d sessions, %d without", n, sessions, base[0])
+	}
+	if n := b.Stats().Goroutines; n < base[1]+2*sessions {
+		t.Fatalf("got %d goroutines with %d sessions, %d without", n, sessions, base[1])
+	}
+
+	for _, c := range cs {
+		c.Close()
+	}
+	waitFor(t, "goroutines back to the baseline", func() bool {
+		return idle() && a.Stats().Goroutines == base[0] && b.Stats().Goroutines == base[1]
+	})
+
+	cancel()
+	wg.Wait()
+	waitFor(t, "no goroutines after the tunnel ends", func() bool {
+		return a.Stats().Goroutines == 0 && b.Stats().Goroutines == 0
+	})
+}
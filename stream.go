@@ -0,0 +1,124 @@
+package portal
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errStreamDeadline = errors.New("deadlines are not supported on HTTP/2 CONNECT streams")
+
+// streamConn is the connection of a session over the request and response bodies of a CONNECT
+// request of HTTP/2 or later, which cannot be hijacked. The bodies are only usable while the
+// handler serving the request runs, so the handler waits for it to be closed.
+// It does not support half close of writing, as the response ends when the handler returns
+type streamConn struct {
+	body   io.ReadCloser
+	w      http.ResponseWriter
+	f      http.Flusher
+	local  net.Addr
+	remote net.Addr
+
+	// Serializes the writes to w. The response status is written with the first write
+	mu      sync.Mutex
+	replied bool
+
+	closed int32
+	once   sync.Once
+	done   chan struct{}
+}
+
+func newStreamConn(w http.ResponseWriter, f http.Flusher, r *http.Request) *streamConn {
+	c := &streamConn{body: r.Body, w: w, f: f, done: make(chan struct{})}
+	c.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if a, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.remote = a
+	}
+	return c
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	if err != nil && atomic.LoadInt32(&c.closed) != 0 {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return 0, net.ErrClosed
+	}
+	c.replied = true
+	n, err := c.w.Write(b)
+	c.f.Flush()
+	return n, err
+}
+
+// reply writes the response status by the connect result, unless data was written already
+func (c *streamConn) reply(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replied {
+		return
+	}
+	c.replied = true
+	if err == nil {
+		c.w.WriteHeader(http.StatusOK)
+		c.f.Flush()
+	} else if errors.Is(err, ErrSessionRateLimited) {
+		http.Error(c.w, err.Error(), http.StatusTooManyRequests)
+	} else if errors.Is(err, ErrServiceUnavailable) || errors.Is(err, ErrTunnelClosed) {
+		http.Error(c.w, err.Error(), http.StatusServiceUnavailable)
+	} else {
+		http.Error(c.w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// Close ends the session side of the streams. A blocked Read returns as the request body is closed
+func (c *streamConn) Close() error {
+	c.once.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		c.body.Close()
+		close(c.done)
+	})
+	return nil
+}
+
+// wait blocks until the connection is closed, or closes it when the client is gone.
+// Then it waits for a write in progress, so the response is not written after the handler returns
+func (c *streamConn) wait(r *http.Request) {
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		c.Close()
+	}
+	c.mu.Lock()
+	c.mu.Unlock()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return errStreamDeadline
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return errStreamDeadline
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return errStreamDeadline
+}
@@ -0,0 +1,80 @@
+package portal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestHTTP2Connect sends CONNECT over HTTP/2, which cannot be hijacked, so the session goes over
+// the request and response bodies
+func TestHTTP2Connect(t *testing.T) {
+	address := listen(t, echo)
+	refused := listen(t, echo)
+	remote := &Tunnel{AllowDestination: func(a string) bool { return a != refused }}
+	coch := serveTunnel(t, &Tunnel{}, remote)
+	proxy := httptest.NewUnstartedServer(NewHTTPHandler(HTTPHandlerOptions{ConnectOperations: coch}))
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	defer proxy.Close()
+	client := proxy.Client()
+	pu, _ := url.Parse(proxy.URL)
+
+	// The request goes to the proxy at URL, and Host is the address to connect to
+	connect := func(t *testing.T, address string, body io.Reader) *http.Response {
+		t.Helper()
+		resp, err := client.Do(&http.Request{
+			Method: http.MethodConnect,
+			URL:    pu,
+			Host:   address,
+			Header: http.Header{},
+			Body:   io.NopCloser(body),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A stalled stream fails the reads instead of hanging the test
+		timer := time.AfterFunc(5*time.Second, func() { resp.Body.Close() })
+		t.Cleanup(func() {
+			timer.Stop()
+			resp.Body.Close()
+		})
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("got %s, want HTTP/2", resp.Proto)
+		}
+		return resp
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		resp := connect(t, address, pr)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d", resp.StatusCode)
+		}
+		// Each write is echoed before the next, so the streams are flushed as they go
+		for _, msg := range []string{"hello", "again"} {
+			go io.WriteString(pw, msg)
+			b := make([]byte, len(msg))
+			if _, err := io.ReadFull(resp.Body, b); err != nil || string(b) != msg {
+				t.Fatalf("got %q %v", b, err)
+			}
+		}
+		// Closing the request body ends the session
+		pw.Close()
+		if _, err := io.ReadAll(resp.Body); err != nil {
+			t.Fatalf("response not ended after the request body: %v", err)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		if resp := connect(t, refused, pr); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+		}
+	})
+}
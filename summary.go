@@ -0,0 +1,100 @@
+package portal
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Summary is the record of one tunnel connection, from Serve starting to returning
+type Summary struct {
+	// Duration is how long the connection was served
+	Duration time.Duration
+
+	// Sessions is the number of sessions connected, initiated by either side
+	Sessions int64
+
+	// PeakSessions is the largest number of sessions open at the same time
+	PeakSessions int64
+
+	// AvgSessionDuration is the average time sessions ended on both sides were open. Zero if none
+	AvgSessionDuration time.Duration
+
+	// BytesRead is the number of bytes read from the proxied connections
+	BytesRead int64
+
+	// BytesWritten is the number of bytes written to the proxied connections
+	BytesWritten int64
+
+	// Err is why the connection ended: io.EOF when the other side closed it, the error the
+	// connection was closed with by the tunnel, e.g. ErrKeepaliveTimeout, the read error,
+	// or the error of ctx
+	Err error
+
+	// Features are the features in use on the connection
+	Features Features
+}
+
+// summary accumulates the record of a tunnel connection for Summary. The counts are atomic, like
+// those of Stats, as the proxyReaders and proxyWriters count each read and write
+type summary struct {
+	sessions     int64
+	bytesRead    int64
+	bytesWritten int64
+
+	mu        sync.Mutex
+	peak      int64
+	ended     int64
+	durations time.Duration
+	err       error
+}
+
+func (s *summary) active(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > s.peak {
+		s.peak = n
+	}
+}
+
+func (s *summary) sessionEnded(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended++
+	s.durations += d
+}
+
+// closed records the first reason of the connection ending
+func (s *summary) closed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// sessionEnded records the duration of a session of the connection tc ended on both sides
+func (tn *Tunnel) sessionEnded(tc *tunnelConn, d time.Duration) {
+	tn.counters.addSessionDuration(d)
+	tc.summary.sessionEnded(d)
+}
+
+// makeSummary builds the summary of the connection tc served since start
+func (tn *Tunnel) makeSummary(tc *tunnelConn, start time.Time) Summary {
+	s := &tc.summary
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := Summary{
+		Duration:     time.Since(start),
+		Sessions:     atomic.LoadInt64(&s.sessions),
+		PeakSessions: s.peak,
+		BytesRead:    atomic.LoadInt64(&s.bytesRead),
+		BytesWritten: atomic.LoadInt64(&s.bytesWritten),
+		Err:          s.err,
+		Features:     tc.handshake.get(),
+	}
+	if s.ended > 0 {
+		sum.AvgSessionDuration = s.durations / time.Duration(s.ended)
+	}
+	return sum
+}
@@ -0,0 +1,42 @@
+package portal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSummaryPerConnection serves two tunnel connections with one Tunnel at the same time, with
+// sessions on both, and checks that the summary of each only counts its own
+func TestSummaryPerConnection(t *testing.T) {
+	summaries := make(chan Summary, 2)
+	hub := &Tunnel{OnClose: func(sm Summary) { summaries <- sm }}
+	address := listen(t, echo)
+	// connect serves hub with a new peer and returns the channel for its sessions and the end of
+	// the peer, which ends both when closed
+	connect := func() (chan<- ConnectOperation, net.Conn) {
+		ca, cb := net.Pipe()
+		t.Cleanup(func() { cb.Close() })
+		coch := make(chan ConnectOperation)
+		go hub.Serve(context.Background(), NewConnFramer(ca), nil)
+		go (&Tunnel{}).Serve(context.Background(), NewConnFramer(cb), coch)
+		return coch, cb
+	}
+
+	first, end := connect()
+	second, _ := connect()
+	transfer(t, dial(t, first, address), 100)
+	for i := 0; i < 2; i++ {
+		transfer(t, dial(t, second, address), 1000)
+	}
+	end.Close()
+	select {
+	case sm := <-summaries:
+		if sm.Sessions != 1 || sm.PeakSessions != 1 || sm.BytesRead != 100 || sm.BytesWritten != 100 {
+			t.Fatalf("got summary %+v of the first connection", sm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first connection not ended")
+	}
+}
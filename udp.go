@@ -0,0 +1,184 @@
+package portal
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxDatagramSize is the largest payload of a UDP datagram
+const maxDatagramSize = 65535
+
+// udpFlowBacklog is the most datagrams of a client waiting for its session. More are dropped,
+// like by a full socket buffer
+const udpFlowBacklog = 64
+
+// UDPForwarder forwards the datagrams received on a UDP socket of this side to an address on the
+// other side, e.g. a DNS server, as sessions of datagrams. Each client address gets its own
+// session, so the answers go back to the client that sent the request. A session ends with
+// IdleTimeout of the tunnel, and the next datagram of the client starts a new one
+type UDPForwarder struct {
+	// Address on the other side the datagrams are sent to
+	Address string
+
+	// ConnectOperations is the channel of the tunnel the sessions are started on, as given to Serve
+	ConnectOperations chan<- ConnectOperation
+
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+}
+
+// Serve reads the datagrams from pc and forwards them until reading fails or ctx is done.
+// It closes pc and the sessions of the clients when it returns, and returns why
+func (f *UDPForwarder) Serve(ctx context.Context, pc net.PacketConn) error {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		pc.Close()
+		f.mu.Lock()
+		flows := f.flows
+		f.flows = nil
+		f.mu.Unlock()
+		for _, c := range flows {
+			c.Close()
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.Close()
+		case <-done:
+		}
+	}()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		c := f.flow(ctx, pc, addr)
+		select {
+		case c.in <- append([]byte(nil), buf[:n]...):
+		default:
+			// The session is behind. Drop it as UDP would
+		}
+	}
+}
+
+// flow returns the flow of the client, starting a session for it if it has none
+func (f *UDPForwarder) flow(ctx context.Context, pc net.PacketConn, addr net.Addr) *udpFlow {
+	key := addr.String()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.flows[key]; ok {
+		return c
+	}
+	if f.flows == nil {
+		f.flows = make(map[string]*udpFlow)
+	}
+	c := &udpFlow{pc: pc, addr: addr, in: make(chan []byte, udpFlowBacklog), closed: make(chan struct{})}
+	c.onClose = func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.flows[key] == c {
+			delete(f.flows, key)
+		}
+	}
+	f.flows[key] = c
+	sessionLogf(-1, "UDP flow: %s", connString(c, f.Address))
+	go func() {
+		rch := make(chan error, 1)
+		select {
+		case f.ConnectOperations <- ConnectOperation{Conn: c, Address: f.Address, Result: rch, Datagram: true}:
+		case <-ctx.Done():
+			c.Close()
+			return
+		}
+		if err := <-rch; err != nil {
+			logf("UDP flow connect error. conn=%s err=%v", connString(c, f.Address), err)
+			c.Close()
+		}
+	}()
+	return c
+}
+
+// udpFlow is the connection of a session of datagrams of one client of UDPForwarder.
+// It reads the datagrams of the client received by the forwarder, and writes to the client
+type udpFlow struct {
+	pc      net.PacketConn
+	addr    net.Addr
+	in      chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	onClose func()
+
+	mu sync.Mutex
+	// Read deadline. It applies to the reads started after it is set
+	deadline time.Time
+}
+
+func (c *udpFlow) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	d := c.deadline
+	c.mu.Unlock()
+	var tch <-chan time.Time
+	if !d.IsZero() {
+		t := time.NewTimer(time.Until(d))
+		defer t.Stop()
+		tch = t.C
+	}
+	select {
+	case p := <-c.in:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-tch:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *udpFlow) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.pc.WriteTo(b, c.addr)
+}
+
+func (c *udpFlow) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *udpFlow) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *udpFlow) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *udpFlow) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpFlow) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writing a datagram does not block
+func (c *udpFlow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
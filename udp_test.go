@@ -0,0 +1,84 @@
+package portal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEcho starts a UDP destination that answers each datagram with itself until the test ends
+func udpEcho(t testing.TB) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// TestUDPDatagrams sends datagrams of different sizes back to back, and checks that each is
+// answered whole with its own content, while the sessions read them into one buffer
+func TestUDPDatagrams(t *testing.T) {
+	local, remote := &Tunnel{}, &Tunnel{}
+	coch := serveTunnel(t, local, remote)
+	// Datagram sessions need the features of the other side
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := local.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &UDPForwarder{Address: udpEcho(t), ConnectOperations: coch}
+	go f.Serve(ctx, pc)
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	const count = 50
+	for i := 0; i < count; i++ {
+		msg := make([]byte, 10+i*20)
+		for j := range msg {
+			msg[j] = byte(i)
+		}
+		if _, err := client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxDatagramSize)
+	got := make(map[int]bool)
+	for len(got) < count {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d datagrams: %v", len(got), count, err)
+		}
+		i := int(buf[0])
+		if n != 10+i*20 {
+			t.Fatalf("got a datagram of %d bytes for %d", n, i)
+		}
+		for _, b := range buf[:n] {
+			if int(b) != i {
+				t.Fatalf("got datagram %d mixed with %d", i, b)
+			}
+		}
+		got[i] = true
+	}
+}
@@ -0,0 +1,160 @@
+package portal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oatcode/portal/pkg/message"
+)
+
+// window limits the data of a session sent to the other side but not yet written to its connection.
+// The proxyReader waits on it before reading, so at most one read buffer goes over the size.
+// With maxMessages, it also limits the DATA messages, so exactly maxMessages at most are queued.
+// The mapper releases the acknowledged bytes and messages and closes it when the session ends
+type window struct {
+	mu          sync.Mutex
+	size        int
+	used        int
+	maxMessages int
+	messages    int
+	closed      bool
+	// Wakes up the waiting proxyReader
+	ch chan struct{}
+}
+
+func newWindow(size int, maxMessages int) *window {
+	return &window{size: size, maxMessages: maxMessages, ch: make(chan struct{}, 1)}
+}
+
+// wait blocks until there is room in the window or the window is closed.
+// It returns false if ctx is done
+func (w *window) wait(ctx context.Context) bool {
+	for {
+		w.mu.Lock()
+		ok := w.closed || (w.used < w.size && (w.maxMessages <= 0 || w.messages < w.maxMessages))
+		w.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-w.ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// use counts a DATA message of n bytes sent
+func (w *window) use(n int) {
+	w.mu.Lock()
+	w.used += n
+	w.messages++
+	w.mu.Unlock()
+}
+
+// release frees the n bytes and messages acknowledged. A message split into parts for the
+// Framer is acknowledged part by part, so messages do not go below zero
+func (w *window) release(n int, messages int) {
+	w.mu.Lock()
+	w.used -= n
+	w.messages -= messages
+	if w.messages < 0 {
+		w.messages = 0
+	}
+	w.mu.Unlock()
+	w.wake()
+}
+
+// unacked returns the bytes sent but not yet acknowledged
+func (w *window) unacked() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.used
+}
+
+func (w *window) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.wake()
+}
+
+func (w *window) wake() {
+	select {
+	case w.ch <- struct{}{}:
+	default:
+	}
+}
+
+// queue forwards messages from in to out in order without blocking the sender.
+// It is put in front of a proxyWriter with flow control, where the other side limits
+// the data in the queue by the window. The data queued is counted in b, and the messages
+// in the queued of the session.
+// out is closed after in is closed and the queue is empty, or when ctx is done
+func queue(ctx context.Context, in <-chan *message.Message, out chan<- *message.Message, b *bufferAccount) {
+	defer close(out)
+	var q []*message.Message
+	defer func() {
+		for _, co := range q {
+			b.add(-len(co.Buf))
+		}
+		atomic.AddInt64(&b.si.queued, int64(-len(q)))
+	}()
+	for in != nil || len(q) > 0 {
+		var och chan<- *message.Message
+		var co *message.Message
+		if len(q) > 0 {
+			och = out
+			co = q[0]
+		}
+		select {
+		case i, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			q = append(q, i)
+			b.add(len(i.Buf))
+			atomic.AddInt64(&b.si.queued, 1)
+		case och <- co:
+			b.add(-len(co.Buf))
+			atomic.AddInt64(&b.si.queued, -1)
+			q[0] = nil
+			q = q[1:]
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetWindowSize changes WindowSize while the tunnel may be serving. Sessions keep the window they
+// were connected with, so the new size only applies to sessions connected after
+func (tn *Tunnel) SetWindowSize(n int) {
+	tn.windowMu.Lock()
+	defer tn.windowMu.Unlock()
+	tn.WindowSize = n
+}
+
+// windowSize returns WindowSize, or the window of the profile if zero. Negative is no flow control
+func (tn *Tunnel) windowSize() int {
+	tn.windowMu.Lock()
+	defer tn.windowMu.Unlock()
+	if tn.WindowSize < 0 {
+		return 0
+	}
+	if tn.WindowSize == 0 {
+		return tn.profile().windowSize
+	}
+	return tn.WindowSize
+}
+
+// sessionWindow returns the receive window of a new session on a tunnel connection with the
+// features f. With LegacyCompat, there is none unless the other side announced flow control, as
+// an older side does not know ACK
+func (tn *Tunnel) sessionWindow(f Features) int {
+	if tn.LegacyCompat && !f.FlowControl {
+		return 0
+	}
+	return tn.windowSize()
+}
@@ -0,0 +1,87 @@
+package portal
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWindowSlowReader has a fast destination and a client that does not read for a while. The
+// data read from the destination stops at the window of the client side, plus one read buffer,
+// and the other sessions of the tunnel go on meanwhile
+func TestWindowSlowReader(t *testing.T) {
+	const window = 16 * 1024
+	const total = 4 << 20
+	client, remote := &Tunnel{WindowSize: window}, &Tunnel{}
+	coch := serveTunnel(t, client, remote)
+	address := listen(t, func(c net.Conn) {
+		defer c.Close()
+		c.Write(make([]byte, total))
+	})
+	c := dial(t, coch, address)
+
+	waitFor(t, "data", func() bool { return remote.Stats().BytesRead > 0 })
+	time.Sleep(200 * time.Millisecond)
+	if n := remote.Stats().BytesRead; n > window+bufferSize {
+		t.Fatalf("read %d bytes from the destination for a window of %d", n, window)
+	}
+	if n := client.Stats().BufferedBytes; n > window+bufferSize {
+		t.Fatalf("%d bytes buffered for a window of %d", n, window)
+	}
+
+	e := dial(t, coch, listen(t, echo))
+	e.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(e, "hi")
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(e, b); err != nil {
+		t.Fatalf("other session blocked by the slow reader: %v", err)
+	}
+
+	n, err := io.Copy(io.Discard, c)
+	if err != nil || n != total {
+		t.Fatalf("got %d bytes %v, want %d", n, err, total)
+	}
+}
+
+// TestMaxQueuedMessagesPerSession has a destination writing small messages to a client that does
+// not read for a while. The data read from the destination stops at the message limit, far
+// below the window, and all of it arrives once the client reads
+func TestMaxQueuedMessagesPerSession(t *testing.T) {
+	const window = 1 << 20
+	const max = 8
+	const total = 4 << 20
+	local := &Tunnel{WindowSize: window, MaxQueuedMessagesPerSession: max}
+	remote := &Tunnel{WindowSize: window}
+	coch := serveTunnel(t, local, remote)
+	address := listen(t, func(c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 1024)
+		for n := 0; n < total; n += len(b) {
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		}
+	})
+	c := dial(t, coch, address)
+
+	// Each message is at most a read buffer, with one more being read and one being written
+	waitFor(t, "data", func() bool { return remote.Stats().BytesRead > 0 })
+	time.Sleep(100 * time.Millisecond)
+	if n := remote.Stats().BytesRead; n > (max+2)*int64(remote.readBufferSize()) {
+		t.Fatalf("read %d bytes from the destination while paused, limit %d messages", n, max)
+	}
+	// The message being written to the client is out of the queue
+	var dump bytes.Buffer
+	local.DebugDump(&dump)
+	if !strings.Contains(dump.String(), " queued=7/8") {
+		t.Fatalf("queue depth not in dump:\n%s", dump.String())
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := io.Copy(io.Discard, c); n != total || err != nil {
+		t.Fatalf("got %d of %d bytes, %v", n, total, err)
+	}
+}
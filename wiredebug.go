@@ -0,0 +1,59 @@
+package portal
+
+import "encoding/hex"
+
+const defaultWireDebugMaxBytes = 256
+
+// wireDebugFramer logs a hex dump of the bytes of each frame read and written by a Framer
+type wireDebugFramer struct {
+	c    Framer
+	max  int
+	logf func(string, ...interface{})
+}
+
+func newWireDebugFramer(c Framer, max int, logf func(string, ...interface{})) *wireDebugFramer {
+	if max <= 0 {
+		max = defaultWireDebugMaxBytes
+	}
+	return &wireDebugFramer{c: c, max: max, logf: logf}
+}
+
+func (w *wireDebugFramer) Read() ([]byte, error) {
+	b, err := w.c.Read()
+	if err != nil {
+		w.logf("wire read error. err=%v", err)
+	} else {
+		w.dump("read", b)
+	}
+	return b, err
+}
+
+func (w *wireDebugFramer) Write(b []byte) error {
+	// Dump before writing, as b may be reused once Write returns
+	w.dump("write", b)
+	err := w.c.Write(b)
+	if err != nil {
+		w.logf("wire write error. err=%v", err)
+	}
+	return err
+}
+
+func (w *wireDebugFramer) Close(err error) error {
+	return w.c.Close(err)
+}
+
+// MaxMessageSize passes on the limit of the Framer, if any
+func (w *wireDebugFramer) MaxMessageSize() int {
+	if s, ok := w.c.(MaxMessageSizer); ok {
+		return s.MaxMessageSize()
+	}
+	return 0
+}
+
+func (w *wireDebugFramer) dump(dir string, b []byte) {
+	d := b
+	if len(d) > w.max {
+		d = d[:w.max]
+	}
+	w.logf("wire %s. len=%d dumped=%d\n%s", dir, len(b), len(d), hex.Dump(d))
+}